@@ -23,6 +23,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
 	"github.com/TencentBlueKing/bk-bscp/pkg/version"
@@ -155,12 +156,40 @@ func Watch(cmd *cobra.Command, args []string) error {
 		client.WithP2PDownload(conf.EnableP2PDownload),
 		client.WithBkAgentID(conf.BkAgentID),
 		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
+			Enabled:                conf.FileCache.Enabled,
+			CacheDir:               conf.FileCache.CacheDir,
+			ThresholdGB:            conf.FileCache.ThresholdGB,
+			CleanupIntervalSeconds: conf.FileCache.CleanupIntervalSeconds,
+			RetentionRate:          conf.FileCache.RetentionRate,
+			EvictionPolicy:         conf.FileCache.EvictionPolicy,
+			Materialize:            conf.FileCache.Materialize,
+			PrefetchConcurrency:    conf.FileCache.PrefetchConcurrency,
 		}),
 		client.WithEnableMonitorResourceUsage(conf.EnableMonitorResourceUsage),
 		client.WithTextLineBreak(conf.TextLineBreak),
+		client.WithEventRetention(conf.EventRetention),
+		client.WithReleaseHistory(conf.ReleaseHistory),
+		client.WithHookTimeout(client.HookTimeout{
+			PreHook:  conf.HookTimeout.PreHook(),
+			PostHook: conf.HookTimeout.PostHook(),
+		}),
+		client.WithBounce(client.Bounce{
+			Enabled:  conf.Bounce.Enabled,
+			Interval: time.Duration(conf.Bounce.IntervalSeconds) * time.Second,
+			Jitter:   time.Duration(conf.Bounce.JitterSeconds) * time.Second,
+		}),
+		client.WithBandwidthLimit(bandwidthLimit(conf.BandwidthLimit)),
+		client.WithRangeDownload(client.RangeDownload{
+			MaxPartBytes:   conf.RangeDownload.MaxPartBytes,
+			MaxConcurrency: conf.RangeDownload.MaxConcurrency,
+			WaitTimeMil:    conf.RangeDownload.WaitTimeMs,
+		}),
+		client.WithAsyncDownload(client.AsyncDownload{
+			MinFileBytes:    conf.P2PDownload.MinFileBytes,
+			Timeout:         time.Duration(conf.P2PDownload.TimeoutSeconds) * time.Second,
+			PollInterval:    time.Duration(conf.P2PDownload.PollIntervalSeconds) * time.Second,
+			MaxPollInterval: time.Duration(conf.P2PDownload.MaxPollIntervalSeconds) * time.Second,
+		}),
 	)
 	if err != nil {
 		logger.Error("init client", logger.ErrAttr(err))
@@ -347,6 +376,23 @@ func init() {
 		&configPath, "config", "c", defaultConfigPath, "config file path")
 }
 
+// bandwidthLimit 转换带宽限制配置为 client 选项
+func bandwidthLimit(c *config.BandwidthLimitConfig) client.BandwidthLimit {
+	l := client.BandwidthLimit{
+		BytesPerSecond:       c.BytesPerSecond,
+		BurstBytes:           c.BurstBytes,
+		WarmupBytesPerSecond: c.WarmupBytesPerSecond,
+	}
+	for _, s := range c.Schedules {
+		l.Schedules = append(l.Schedules, client.BandwidthSchedule{
+			Start:          s.Start,
+			End:            s.End,
+			BytesPerSecond: s.BytesPerSecond,
+		})
+	}
+	return l
+}
+
 // setLogger 自定义日志
 func setLogger(w io.Writer) {
 	textHandler := slog.NewTextHandler(w, &slog.HandlerOptions{
@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
+
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+)
+
+var (
+	// ErrContentNotFound should be returned by DownloadBackend.Open when the backend does not have the content,
+	// then the next backend in the chain is tried.
+	ErrContentNotFound = downloader.ErrBackendContentNotFound
+
+	// BuiltinDownloadBackend stands for the built-in async p2p and http downloaders in the download backend chain,
+	// use it to decide whether the custom backends are tried before or after the built-in ones.
+	BuiltinDownloadBackend DownloadBackend = downloader.BuiltinBackend
+)
+
+// DownloadBackend is a pluggable source of the config item content, such as an internal http mirror,
+// an S3-compatible bucket or a local NFS directory. the content supplied by any backend is verified with
+// the signature before it is used.
+type DownloadBackend interface {
+	// Name returns the name of the backend, used in logs and metrics.
+	Name() string
+	// Open opens the content stream of the config item, signature is the SHA256 of the content.
+	// the caller is responsible for closing the returned reader.
+	Open(ctx context.Context, fileMeta *pbfs.FileMeta, signature string) (io.ReadCloser, error)
+}
+
+// dirDownloadBackend reads the content from a local directory laid out by signature.
+type dirDownloadBackend struct {
+	dir string
+}
+
+// NewDirDownloadBackend returns a download backend which reads the content from a local directory,
+// such as a NFS directory, the content is stored in the file named by its signature.
+func NewDirDownloadBackend(dir string) DownloadBackend {
+	return &dirDownloadBackend{dir: dir}
+}
+
+// Name returns the name of the backend.
+func (b *dirDownloadBackend) Name() string {
+	return "dir"
+}
+
+// Open opens the file named by the signature in the directory.
+func (b *dirDownloadBackend) Open(_ context.Context, _ *pbfs.FileMeta, signature string) (io.ReadCloser, error) {
+	if signature == "" {
+		return nil, ErrContentNotFound
+	}
+	file, err := os.Open(filepath.Join(b.dir, filepath.Base(signature)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrContentNotFound
+		}
+		return nil, fmt.Errorf("open content file failed, err: %s", err.Error())
+	}
+	return file, nil
+}
+
+// toDownloaderBackends converts the download backends to the downloader ones
+func toDownloaderBackends(backends []DownloadBackend) []downloader.Backend {
+	result := make([]downloader.Backend, 0, len(backends))
+	for _, b := range backends {
+		result = append(result, b)
+	}
+	return result
+}
@@ -0,0 +1,442 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	pbhook "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/hook"
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// bundleVersion is the format version of the offline bundle
+	bundleVersion = 1
+	// bundleManifestName is the name of the manifest in the bundle
+	bundleManifestName = "manifest.json"
+	// bundleSignatureName is the name of the hex encoded ed25519 signature of the manifest in the bundle
+	bundleSignatureName = "manifest.sig"
+	// bundleContentsDir is the directory of the contents in the bundle and the bundle store, the contents are
+	// named by their SHA256
+	bundleContentsDir = "contents"
+	// bundleKvsFile is the file which the kvs of the bundle are saved to in the app dir
+	bundleKvsFile = "kvs.json"
+	// appConfigTypeKv is the config type of kv app
+	appConfigTypeKv = "kv"
+	// kvTypeSecret is the kv type of the secret kvs, which are not exported into the bundle in plaintext
+	kvTypeSecret = "secret"
+)
+
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ErrBundleSignature is returned when the signature of the bundle is not verified
+var ErrBundleSignature = errors.New("bundle signature is not verified")
+
+// BundleManifest describes the release in an offline bundle
+type BundleManifest struct {
+	Version     int                     `json:"version"`
+	BizID       uint32                  `json:"biz_id"`
+	App         string                  `json:"app"`
+	ReleaseID   uint32                  `json:"release_id"`
+	ReleaseName string                  `json:"release_name"`
+	CreatedAt   time.Time               `json:"created_at"`
+	Files       []*sfs.ConfigItemMetaV1 `json:"files"`
+	Kvs         []*BundleKv             `json:"kvs"`
+	PreHook     *pbhook.HookSpec        `json:"pre_hook"`
+	PostHook    *pbhook.HookSpec        `json:"post_hook"`
+}
+
+// BundleKv is a kv with its value in the bundle
+type BundleKv struct {
+	Key    string `json:"key"`
+	KvType string `json:"kv_type"`
+	Value  string `json:"value"`
+}
+
+// ExportBundle pulls the release of the app, and writes the file metas, contents, kvs and hooks into w as
+// a gzipped tarball, the manifest is signed by the key and the contents are named by their SHA256
+func (c *client) ExportBundle(app string, w io.Writer, key ed25519.PrivateKey, opts ...AppOption) (
+	*BundleManifest, error) {
+	m := &BundleManifest{Version: bundleVersion, BizID: c.opts.bizID, App: app, CreatedAt: time.Now().UTC()}
+
+	apps, err := c.ListApps([]string{app})
+	if err != nil {
+		return nil, fmt.Errorf("list app %s failed, err: %s", app, err.Error())
+	}
+	var files []*ConfigItemFile
+	if len(apps) > 0 && apps[0].ConfigType == appConfigTypeKv {
+		if err = c.exportKvs(m, app, opts...); err != nil {
+			return nil, err
+		}
+	} else {
+		release, e := c.PullFiles(app, opts...)
+		if e != nil {
+			return nil, fmt.Errorf("pull files of app %s failed, err: %s", app, e.Error())
+		}
+		m.ReleaseID, m.ReleaseName = release.ReleaseID, release.ReleaseName
+		m.PreHook, m.PostHook = release.PreHook, release.PostHook
+		files = release.FileItems
+		for _, f := range files {
+			m.Files = append(m.Files, f.FileMeta)
+		}
+	}
+
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("encode bundle manifest failed, err: %s", err.Error())
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	// the manifest is written first, so that it can be verified before reading the contents
+	if err = writeTarEntry(tw, bundleManifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+	sig := []byte(hex.EncodeToString(ed25519.Sign(key, manifest)))
+	if err = writeTarEntry(tw, bundleSignatureName, int64(len(sig)), bytes.NewReader(sig)); err != nil {
+		return nil, err
+	}
+	if err = exportContents(tw, files); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, fmt.Errorf("close bundle tarball failed, err: %s", err.Error())
+	}
+	if err = gw.Close(); err != nil {
+		return nil, fmt.Errorf("close bundle gzip failed, err: %s", err.Error())
+	}
+	return m, nil
+}
+
+// exportKvs pulls the kvs and their values of the kv app into the manifest, the secret kvs are skipped
+// since the bundle is not encrypted
+func (c *client) exportKvs(m *BundleManifest, app string, opts ...AppOption) error {
+	release, err := c.PullKvs(app, nil, opts...)
+	if err != nil {
+		return fmt.Errorf("pull kvs of app %s failed, err: %s", app, err.Error())
+	}
+	m.ReleaseID = release.ReleaseID
+	for _, kv := range release.KvItems {
+		if kv.KvType == kvTypeSecret {
+			logger.Warn("skip secret kv in bundle", slog.String("app", app), slog.String("key", kv.Key))
+			continue
+		}
+		value, err := c.Get(app, kv.Key, opts...)
+		if err != nil {
+			return fmt.Errorf("get kv %s of app %s failed, err: %s", kv.Key, app, err.Error())
+		}
+		m.Kvs = append(m.Kvs, &BundleKv{Key: kv.Key, KvType: kv.KvType, Value: value})
+	}
+	return nil
+}
+
+// exportContents downloads the contents of the files and writes them into the tarball, the same content is
+// written only once
+func exportContents(tw *tar.Writer, files []*ConfigItemFile) error {
+	tmpDir, err := os.MkdirTemp("", "bscp-bundle-")
+	if err != nil {
+		return fmt.Errorf("create bundle temp dir failed, err: %s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+
+	written := make(map[string]bool)
+	for _, f := range files {
+		sig := f.FileMeta.ContentSpec.Signature
+		if written[sig] {
+			continue
+		}
+		tmpFile := filepath.Join(tmpDir, sig)
+		if err := f.SaveToFile(tmpFile); err != nil {
+			return fmt.Errorf("download file %s failed, err: %s", path.Join(f.Path, f.Name), err.Error())
+		}
+		file, err := os.Open(tmpFile)
+		if err != nil {
+			return fmt.Errorf("open downloaded file failed, err: %s", err.Error())
+		}
+		err = writeTarEntry(tw, path.Join(bundleContentsDir, sig), int64(f.FileMeta.ContentSpec.ByteSize), file)
+		file.Close()
+		os.Remove(tmpFile)
+		if err != nil {
+			return err
+		}
+		written[sig] = true
+	}
+	return nil
+}
+
+// writeTarEntry writes a regular file entry into the tarball
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write bundle entry %s header failed, err: %s", name, err.Error())
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("write bundle entry %s failed, err: %s", name, err.Error())
+	}
+	return nil
+}
+
+// Bundle is an offline bundle imported into the local bundle store
+type Bundle struct {
+	manifest *BundleManifest
+	// storeDir is the root dir of the bundle store
+	storeDir string
+}
+
+// Manifest returns the manifest of the bundle
+func (b *Bundle) Manifest() *BundleManifest {
+	return b.manifest
+}
+
+// bundleReleaseDir returns the dir where the manifest of the release is stored
+func bundleReleaseDir(storeDir string, bizID uint32, app string, releaseID uint32) string {
+	return filepath.Join(storeDir, strconv.Itoa(int(bizID)), app, strconv.Itoa(int(releaseID)))
+}
+
+// ImportBundle verifies the bundle with the public key and imports it into the store dir, the contents are
+// verified against the signatures in the manifest and shared by all the imported bundles
+func ImportBundle(r io.Reader, storeDir string, key ed25519.PublicKey) (*Bundle, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("open bundle gzip failed, err: %s", err.Error())
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	var manifest, sig []byte
+	for manifest == nil || sig == nil {
+		hdr, e := tr.Next()
+		if e != nil {
+			return nil, fmt.Errorf("read bundle manifest failed, err: %v", e)
+		}
+		switch hdr.Name {
+		case bundleManifestName:
+			manifest, err = io.ReadAll(tr)
+		case bundleSignatureName:
+			sig, err = io.ReadAll(tr)
+		default:
+			return nil, fmt.Errorf("unexpected bundle entry %s before the manifest", hdr.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read bundle entry %s failed, err: %s", hdr.Name, err.Error())
+		}
+	}
+	m, err := verifyManifest(manifest, sig, key)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make(map[string]uint64)
+	for _, f := range m.Files {
+		expected[f.ContentSpec.Signature] = f.ContentSpec.ByteSize
+	}
+	contentsDir := filepath.Join(storeDir, bundleContentsDir)
+	if err = os.MkdirAll(contentsDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("create bundle contents dir failed, err: %s", err.Error())
+	}
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, fmt.Errorf("read bundle failed, err: %s", e.Error())
+		}
+		dir, name := path.Split(hdr.Name)
+		size, ok := expected[name]
+		if path.Clean(dir) != bundleContentsDir || !ok {
+			return nil, fmt.Errorf("unexpected bundle entry %s", hdr.Name)
+		}
+		if err = importContent(tr, contentsDir, name, size); err != nil {
+			return nil, err
+		}
+		delete(expected, name)
+	}
+	// the content may be imported by another bundle before
+	for name := range expected {
+		if _, err = os.Stat(filepath.Join(contentsDir, name)); err != nil {
+			return nil, fmt.Errorf("content %s is missing in the bundle", name)
+		}
+	}
+
+	if err = saveManifest(storeDir, m, manifest, sig); err != nil {
+		return nil, err
+	}
+	logger.Info("import bundle success", slog.String("app", m.App), slog.Any("releaseID", m.ReleaseID),
+		slog.Int("files", len(m.Files)), slog.Int("kvs", len(m.Kvs)))
+	return &Bundle{manifest: m, storeDir: storeDir}, nil
+}
+
+// LoadBundle loads the bundle imported into the store dir before, and verifies it with the public key again
+func LoadBundle(storeDir string, bizID uint32, app string, releaseID uint32, key ed25519.PublicKey) (
+	*Bundle, error) {
+	dir := bundleReleaseDir(storeDir, bizID, app, releaseID)
+	manifest, err := os.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("read bundle manifest failed, err: %s", err.Error())
+	}
+	sig, err := os.ReadFile(filepath.Join(dir, bundleSignatureName))
+	if err != nil {
+		return nil, fmt.Errorf("read bundle signature failed, err: %s", err.Error())
+	}
+	m, err := verifyManifest(manifest, sig, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Bundle{manifest: m, storeDir: storeDir}, nil
+}
+
+// verifyManifest verifies the signature of the manifest and decodes it
+func verifyManifest(manifest, sig []byte, key ed25519.PublicKey) (*BundleManifest, error) {
+	s, err := hex.DecodeString(string(sig))
+	if err != nil || !ed25519.Verify(key, manifest, s) {
+		return nil, ErrBundleSignature
+	}
+	m := new(BundleManifest)
+	if err := json.Unmarshal(manifest, m); err != nil {
+		return nil, fmt.Errorf("decode bundle manifest failed, err: %s", err.Error())
+	}
+	if m.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", m.Version)
+	}
+	for _, f := range m.Files {
+		if f.ContentSpec == nil || f.ConfigItemSpec == nil || !sha256Regexp.MatchString(f.ContentSpec.Signature) {
+			return nil, fmt.Errorf("invalid file meta in bundle manifest")
+		}
+	}
+	return m, nil
+}
+
+// importContent writes the content into the contents dir through a temp file, and verifies its SHA256
+func importContent(r io.Reader, contentsDir, signature string, size uint64) error {
+	tmp, err := os.CreateTemp(contentsDir, "."+signature+"-*")
+	if err != nil {
+		return fmt.Errorf("create content temp file failed, err: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return fmt.Errorf("write content %s failed, err: %s", signature, err.Error())
+	}
+	if uint64(n) != size || hex.EncodeToString(h.Sum(nil)) != signature {
+		return fmt.Errorf("content %s is not match with the signature", signature)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("sync content %s failed, err: %s", signature, err.Error())
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("close content %s failed, err: %s", signature, err.Error())
+	}
+	return util.ReplaceFile(tmp.Name(), filepath.Join(contentsDir, signature))
+}
+
+// saveManifest saves the verified manifest and its signature into the release dir of the store
+func saveManifest(storeDir string, m *BundleManifest, manifest, sig []byte) error {
+	dir := bundleReleaseDir(storeDir, m.BizID, m.App, m.ReleaseID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("create bundle release dir failed, err: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleSignatureName), sig, 0644); err != nil {
+		return fmt.Errorf("save bundle signature failed, err: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleManifestName), manifest, 0600); err != nil {
+		return fmt.Errorf("save bundle manifest failed, err: %s", err.Error())
+	}
+	return nil
+}
+
+// Release builds the release of the bundle, it can be materialized by Release.Execute without feed server,
+// the contents are read from the bundle store instead of downloading
+func (b *Bundle) Release(appDir, tempDir string) *Release {
+	m := b.manifest
+	contentsDir := filepath.Join(b.storeDir, bundleContentsDir)
+	files := make([]*ConfigItemFile, 0, len(m.Files))
+	var totalFileSize uint64
+	for _, meta := range m.Files {
+		meta.ConfigItemSpec.Path = filepath.FromSlash(meta.ConfigItemSpec.Path)
+		files = append(files, &ConfigItemFile{
+			Name:       meta.ConfigItemSpec.Name,
+			Path:       meta.ConfigItemSpec.Path,
+			Permission: meta.ConfigItemSpec.Permission,
+			FileMeta:   meta,
+			contentDir: contentsDir,
+		})
+		totalFileSize += meta.ContentSpec.ByteSize
+	}
+
+	return &Release{
+		ReleaseID:   m.ReleaseID,
+		ReleaseName: m.ReleaseName,
+		FileItems:   files,
+		PreHook:     m.PreHook,
+		PostHook:    m.PostHook,
+		CursorID:    util.GenerateCursorID(m.BizID),
+		// updateFiles notifies every file, buffer all of them since nobody receives in offline mode
+		SemaphoreCh: make(chan struct{}, len(files)),
+		AppDir:      appDir,
+		TempDir:     tempDir,
+		BizID:       m.BizID,
+		ClientMode:  sfs.Pull,
+		AppMate: &sfs.SideAppMeta{
+			App:             m.App,
+			TargetReleaseID: m.ReleaseID,
+			TotalFileNum:    len(files),
+			TotalFileSize:   totalFileSize,
+		},
+	}
+}
+
+// UpdateKvs saves the kvs of the bundle into the kvs.json in the app dir
+func (b *Bundle) UpdateKvs(appDir string) Function {
+	return func() error {
+		if len(b.manifest.Kvs) == 0 {
+			return nil
+		}
+		kvs := make(map[string]*BundleKv, len(b.manifest.Kvs))
+		for _, kv := range b.manifest.Kvs {
+			kvs[kv.Key] = kv
+		}
+		data, err := json.MarshalIndent(kvs, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode kvs failed, err: %s", err.Error())
+		}
+		kvsFile := filepath.Join(appDir, bundleKvsFile)
+		tmp := kvsFile + materializeTmpSuffix
+		if err = os.WriteFile(tmp, data, 0600); err != nil {
+			return fmt.Errorf("write kvs failed, err: %s", err.Error())
+		}
+		return util.ReplaceFile(tmp, kvsFile)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pbci "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/content"
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+)
+
+type testBundleEntry struct {
+	name string
+	data []byte
+}
+
+// newTestBundle returns the tar entries of the bundle of one file signed by the key
+func newTestBundle(t *testing.T, key ed25519.PrivateKey, content []byte) []testBundleEntry {
+	sum := sha256.Sum256(content)
+	signature := hex.EncodeToString(sum[:])
+	m := &BundleManifest{Version: bundleVersion, BizID: 2, App: "demo", ReleaseID: 7,
+		Files: []*sfs.ConfigItemMetaV1{{
+			ContentSpec:    &pbcontent.ContentSpec{Signature: signature, ByteSize: uint64(len(content))},
+			ConfigItemSpec: &pbci.ConfigItemSpec{Name: "a.conf", Path: "/etc"},
+		}}}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []testBundleEntry{
+		{name: bundleManifestName, data: manifest},
+		{name: bundleSignatureName, data: []byte(hex.EncodeToString(ed25519.Sign(key, manifest)))},
+		{name: path.Join(bundleContentsDir, signature), data: content},
+	}
+}
+
+func writeTestBundle(t *testing.T, entries []testBundleEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		if err := writeTarEntry(tw, e.name, int64(len(e.data)), bytes.NewReader(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestImportBundle(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    ed25519.PublicKey
+		tamper func(entries []testBundleEntry) []testBundleEntry
+		errMsg string
+	}{
+		{
+			name:   "valid",
+			key:    pub,
+			tamper: func(entries []testBundleEntry) []testBundleEntry { return entries },
+		},
+		{
+			name: "tampered manifest",
+			key:  pub,
+			tamper: func(entries []testBundleEntry) []testBundleEntry {
+				entries[0].data = bytes.Replace(entries[0].data, []byte(`"app":"demo"`), []byte(`"app":"evil"`), 1)
+				return entries
+			},
+			errMsg: ErrBundleSignature.Error(),
+		},
+		{
+			name:   "wrong key",
+			key:    otherPub,
+			tamper: func(entries []testBundleEntry) []testBundleEntry { return entries },
+			errMsg: ErrBundleSignature.Error(),
+		},
+		{
+			name: "tampered content",
+			key:  pub,
+			tamper: func(entries []testBundleEntry) []testBundleEntry {
+				entries[2].data = []byte("key=evil")
+				return entries
+			},
+			errMsg: "is not match with the signature",
+		},
+		{
+			name: "unexpected entry",
+			key:  pub,
+			tamper: func(entries []testBundleEntry) []testBundleEntry {
+				return append(entries, testBundleEntry{name: "../../etc/passwd", data: []byte("root")})
+			},
+			errMsg: "unexpected bundle entry",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storeDir := t.TempDir()
+			entries := newTestBundle(t, priv, []byte("key=value"))
+			signature := path.Base(entries[2].name)
+
+			b, err := ImportBundle(writeTestBundle(t, tt.tamper(entries)), storeDir, tt.key)
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("expect error %q, got %v", tt.errMsg, err)
+				}
+				if _, e := os.Stat(bundleReleaseDir(storeDir, 2, "demo", 7)); !errors.Is(e, os.ErrNotExist) {
+					t.Fatalf("expect no manifest imported, got %v", e)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Manifest().ReleaseID != 7 {
+				t.Fatalf("unexpected manifest %+v", b.Manifest())
+			}
+			data, err := os.ReadFile(filepath.Join(storeDir, bundleContentsDir, signature))
+			if err != nil || string(data) != "key=value" {
+				t.Fatalf("unexpected content %q, err: %v", data, err)
+			}
+			if _, err = LoadBundle(storeDir, 2, "demo", 7, tt.key); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestImportContentMismatch(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha256.Sum256([]byte("key=value"))
+	signature := hex.EncodeToString(sum[:])
+
+	// the size is checked as well as the sha256
+	if err := importContent(strings.NewReader("key=value"), dir, signature, 1); err == nil {
+		t.Fatal("expect the size mismatch error")
+	}
+	if err := importContent(strings.NewReader("key=evil!"), dir, signature, 9); err == nil {
+		t.Fatal("expect the signature mismatch error")
+	}
+	// neither the content nor the temp files are left
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expect empty contents dir, got %d entries", len(entries))
+	}
+}
@@ -15,11 +15,14 @@ package client
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/TencentBlueKing/bk-bscp/pkg/criteria/constant"
@@ -28,7 +31,6 @@ import (
 	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
 	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
 	"github.com/TencentBlueKing/bk-bscp/pkg/version"
-	"github.com/allegro/bigcache/v3"
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -37,7 +39,9 @@ import (
 	"github.com/TencentBlueKing/bscp-go/internal/downloader"
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 // Client bscp client method
@@ -50,16 +54,30 @@ type Client interface {
 	PullKvs(app string, match []string, opts ...AppOption) (*Release, error)
 	// Get gets Key Value from remote
 	Get(app string, key string, opts ...AppOption) (string, error)
+	// GetWithMeta gets the kv value with its source, release and staleness
+	GetWithMeta(app string, key string, opts ...AppOption) (*KvValue, error)
 	// AddWatcher add a watcher to client
 	AddWatcher(callback Callback, app string, opts ...AppOption) error
 	// StartWatch start watch
 	StartWatch() error
 	// StopWatch stop watch
 	StopWatch()
+	// WatchStatus returns the live state of the watch, such as the connection and the watched apps
+	WatchStatus() *WatchStatus
 	// ResetLabels reset bscp client labels, if key conflict, app value will overwrite client value
 	ResetLabels(labels map[string]string)
 	// GetFile get files from remote
 	GetFile(app string, filePath string, opts ...AppOption) (*FileStreamReader, error)
+	// SetBandwidthLimit adjusts the download bandwidth limit at runtime, it takes effect immediately
+	SetBandwidthLimit(limit BandwidthLimit) error
+	// ExportBundle pulls the release of the app into a signed offline bundle
+	ExportBundle(app string, w io.Writer, key ed25519.PrivateKey, opts ...AppOption) (*BundleManifest, error)
+	// Rollback restores the app in the temp dir to a release in the local history, 0 means the previous release
+	Rollback(app string, tempDir string, releaseID uint32) (*Release, error)
+	// ListMetadata lists the releases applied to the app in the temp dir, the latest first
+	ListMetadata(app string, tempDir string, filter HistoryFilter) ([]*MetadataEvent, error)
+	// ListChangeEvents lists the release change events of the app in the temp dir, the latest first
+	ListChangeEvents(app string, tempDir string, filter HistoryFilter) ([]*ChangeEvent, error)
 	// Close gracefully shuts down the client and releases resources
 	Close() error
 }
@@ -73,6 +91,8 @@ type client struct {
 	opts     options
 	watcher  *watcher
 	upstream upstream.Upstream
+	// kvVerifications records the last verification of the cached kvs, map[cacheKey]*kvVerification
+	kvVerifications sync.Map
 }
 
 // New return a bscp client instance
@@ -145,13 +165,11 @@ func New(opts ...Option) (Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("decode handshake payload failed, err: %s, rid: %s", err.Error(), vas.Rid)
 	}
-	err = downloader.Init(vas, clientOpt.bizID, clientOpt.token, u, pl.RuntimeOption.RepositoryTLS,
-		pl.RuntimeOption.EnableAsyncDownload, clientOpt.enableP2PDownload, clientOpt.bkAgentID, clientOpt.clusterID,
-		clientOpt.podID, clientOpt.containerName)
-	if err != nil {
-		return nil, fmt.Errorf("init downloader failed, err: %s", err.Error())
+	if err = c.initDownloader(vas, pl.RuntimeOption); err != nil {
+		return nil, err
 	}
 
+	eventmeta.SetRetention(clientOpt.eventRetention)
 	if err = initFileCache(clientOpt); err != nil {
 		return nil, err
 	}
@@ -164,18 +182,112 @@ func New(opts ...Option) (Client, error) {
 		return nil, fmt.Errorf("init watcher failed, err: %s", err.Error())
 	}
 	c.watcher = watcher
+
+	if clientOpt.bounce.Enabled {
+		c.enableBounce(pl.RuntimeOption)
+	}
 	return c, nil
 }
 
+// initDownloader init the downloader with the runtime option returned by handshake
+func (c *client) initDownloader(vas *kit.Vas, ro *sfs.SidecarRuntimeOption) error {
+	err := downloader.Init(vas, c.opts.bizID, c.opts.token, c.upstream, ro.RepositoryTLS,
+		ro.EnableAsyncDownload, c.opts.enableP2PDownload, c.opts.bkAgentID, c.opts.clusterID,
+		c.opts.podID, c.opts.containerName)
+	if err != nil {
+		return fmt.Errorf("init downloader failed, err: %s", err.Error())
+	}
+	if len(c.opts.downloadBackends) > 0 {
+		downloader.SetBackends(toDownloaderBackends(c.opts.downloadBackends))
+	}
+	downloader.SetRangeDownload(downloader.RangeDownload(c.opts.rangeDownload))
+	downloader.SetAsyncDownload(downloader.AsyncDownload(c.opts.asyncDownload))
+	return c.SetBandwidthLimit(c.opts.bandwidthLimit)
+}
+
+// enableBounce enable periodic upstream rebalancing, the interval set by client option has higher
+// priority than the one suggested by server in handshake
+func (c *client) enableBounce(ro *sfs.SidecarRuntimeOption) {
+	interval := c.opts.bounce.Interval
+	if interval <= 0 && ro != nil && ro.BounceIntervalHour > 0 {
+		interval = time.Duration(ro.BounceIntervalHour) * time.Hour
+	}
+	if interval <= 0 {
+		interval = upstream.DefaultBounceInterval
+	}
+	logger.Info("enable upstream bounce", slog.Duration("interval", interval),
+		slog.Duration("jitter", c.opts.bounce.Jitter))
+	c.upstream.EnableBounce(interval, c.opts.bounce.Jitter, c.watcher.bounce)
+}
+
+// SetBandwidthLimit adjusts the download bandwidth limit at runtime
+func (c *client) SetBandwidthLimit(limit BandwidthLimit) error {
+	l, err := limit.toDownloader()
+	if err != nil {
+		return err
+	}
+	downloader.SetBandwidthLimit(l)
+	logger.Info("set download bandwidth limit", slog.Int64("bytes_per_second", limit.BytesPerSecond),
+		slog.Int64("burst_bytes", limit.BurstBytes), slog.Int64("warmup_bytes_per_second", limit.WarmupBytesPerSecond),
+		slog.Int("schedules", len(limit.Schedules)))
+	return nil
+}
+
+// toDownloader converts the bandwidth limit option to the downloader one
+func (l BandwidthLimit) toDownloader() (downloader.BandwidthLimit, error) {
+	if l.BytesPerSecond < 0 || l.BurstBytes < 0 || l.WarmupBytesPerSecond < 0 {
+		return downloader.BandwidthLimit{}, fmt.Errorf("bandwidth limit should not be negative")
+	}
+
+	limit := downloader.BandwidthLimit{
+		BytesPerSecond:       l.BytesPerSecond,
+		BurstBytes:           l.BurstBytes,
+		WarmupBytesPerSecond: l.WarmupBytesPerSecond,
+	}
+	for _, s := range l.Schedules {
+		start, err := util.ParseClock(s.Start)
+		if err != nil {
+			return downloader.BandwidthLimit{}, fmt.Errorf("invalid bandwidth schedule start, %s", err.Error())
+		}
+		end, err := util.ParseClock(s.End)
+		if err != nil {
+			return downloader.BandwidthLimit{}, fmt.Errorf("invalid bandwidth schedule end, %s", err.Error())
+		}
+		if s.BytesPerSecond < 0 {
+			return downloader.BandwidthLimit{}, fmt.Errorf("bandwidth schedule limit should not be negative")
+		}
+		limit.Schedules = append(limit.Schedules, downloader.BandwidthSchedule{
+			Start:          start,
+			End:            end,
+			BytesPerSecond: s.BytesPerSecond,
+		})
+	}
+	return limit, nil
+}
+
 // initFileCache init file cache
 func initFileCache(opts *options) error {
 	if opts.fileCache.Enabled {
 		logger.Info("enable file cache")
-		if err := cache.Init(opts.fileCache.CacheDir, opts.fileCache.ThresholdGB); err != nil {
+		c := opts.fileCache
+		if c.CleanupIntervalSeconds <= 0 {
+			c.CleanupIntervalSeconds = DefaultCleanupIntervalSeconds
+		}
+		if c.RetentionRate <= 0 || c.RetentionRate > 1 {
+			c.RetentionRate = DefaultCacheRetentionRate
+		}
+		if err := cache.Init(cache.Options{
+			Path:                   c.CacheDir,
+			ThresholdGB:            c.ThresholdGB,
+			CleanupIntervalSeconds: c.CleanupIntervalSeconds,
+			RetentionRate:          c.RetentionRate,
+			EvictionPolicy:         cache.EvictionPolicy(c.EvictionPolicy),
+			Materialize:            cache.MaterializeMode(c.Materialize),
+			PrefetchConcurrency:    c.PrefetchConcurrency,
+		}); err != nil {
 			return fmt.Errorf("init file cache failed, err: %s", err.Error())
 		}
-		go cache.AutoCleanupFileCache(opts.fileCache.CacheDir, DefaultCleanupIntervalSeconds,
-			opts.fileCache.ThresholdGB, DefaultCacheRetentionRate)
+		go cache.GetCache().AutoCleanupFileCache()
 	}
 	return nil
 }
@@ -198,10 +310,28 @@ func initKvCache(opts *options) error {
 				}
 				logger.Debug("kv cache statistics", slog.Int64("hit", hit), slog.Int64("miss", miss),
 					slog.String("hit-ratio", fmt.Sprintf("%.3f", hitRatio)), slog.Int("kv-count", kvCnt))
+				metrics.CacheSizeBytes.WithLabelValues(metrics.CacheKv).Set(float64(cache.MemCacheUsedBytes()))
 				time.Sleep(time.Second * 15)
 			}
 		}()
 	}
+	if opts.kvCache.DiskEnabled {
+		dir, threshold := opts.kvCache.DiskDir, opts.kvCache.DiskThresholdMB
+		if dir == "" {
+			dir = DefaultKvDiskCacheDir
+		}
+		if threshold <= 0 {
+			threshold = DefaultKvDiskCacheThresholdMB
+		}
+		logger.Info("enable kv disk cache", slog.String("dir", dir))
+		if err := cache.InitKvStore(cache.KvStoreOptions{
+			Dir:           dir,
+			ThresholdMB:   threshold,
+			EncryptionKey: opts.kvCache.EncryptionKey,
+		}); err != nil {
+			return fmt.Errorf("init kv disk cache failed, err: %s", err.Error())
+		}
+	}
 	return nil
 }
 
@@ -221,6 +351,11 @@ func (c *client) StopWatch() {
 	c.watcher.StopWatch()
 }
 
+// WatchStatus returns the live state of the watch
+func (c *client) WatchStatus() *WatchStatus {
+	return c.watcher.status()
+}
+
 // Close gracefully shuts down the client and releases all resources
 func (c *client) Close() error {
 	// First stop the watcher to prevent new events
@@ -234,6 +369,14 @@ func (c *client) Close() error {
 		}
 	}
 
+	// flush the cache index and remove the work dir of the process
+	if cache.Enable {
+		if err := cache.GetCache().Close(); err != nil {
+			logger.Error("failed to close file cache", logger.ErrAttr(err))
+			return err
+		}
+	}
+
 	logger.Info("bscp client closed successfully")
 	return nil
 }
@@ -402,6 +545,8 @@ func (c *client) PullFiles(app string, opts ...AppOption) (*Release, error) { //
 	r.AppMate.TargetReleaseID = resp.ReleaseId
 	r.AppMate.TotalFileNum = len(files)
 	r.AppMate.TotalFileSize = totalFileSize
+	r.HookTimeout = c.opts.hookTimeout
+	r.historyLimit = c.opts.releaseHistory
 
 	return r, nil
 }
@@ -458,111 +603,11 @@ func (c *client) PullKvs(app string, match []string, opts ...AppOption) (*Releas
 // 先从feed-server服务端拉取最新版本元数据，优先从缓存中获取该最新版本value，缓存中没有再调用feed-server获取value并缓存起来
 // 在feed-server服务端连接不可用时则降级从缓存中获取（如果有缓存过），此时存在从缓存获取到的value值不是最新发布版本的风险
 func (c *client) Get(app string, key string, opts ...AppOption) (string, error) {
-	// get kv value from cache
-	var val, md5 string
-	var err error
-	cacheKey := kvCacheKey(c.opts.bizID, app, key)
-	if cache.EnableMemCache {
-		val, md5, err = c.getKvValueFromCache(app, key, opts...)
-		if err == nil {
-			return val, nil
-		} else if err != bigcache.ErrEntryNotFound {
-			logger.Error("get kv value from cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
-		}
-	}
-
-	// get kv value from feed-server
-	option := &AppOptions{}
-	for _, opt := range opts {
-		opt(option)
-	}
-	vas, _ := c.buildVas()
-	req := &pbfs.GetKvValueReq{
-		BizId: c.opts.bizID,
-		AppMeta: &pbfs.AppMeta{
-			App:    app,
-			Labels: c.opts.labels,
-			Uid:    c.opts.uid,
-		},
-		Key: key,
-	}
-	req.AppMeta.Labels = util.MergeLabels(c.opts.labels, option.Labels)
-	// reset uid
-	if option.UID != "" {
-		req.AppMeta.Uid = option.UID
-	}
-
-	resp, err := c.upstream.GetKvValue(vas, req)
-	if err != nil {
-		st, _ := status.FromError(err)
-		switch st.Code() {
-		case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
-			logger.Error("feed-server is unavailable", logger.ErrAttr(err))
-			// 降级从缓存中获取
-			if cache.EnableMemCache {
-				v, cErr := cache.GetMemCache().Get(cacheKey)
-				if cErr != nil {
-					logger.Error("get kv value from cache failed", slog.String("key", cacheKey), logger.ErrAttr(cErr))
-					return "", err
-				}
-				logger.Warn("feed-server is unavailable but get kv value from cache successfully",
-					slog.String("key", cacheKey))
-				return string(v[32:]), nil
-			}
-		default:
-			return "", err
-		}
-	}
-	val = resp.Value
-
-	// set kv md5 and value for cache
-	if cache.EnableMemCache {
-		if md5 == "" {
-			logger.Error("set kv cache failed", slog.String("key", cacheKey), logger.ErrAttr(ErrNotFoundKvMD5))
-		} else {
-			if err := cache.GetMemCache().Set(cacheKey, append([]byte(md5), []byte(val)...)); err != nil {
-				logger.Error("set kv cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
-			}
-		}
-	}
-
-	return val, nil
-}
-
-// getKvValueWithCache get kv value from the cache
-func (c *client) getKvValueFromCache(app string, key string, opts ...AppOption) (string, string, error) {
-	release, err := c.PullKvs(app, []string{}, opts...)
+	v, err := c.GetWithMeta(app, key, opts...)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
-
-	var md5 string
-	for _, k := range release.KvItems {
-		if k.Key == key {
-			md5 = k.ContentSpec.Md5
-			break
-		}
-	}
-	if md5 == "" {
-		return "", "", ErrNotFoundKvMD5
-	}
-
-	var val []byte
-	val, err = cache.GetMemCache().Get(kvCacheKey(c.opts.bizID, app, key))
-	if err != nil {
-		return "", md5, err
-	}
-	// 判断是否为最新版本缓存，不是最新则仍从服务端获取value
-	if string(val[:32]) != md5 {
-		return "", md5, bigcache.ErrEntryNotFound
-	}
-
-	return string(val[32:]), md5, nil
-}
-
-// kvCacheKey is cache key for kv md5 and value, the cached data's first 32 character is md5, other is value
-func kvCacheKey(bizID uint32, app, key string) string {
-	return fmt.Sprintf("%d_%s_%s", bizID, app, key)
+	return v.Value, nil
 }
 
 // ListApps list app from remote, only return have perm by token
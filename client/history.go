@@ -0,0 +1,270 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pbhook "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/hook"
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// releaseHistoryDir is the dir of the release snapshots in the app dir
+	releaseHistoryDir = "history"
+	// eventTypeAnnotation is the annotation key of the type of the release change event
+	eventTypeAnnotation = "event_type"
+	// eventTypeRollback is the event type of the rollback to a release in the local history
+	eventTypeRollback = "rollback"
+	// rollbackFromAnnotation is the annotation key of the release which is rolled back from
+	rollbackFromAnnotation = "rollback_from_release_id"
+)
+
+// ErrNoReleaseToRollback is returned when the release to rollback to is not in the local history
+var ErrNoReleaseToRollback = errors.New("no release to rollback to in the local history")
+
+type (
+	// HistoryFilter filters the events of the local history by release and status, the zero value fields match
+	// all events
+	HistoryFilter = eventmeta.Filter
+	// EventStatus is the status of the events of the local history
+	EventStatus = eventmeta.EventStatus
+	// MetadataEvent is the event of the release applied to the app, which is written to metadata.json
+	MetadataEvent = eventmeta.EventMeta
+	// ChangeEvent is the event of the release change of the app, which is written to changeevent.json
+	ChangeEvent = eventmeta.ChangeEvent
+)
+
+const (
+	// EventStatusSuccess is the status of the successful events
+	EventStatusSuccess = eventmeta.EventStatusSuccess
+	// EventStatusFailed is the status of the failed events
+	EventStatusFailed = eventmeta.EventStatusFailed
+)
+
+// ReleaseSnapshot is the snapshot of a release applied to the app dir, the file contents are not copied but
+// referenced by the signatures, they are restored from the file cache or downloaded from the repository.
+type ReleaseSnapshot struct {
+	BizID         uint32                  `json:"biz_id"`
+	App           string                  `json:"app"`
+	ReleaseID     uint32                  `json:"release_id"`
+	ReleaseName   string                  `json:"release_name"`
+	ConfigMatches []string                `json:"config_matches"`
+	AppliedAt     time.Time               `json:"applied_at"`
+	Files         []*sfs.ConfigItemMetaV1 `json:"files"`
+	PreHook       *pbhook.HookSpec        `json:"pre_hook"`
+	PostHook      *pbhook.HookSpec        `json:"post_hook"`
+}
+
+// saveSnapshot saves the snapshot of the applied release into the history of the app dir, only the latest
+// historyLimit releases are kept.
+func (r *Release) saveSnapshot() error {
+	dir := filepath.Join(r.AppDir, releaseHistoryDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("create release history dir failed, err: %s", err.Error())
+	}
+	s := &ReleaseSnapshot{
+		BizID:         r.BizID,
+		App:           r.AppMate.App,
+		ReleaseID:     r.ReleaseID,
+		ReleaseName:   r.ReleaseName,
+		ConfigMatches: r.AppMate.Match,
+		AppliedAt:     time.Now().UTC(),
+		Files:         make([]*sfs.ConfigItemMetaV1, 0, len(r.FileItems)),
+		PreHook:       r.PreHook,
+		PostHook:      r.PostHook,
+	}
+	for _, f := range r.FileItems {
+		s.Files = append(s.Files, f.FileMeta)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encode release snapshot failed, err: %s", err.Error())
+	}
+	path := filepath.Join(dir, strconv.FormatUint(uint64(r.ReleaseID), 10)+".json")
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("write release snapshot failed, err: %s", err.Error())
+	}
+	if err = util.ReplaceFile(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("replace release snapshot failed, err: %s", err.Error())
+	}
+
+	snapshots, err := ListReleaseHistory(r.AppDir)
+	if err != nil {
+		return err
+	}
+	for _, old := range snapshots[min(len(snapshots), r.historyLimit):] {
+		_ = os.Remove(filepath.Join(dir, strconv.FormatUint(uint64(old.ReleaseID), 10)+".json"))
+	}
+	return nil
+}
+
+// ListReleaseHistory lists the snapshots of the releases applied to the app dir, the latest applied first
+func ListReleaseHistory(appDir string) ([]*ReleaseSnapshot, error) {
+	dir := filepath.Join(appDir, releaseHistoryDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read release history dir failed, err: %s", err.Error())
+	}
+
+	snapshots := make([]*ReleaseSnapshot, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read release snapshot %s failed, err: %s", e.Name(), err.Error())
+		}
+		s := new(ReleaseSnapshot)
+		if err = json.Unmarshal(b, s); err != nil {
+			logger.Warn("skip the broken release snapshot", slog.String("file", e.Name()), logger.ErrAttr(err))
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].AppliedAt.After(snapshots[j].AppliedAt)
+	})
+	return snapshots, nil
+}
+
+// ListMetadata lists the releases applied to the app in the temp dir which match the filter, the latest first
+func (c *client) ListMetadata(app string, tempDir string, filter HistoryFilter) ([]*MetadataEvent, error) {
+	return eventmeta.ListMetadata(filepath.Join(tempDir, strconv.Itoa(int(c.opts.bizID)), app), filter)
+}
+
+// ListChangeEvents lists the release change events of the app in the temp dir which match the filter,
+// the latest first
+func (c *client) ListChangeEvents(app string, tempDir string, filter HistoryFilter) ([]*ChangeEvent, error) {
+	return eventmeta.ListChangeEvents(filepath.Join(tempDir, strconv.Itoa(int(c.opts.bizID)), app), filter)
+}
+
+// Rollback restores the app in the temp dir to a release applied before, the latest applied release other than
+// the current one is chosen if releaseID is 0. the files are restored from the file cache or downloaded by their
+// signatures, then the post hook is executed and the metadata is updated, the change is reported as a rollback.
+func (c *client) Rollback(app string, tempDir string, releaseID uint32) (*Release, error) {
+	appDir := filepath.Join(tempDir, strconv.Itoa(int(c.opts.bizID)), app)
+	meta, exists, err := eventmeta.GetLatestMetadataFromFile(appDir)
+	if err != nil {
+		return nil, err
+	}
+	var current uint32
+	if exists {
+		current = meta.ReleaseID
+	}
+
+	snapshots, err := ListReleaseHistory(appDir)
+	if err != nil {
+		return nil, err
+	}
+	target := rollbackTarget(snapshots, current, releaseID)
+	if target == nil {
+		return nil, ErrNoReleaseToRollback
+	}
+
+	r := c.snapshotRelease(target, appDir, tempDir)
+	r.AppMate.CurrentReleaseID = current
+	r.rollbackFrom = current
+	// 1.更新文件
+	// 2.执行后置脚本
+	// 3.更新Metadata
+	if err = r.Execute(r.UpdateFiles(), r.ExecuteHook(&PostScriptStrategy{}), r.UpdateMetadata()); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// rollbackTarget chooses the snapshot to rollback to from the snapshots sorted by the applied time, the latest
+// applied one other than the current release is chosen if releaseID is 0, returns nil if not found
+func rollbackTarget(snapshots []*ReleaseSnapshot, current, releaseID uint32) *ReleaseSnapshot {
+	for _, s := range snapshots {
+		if (releaseID == 0 && s.ReleaseID != current) || (releaseID != 0 && s.ReleaseID == releaseID) {
+			return s
+		}
+	}
+	return nil
+}
+
+// annotateRollback marks the change event of the rollback and the release it is rolled back from in the report
+func (r *Release) annotateRollback(annotations map[string]interface{}) {
+	if !r.rollback {
+		return
+	}
+	annotations[eventTypeAnnotation] = eventTypeRollback
+	annotations[rollbackFromAnnotation] = r.rollbackFrom
+}
+
+// snapshotRelease builds the release to rollback to from the snapshot
+func (c *client) snapshotRelease(s *ReleaseSnapshot, appDir, tempDir string) *Release {
+	vas, _ := c.buildVas()
+	files := make([]*ConfigItemFile, 0, len(s.Files))
+	var totalFileSize uint64
+	for _, meta := range s.Files {
+		files = append(files, &ConfigItemFile{
+			Name:          meta.ConfigItemSpec.Name,
+			Path:          meta.ConfigItemSpec.Path,
+			TextLineBreak: c.opts.textLineBreak,
+			Permission:    meta.ConfigItemSpec.Permission,
+			FileMeta:      meta,
+		})
+		totalFileSize += meta.ContentSpec.ByteSize
+	}
+
+	return &Release{
+		ReleaseID:   s.ReleaseID,
+		ReleaseName: s.ReleaseName,
+		FileItems:   files,
+		PreHook:     s.PreHook,
+		PostHook:    s.PostHook,
+		CursorID:    util.GenerateCursorID(c.opts.bizID),
+		// updateFiles notifies every file, buffer all of them since nobody receives them
+		SemaphoreCh:  make(chan struct{}, len(files)),
+		upstream:     c.upstream,
+		vas:          vas,
+		AppDir:       appDir,
+		TempDir:      tempDir,
+		BizID:        c.opts.bizID,
+		ClientMode:   sfs.Pull,
+		HookTimeout:  c.opts.hookTimeout,
+		historyLimit: c.opts.releaseHistory,
+		rollback:     true,
+		AppMate: &sfs.SideAppMeta{
+			App:             s.App,
+			Uid:             c.opts.uid,
+			Labels:          c.opts.labels,
+			Match:           s.ConfigMatches,
+			TargetReleaseID: s.ReleaseID,
+			TotalFileNum:    len(files),
+			TotalFileSize:   totalFileSize,
+		},
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pbci "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/content"
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+// newTestRelease builds the release of the files whose contents are read from the content dir, so that it is
+// applied without feed server like the offline bundles
+func newTestRelease(t *testing.T, appDir string, releaseID uint32, files map[string]string) *Release {
+	contentDir := filepath.Join(filepath.Dir(appDir), "contents")
+	if err := os.MkdirAll(contentDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	r := &Release{
+		ReleaseID:    releaseID,
+		SemaphoreCh:  make(chan struct{}, len(files)),
+		AppDir:       appDir,
+		BizID:        2,
+		ClientMode:   sfs.Pull,
+		historyLimit: 2,
+		AppMate:      &sfs.SideAppMeta{App: "demo", TargetReleaseID: releaseID},
+	}
+	for name, content := range files {
+		sum := sha256.Sum256([]byte(content))
+		signature := hex.EncodeToString(sum[:])
+		if err := os.WriteFile(filepath.Join(contentDir, signature), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		meta := &sfs.ConfigItemMetaV1{
+			ContentSpec: &pbcontent.ContentSpec{Signature: signature, ByteSize: uint64(len(content))},
+			ConfigItemSpec: &pbci.ConfigItemSpec{Name: name, Path: "/",
+				Permission: &pbci.FilePermission{User: "root", UserGroup: "root", Privilege: "644"}},
+		}
+		r.FileItems = append(r.FileItems, &ConfigItemFile{Name: name, Path: "/", FileMeta: meta,
+			Permission: meta.ConfigItemSpec.Permission, contentDir: contentDir})
+	}
+	return r
+}
+
+func applyTestRelease(t *testing.T, r *Release) {
+	if err := r.Execute(r.UpdateFiles(), r.UpdateMetadata()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseHistory(t *testing.T) {
+	appDir := filepath.Join(t.TempDir(), "2", "demo")
+	filesDir := filepath.Join(appDir, "files")
+
+	applyTestRelease(t, newTestRelease(t, appDir, 1, map[string]string{"a.conf": "a=1", "b.conf": "b=1"}))
+	applyTestRelease(t, newTestRelease(t, appDir, 2, map[string]string{"a.conf": "a=2"}))
+	// the files not in the release are kept in pull mode
+	if _, err := os.Stat(filepath.Join(filesDir, "b.conf")); err != nil {
+		t.Fatalf("expect b.conf kept in pull mode, err: %v", err)
+	}
+	applyTestRelease(t, newTestRelease(t, appDir, 3, map[string]string{"a.conf": "a=3"}))
+
+	// only the latest 2 snapshots are kept, the latest applied first
+	snapshots, err := ListReleaseHistory(appDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].ReleaseID != 3 || snapshots[1].ReleaseID != 2 {
+		t.Fatalf("unexpected release history %+v", snapshots)
+	}
+	if len(snapshots[0].Files) != 1 || snapshots[0].Files[0].ConfigItemSpec.Name != "a.conf" {
+		t.Fatalf("unexpected snapshot files %+v", snapshots[0].Files)
+	}
+
+	// the previous release is chosen by default, and the files not in it are removed on rollback
+	target := rollbackTarget(snapshots, 3, 0)
+	if target == nil || target.ReleaseID != 2 {
+		t.Fatalf("expect rollback to release 2, got %+v", target)
+	}
+	r := newTestRelease(t, appDir, target.ReleaseID, map[string]string{"a.conf": "a=2"})
+	r.rollback, r.rollbackFrom = true, 3
+	applyTestRelease(t, r)
+	if _, err = os.Stat(filepath.Join(filesDir, "b.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expect b.conf removed on rollback, err: %v", err)
+	}
+	if b, e := os.ReadFile(filepath.Join(filesDir, "a.conf")); e != nil || string(b) != "a=2" {
+		t.Fatalf("unexpected a.conf %q, err: %v", b, e)
+	}
+	meta, _, err := eventmeta.GetLatestMetadataFromFile(appDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ReleaseID != 2 || meta.Message != "rollback from release 3" {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+}
+
+func TestRollbackTarget(t *testing.T) {
+	snapshots := []*ReleaseSnapshot{{ReleaseID: 3}, {ReleaseID: 2}, {ReleaseID: 1}}
+	tests := []struct {
+		name      string
+		current   uint32
+		releaseID uint32
+		expect    uint32
+	}{
+		{name: "previous release", current: 3, expect: 2},
+		{name: "current release is rolled back already", current: 2, expect: 3},
+		{name: "specified release", current: 3, releaseID: 1, expect: 1},
+		{name: "not in history", current: 3, releaseID: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := rollbackTarget(snapshots, tt.current, tt.releaseID)
+			if tt.expect == 0 {
+				if target != nil {
+					t.Fatalf("expect no target, got %d", target.ReleaseID)
+				}
+				return
+			}
+			if target == nil || target.ReleaseID != tt.expect {
+				t.Fatalf("expect release %d, got %+v", tt.expect, target)
+			}
+		})
+	}
+	if rollbackTarget(nil, 0, 0) != nil {
+		t.Fatal("expect no target in empty history")
+	}
+}
+
+func TestAnnotateRollback(t *testing.T) {
+	annotations := make(map[string]interface{})
+	(&Release{}).annotateRollback(annotations)
+	if len(annotations) != 0 {
+		t.Fatalf("expect no annotation for the normal release, got %v", annotations)
+	}
+
+	(&Release{rollback: true, rollbackFrom: 3}).annotateRollback(annotations)
+	if annotations[eventTypeAnnotation] != eventTypeRollback || annotations[rollbackFromAnnotation] != uint32(3) {
+		t.Fatalf("unexpected rollback annotations %v", annotations)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
+	"github.com/allegro/bigcache/v3"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+// KvSource is where the kv value is read from
+type KvSource string
+
+const (
+	// KvSourceRemote means the value is read from feed-server
+	KvSourceRemote KvSource = "remote"
+	// KvSourceCacheVerified means the value is read from the cache and verified to be the latest one
+	KvSourceCacheVerified KvSource = "cache-verified"
+	// KvSourceCacheFallback means the value is read from the cache because feed-server is unavailable,
+	// it may be not the latest one
+	KvSourceCacheFallback KvSource = "cache-fallback"
+)
+
+// ErrKvStale is returned when feed-server is unavailable and the cached kv value is staler than the max staleness
+var ErrKvStale = errors.New("cached kv value is too stale")
+
+// KvValue is the kv value with its source and staleness
+type KvValue struct {
+	// Value is the kv value
+	Value string
+	// Source is where the value is read from
+	Source KvSource
+	// ReleaseID is the release id of the value, 0 means unknown
+	ReleaseID uint32
+	// Md5 is the md5 of the value, empty means unknown
+	Md5 string
+	// VerifiedAt is the last time the value was verified to be the latest one, zero means unknown
+	VerifiedAt time.Time
+	// Staleness is the duration since the value was verified to be the latest one, 0 for the verified values
+	Staleness time.Duration
+}
+
+// kvVerification is the last verification of the cached kv
+type kvVerification struct {
+	releaseID uint32
+	md5       string
+	at        time.Time
+}
+
+// latestKv is the meta of the kv in the latest release, which verifies the cached value
+type latestKv struct {
+	releaseID uint32
+	md5       string
+	kvType    string
+}
+
+// GetWithMeta gets the kv value with its source, release and staleness. the value is read from the cache if it is
+// verified to be the latest one, otherwise from feed-server. when feed-server is unavailable, the cached value is
+// returned as a fallback unless it is staler than the max staleness of the kv cache.
+func (c *client) GetWithMeta(app string, key string, opts ...AppOption) (*KvValue, error) {
+	// get kv value from cache
+	var latest *latestKv
+	var err error
+	cacheKey := kvCacheKey(c.opts.bizID, app, key)
+	if cache.EnableMemCache || cache.EnableKvStore {
+		latest, err = c.getLatestKv(app, key, opts...)
+		if err != nil {
+			logger.Error("get kv md5 failed", slog.String("key", cacheKey), logger.ErrAttr(err))
+		}
+	}
+	if latest != nil {
+		if v, ok := c.getVerifiedKvValue(cacheKey, latest); ok {
+			return v, nil
+		}
+	}
+
+	// get kv value from feed-server
+	option := &AppOptions{}
+	for _, opt := range opts {
+		opt(option)
+	}
+	vas, _ := c.buildVas()
+	req := &pbfs.GetKvValueReq{
+		BizId: c.opts.bizID,
+		AppMeta: &pbfs.AppMeta{
+			App:    app,
+			Labels: c.opts.labels,
+			Uid:    c.opts.uid,
+		},
+		Key: key,
+	}
+	req.AppMeta.Labels = util.MergeLabels(c.opts.labels, option.Labels)
+	// reset uid
+	if option.UID != "" {
+		req.AppMeta.Uid = option.UID
+	}
+
+	resp, err := c.upstream.GetKvValue(vas, req)
+	if err != nil {
+		st, _ := status.FromError(err)
+		switch st.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+			logger.Error("feed-server is unavailable", logger.ErrAttr(err))
+			// 降级从缓存中获取
+			return c.getKvValueDegraded(cacheKey, err)
+		default:
+			return nil, err
+		}
+	}
+	v := &KvValue{Value: resp.Value, Source: KvSourceRemote, VerifiedAt: time.Now()}
+
+	// set kv md5 and value for cache
+	if latest == nil {
+		if cache.EnableMemCache || cache.EnableKvStore {
+			logger.Error("set kv cache failed", slog.String("key", cacheKey), logger.ErrAttr(ErrNotFoundKvMD5))
+		}
+	} else {
+		latest.kvType = resp.KvType
+		v.ReleaseID, v.Md5 = latest.releaseID, latest.md5
+		c.setKvValueToCache(cacheKey, latest, v.Value, true)
+	}
+
+	return v, nil
+}
+
+// getVerifiedKvValue gets the kv value from the memory cache or the disk store if it is the latest one
+func (c *client) getVerifiedKvValue(cacheKey string, latest *latestKv) (*KvValue, bool) {
+	verified := func(val string) *KvValue {
+		now := time.Now()
+		c.kvVerifications.Store(cacheKey, &kvVerification{releaseID: latest.releaseID, md5: latest.md5, at: now})
+		return &KvValue{Value: val, Source: KvSourceCacheVerified, ReleaseID: latest.releaseID, Md5: latest.md5,
+			VerifiedAt: now}
+	}
+
+	if cache.EnableMemCache {
+		val, err := c.getKvValueFromCache(cacheKey, latest.md5)
+		if err == nil {
+			return verified(val), true
+		} else if err != bigcache.ErrEntryNotFound {
+			logger.Error("get kv value from cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
+		}
+	}
+	if cache.EnableKvStore {
+		if entry, val, ok := cache.GetKvStore().Get(cacheKey); ok && entry.Md5 == latest.md5 {
+			c.setKvValueToCache(cacheKey, latest, val, false)
+			return verified(val), true
+		}
+	}
+	return nil, false
+}
+
+// getKvValueDegraded gets the kv value from the memory cache or the disk store when feed-server is unavailable,
+// the value may be not the latest one, and is refused if it is staler than the max staleness.
+func (c *client) getKvValueDegraded(cacheKey string, err error) (*KvValue, error) {
+	var v *KvValue
+	if cache.EnableMemCache {
+		val, cErr := cache.GetMemCache().Get(cacheKey)
+		if cErr == nil {
+			v = &KvValue{Value: string(val[32:]), Md5: string(val[:32])}
+			metrics.CacheHitCounter.WithLabelValues(metrics.CacheKv).Inc()
+			metrics.CacheServedBytesCounter.WithLabelValues(metrics.CacheKv).Add(float64(len(v.Value)))
+			logger.Warn("feed-server is unavailable but get kv value from cache successfully",
+				slog.String("key", cacheKey))
+		} else {
+			metrics.CacheMissCounter.WithLabelValues(metrics.CacheKv).Inc()
+			logger.Error("get kv value from cache failed", slog.String("key", cacheKey), logger.ErrAttr(cErr))
+		}
+	}
+	if v == nil && cache.EnableKvStore {
+		if entry, val, ok := cache.GetKvStore().Get(cacheKey); ok {
+			// the value is verified when it is stored at least
+			v = &KvValue{Value: val, Md5: entry.Md5, ReleaseID: entry.ReleaseID, VerifiedAt: entry.UpdatedAt}
+			logger.Warn("feed-server is unavailable but get kv value from disk cache successfully",
+				slog.String("key", cacheKey), slog.Any("releaseID", entry.ReleaseID))
+		} else {
+			logger.Error("get kv value from disk cache failed", slog.String("key", cacheKey))
+		}
+	}
+	if v == nil {
+		return nil, err
+	}
+
+	v.Source = KvSourceCacheFallback
+	if vf, ok := c.kvVerifications.Load(cacheKey); ok && vf.(*kvVerification).md5 == v.Md5 {
+		v.ReleaseID = vf.(*kvVerification).releaseID
+		if vf.(*kvVerification).at.After(v.VerifiedAt) {
+			v.VerifiedAt = vf.(*kvVerification).at
+		}
+	}
+	if !v.VerifiedAt.IsZero() {
+		v.Staleness = time.Since(v.VerifiedAt)
+	}
+
+	maxStaleness := c.opts.kvCache.MaxStaleness
+	if maxStaleness > 0 && (v.VerifiedAt.IsZero() || v.Staleness > maxStaleness) {
+		return nil, fmt.Errorf("%w, staleness %s exceeds %s, err: %s", ErrKvStale, v.Staleness, maxStaleness,
+			err.Error())
+	}
+	return v, nil
+}
+
+// getLatestKv gets the meta of the kv in the latest release
+func (c *client) getLatestKv(app string, key string, opts ...AppOption) (*latestKv, error) {
+	release, err := c.PullKvs(app, []string{}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range release.KvItems {
+		if k.Key == key {
+			return &latestKv{releaseID: release.ReleaseID, md5: k.ContentSpec.Md5, kvType: k.KvType}, nil
+		}
+	}
+	return nil, ErrNotFoundKvMD5
+}
+
+// getKvValueFromCache get kv value from the cache
+func (c *client) getKvValueFromCache(cacheKey, md5 string) (string, error) {
+	val, err := cache.GetMemCache().Get(cacheKey)
+	if err != nil {
+		metrics.CacheMissCounter.WithLabelValues(metrics.CacheKv).Inc()
+		return "", err
+	}
+	// 判断是否为最新版本缓存，不是最新则仍从服务端获取value
+	if string(val[:32]) != md5 {
+		metrics.CacheMissCounter.WithLabelValues(metrics.CacheKv).Inc()
+		return "", bigcache.ErrEntryNotFound
+	}
+
+	metrics.CacheHitCounter.WithLabelValues(metrics.CacheKv).Inc()
+	metrics.CacheServedBytesCounter.WithLabelValues(metrics.CacheKv).Add(float64(len(val) - 32))
+	return string(val[32:]), nil
+}
+
+// setKvValueToCache sets the kv value to the memory cache, and writes through the disk store if toDisk
+func (c *client) setKvValueToCache(cacheKey string, latest *latestKv, val string, toDisk bool) {
+	c.kvVerifications.Store(cacheKey, &kvVerification{releaseID: latest.releaseID, md5: latest.md5,
+		at: time.Now()})
+	if cache.EnableMemCache {
+		if err := cache.SetMemCache(cacheKey, append([]byte(latest.md5), []byte(val)...)); err != nil {
+			logger.Error("set kv cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
+		}
+	}
+	if cache.EnableKvStore && toDisk {
+		err := cache.GetKvStore().Set(cacheKey, latest.releaseID, latest.md5, latest.kvType, val)
+		if err != nil && !errors.Is(err, cache.ErrKvStoreSecret) {
+			logger.Error("set kv disk cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
+		}
+	}
+}
+
+// kvCacheKey is cache key for kv md5 and value, the cached data's first 32 character is md5, other is value
+func kvCacheKey(bizID uint32, app, key string) string {
+	return fmt.Sprintf("%d_%s_%s", bizID, app, key)
+}
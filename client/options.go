@@ -12,6 +12,11 @@
 
 package client
 
+import (
+	"fmt"
+	"time"
+)
+
 // options options for bscp sdk client
 type options struct {
 	// FeedAddr BSCP feed_server address
@@ -46,6 +51,22 @@ type options struct {
 	enableMonitorResourceUsage bool
 	// textLineBreak is the text file line break character, default as LF
 	textLineBreak string
+	// eventRetention is the count of the events retained in metadata.json and changeevent.json
+	eventRetention int
+	// hookTimeout is the timeouts of the pre and post hooks
+	hookTimeout HookTimeout
+	// releaseHistory is the count of the release snapshots kept for rollback in the app dirs, 0 means disabled
+	releaseHistory int
+	// bounce periodic upstream rebalancing option
+	bounce Bounce
+	// bandwidthLimit download bandwidth limit option
+	bandwidthLimit BandwidthLimit
+	// rangeDownload adaptive range download option
+	rangeDownload RangeDownload
+	// asyncDownload async p2p download option
+	asyncDownload AsyncDownload
+	// downloadBackends the download backend chain
+	downloadBackends []DownloadBackend
 }
 
 // FileCache option for file cache
@@ -56,10 +77,20 @@ type FileCache struct {
 	CacheDir string
 	// ThresholdGB is threshold gigabyte of cleanup
 	ThresholdGB float64
-	// CleanupIntervalSeconds is interval seconds of cleanup, not exposed for configuration now, use default value
-	// CleanupIntervalSeconds int64
-	// RetentionRate is retention rate of cleanup, not exposed for configuration now, use default value
-	// RetentionRate float64
+	// CleanupIntervalSeconds is interval seconds of cleanup, 0 means DefaultCleanupIntervalSeconds
+	CleanupIntervalSeconds int64
+	// RetentionRate is the rate of the threshold retained after cleanup, 0 means DefaultCacheRetentionRate
+	RetentionRate float64
+	// EvictionPolicy is the policy to choose the files to evict, one of lru, lfu, empty means lru
+	EvictionPolicy string
+	// Materialize is the way to materialize the app files from the cache, one of copy, reflink, hardlink,
+	// empty means copy. reflink falls back to copy if the file system does not support it, hardlink falls back to
+	// reflink or copy for the text files need line break conversion and the cache files shared with different
+	// permission. the hard linked files must not be modified in place by the applications.
+	Materialize string
+	// PrefetchConcurrency is the max concurrent downloads prefetching the contents of the published releases to
+	// the cache in the background when watching, limited by the warm-up bandwidth limit, 0 means disabled
+	PrefetchConcurrency int
 }
 
 // P2PDownload option for p2p download file
@@ -76,12 +107,92 @@ type P2PDownload struct {
 	ContainerName string
 }
 
+// Bounce option for periodic upstream rebalancing
+type Bounce struct {
+	// Enabled is whether enable periodic reconnecting to another feed server
+	Enabled bool
+	// Interval is the interval of rebalancing, use the server suggested one if not set
+	Interval time.Duration
+	// Jitter is the max random delay added to each interval, avoid all clients rebalancing at the same time
+	Jitter time.Duration
+}
+
+// HookTimeout option for the timeouts of the hooks, the hook is killed with the processes it spawns on timeout.
+// the timeout is overridden by the hook tag timeout=<duration> of the release, 0 means no timeout.
+type HookTimeout struct {
+	// PreHook is the timeout of the pre hook
+	PreHook time.Duration
+	// PostHook is the timeout of the post hook
+	PostHook time.Duration
+}
+
+// BandwidthLimit option for download bandwidth limit
+type BandwidthLimit struct {
+	// BytesPerSecond is the bandwidth limit of all the downloads in the process, 0 means unlimited
+	BytesPerSecond int64
+	// BurstBytes is the max bytes allowed to be downloaded at once, 0 means the same as the limit per second
+	BurstBytes int64
+	// WarmupBytesPerSecond is the bandwidth limit of the cache warm-up downloads, 0 means unlimited
+	WarmupBytesPerSecond int64
+	// Schedules overrides BytesPerSecond in the specified time range of the day, the first matched one wins
+	Schedules []BandwidthSchedule
+}
+
+// BandwidthSchedule option for download bandwidth limit in a time range of the day
+type BandwidthSchedule struct {
+	// Start is the begin clock of the time range in local time, formatted as 15:04
+	Start string
+	// End is the end clock of the time range in local time, formatted as 15:04, the time range crosses the
+	// midnight if End is earlier than Start
+	End string
+	// BytesPerSecond is the bandwidth limit in the time range, 0 means unlimited
+	BytesPerSecond int64
+}
+
+// RangeDownload option for adaptive range download, the part size and concurrency are adjusted by the
+// measured throughput and error rate within the upper bounds
+type RangeDownload struct {
+	// MaxPartBytes is the max size of a range part, 0 means the default value
+	MaxPartBytes uint64
+	// MaxConcurrency is the max concurrent range parts of the process, 0 means the max http download goroutines
+	MaxConcurrency int64
+	// WaitTimeMil is the delay in milliseconds before downloading, used for traffic control,
+	// 0 means use the server suggested one, negative means no delay
+	WaitTimeMil int64
+}
+
+// AsyncDownload option for async p2p download, 0 means the default value
+type AsyncDownload struct {
+	// MinFileBytes is the min size of the file downloaded via p2p, default as 2MB
+	MinFileBytes uint64
+	// Timeout is the max time waiting for a p2p download task since it is submitted, default as 10 minutes
+	Timeout time.Duration
+	// PollInterval is the initial interval of polling the task status, default as 5 seconds
+	PollInterval time.Duration
+	// MaxPollInterval is the max interval of polling the task status, the interval doubles each time no task
+	// makes progress, default as 30 seconds
+	MaxPollInterval time.Duration
+}
+
 // KvCache option for kv cache
 type KvCache struct {
 	// Enabled is whether enable kv cache
 	Enabled bool
 	// ThresholdMB is threshold megabyte of kv cache
 	ThresholdMB float64
+	// DiskEnabled is whether enable the on-disk kv cache, which is loaded when the client is created and serves
+	// the kv values when feed-server is unavailable, even after restart
+	DiskEnabled bool
+	// DiskDir is the dir of the on-disk kv cache
+	DiskDir string
+	// DiskThresholdMB is threshold megabyte of the on-disk kv cache, the least recently used kvs are evicted beyond it
+	DiskThresholdMB float64
+	// EncryptionKey is the 32 bytes AES-256 key to encrypt the secret kvs on disk, secret kvs are not stored
+	// on disk without it
+	EncryptionKey []byte
+	// MaxStaleness is the max duration since the cached kv value was verified to be the latest one, the staler value
+	// is refused with ErrKvStale when feed-server is unavailable, 0 means unlimited
+	MaxStaleness time.Duration
 }
 
 const (
@@ -89,6 +200,10 @@ const (
 	DefaultCleanupIntervalSeconds = 300
 	// DefaultCacheRetentionRate is the bscp cli default file cache retention rate, which is 90%
 	DefaultCacheRetentionRate = 0.9
+	// DefaultKvDiskCacheDir is the default dir of the on-disk kv cache
+	DefaultKvDiskCacheDir = "/data/bscp/kv-cache"
+	// DefaultKvDiskCacheThresholdMB is the default threshold of the on-disk kv cache, which is 100MB
+	DefaultKvDiskCacheThresholdMB = 100
 )
 
 // Option setter for bscp sdk options
@@ -216,6 +331,88 @@ func WithTextLineBreak(lineBreak string) Option {
 	}
 }
 
+// WithEventRetention set the count of the events retained in metadata.json and changeevent.json of the apps,
+// the older events are compacted, 0 means the default count
+func WithEventRetention(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid event retention %d, should not be negative", n)
+		}
+		o.eventRetention = n
+		return nil
+	}
+}
+
+// WithReleaseHistory set the count of the latest applied releases kept as snapshots for rollback in the app
+// dirs, the snapshots reference the file contents by signatures, 0 means disabled
+func WithReleaseHistory(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid release history %d, should not be negative", n)
+		}
+		o.releaseHistory = n
+		return nil
+	}
+}
+
+// WithHookTimeout set the timeouts of the pre and post hooks
+func WithHookTimeout(t HookTimeout) Option {
+	return func(o *options) error {
+		if t.PreHook < 0 || t.PostHook < 0 {
+			return fmt.Errorf("invalid hook timeout %+v, should not be negative", t)
+		}
+		o.hookTimeout = t
+		return nil
+	}
+}
+
+// WithBounce set periodic upstream rebalancing
+func WithBounce(b Bounce) Option {
+	return func(o *options) error {
+		o.bounce = b
+		return nil
+	}
+}
+
+// WithBandwidthLimit set download bandwidth limit
+func WithBandwidthLimit(l BandwidthLimit) Option {
+	return func(o *options) error {
+		if _, err := l.toDownloader(); err != nil {
+			return err
+		}
+		o.bandwidthLimit = l
+		return nil
+	}
+}
+
+// WithRangeDownload set adaptive range download option
+func WithRangeDownload(r RangeDownload) Option {
+	return func(o *options) error {
+		if r.MaxConcurrency < 0 {
+			return fmt.Errorf("invalid range download max concurrency %d, should >= 0", r.MaxConcurrency)
+		}
+		o.rangeDownload = r
+		return nil
+	}
+}
+
+// WithAsyncDownload set async p2p download option, it takes effect when p2p download is enabled
+func WithAsyncDownload(a AsyncDownload) Option {
+	return func(o *options) error {
+		o.asyncDownload = a
+		return nil
+	}
+}
+
+// WithDownloadBackend set the download backend chain, the backends are tried in order until one of them
+// succeeds, the built-in downloaders are tried at last unless BuiltinDownloadBackend is in the chain
+func WithDownloadBackend(backends ...DownloadBackend) Option {
+	return func(o *options) error {
+		o.downloadBackends = append(o.downloadBackends, backends...)
+		return nil
+	}
+}
+
 // AppOptions options for app pull and watch
 type AppOptions struct {
 	// Match matches config items
@@ -0,0 +1,146 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+)
+
+// FileProgress is the download progress of a config item file
+type FileProgress struct {
+	// File is the path and name of the config item
+	File string
+	// Signature is the SHA256 of the content
+	Signature string
+	// DoneBytes is the downloaded bytes
+	DoneBytes uint64
+	// TotalBytes is the total bytes of the content
+	TotalBytes uint64
+	// BytesPerSecond is the average download rate
+	BytesPerSecond float64
+	// ETA is the estimated remaining time
+	ETA time.Duration
+	// ActiveParts is the [start, end] byte ranges being downloaded when download with range policy
+	ActiveParts [][2]uint64
+	// AsyncStatus is the status of the p2p download task, empty if the file is not downloaded via p2p
+	AsyncStatus string
+	// Done is whether the file is downloaded
+	Done bool
+}
+
+// ReleaseProgress is the download progress of the files of a release
+type ReleaseProgress struct {
+	// ReleaseID is the id of the release
+	ReleaseID uint32
+	// DoneFiles is the count of the downloaded files
+	DoneFiles int
+	// TotalFiles is the count of the files to be downloaded
+	TotalFiles int
+	// DoneBytes is the downloaded bytes of all the files
+	DoneBytes uint64
+	// TotalBytes is the total bytes of all the files
+	TotalBytes uint64
+	// BytesPerSecond is the average download rate since tracking
+	BytesPerSecond float64
+	// ETA is the estimated remaining time
+	ETA time.Duration
+	// File is the progress of the file which triggers this event
+	File FileProgress
+}
+
+// AddDownloadProgressListener adds a listener to receive the download progress of every file downloaded by the
+// process, the listener must not block, returns a function to remove the listener
+func AddDownloadProgressListener(listener func(p FileProgress)) (remove func()) {
+	return downloader.AddProgressListener(func(p downloader.Progress) {
+		listener(FileProgress(p))
+	})
+}
+
+// TrackProgress tracks the download progress of the release's files, the handler is called serially when any
+// of the files makes progress, and must not block, returns a function to stop tracking
+func (r *Release) TrackProgress(handler func(p ReleaseProgress)) (stop func()) {
+	t := &releaseTracker{
+		handler: handler,
+		files:   make(map[string]*fileState),
+		start:   time.Now(),
+		progress: ReleaseProgress{
+			ReleaseID:  r.ReleaseID,
+			TotalFiles: len(r.FileItems),
+		},
+	}
+	for _, f := range r.FileItems {
+		signature := f.FileMeta.ContentSpec.Signature
+		state, ok := t.files[signature]
+		if !ok {
+			state = &fileState{total: f.FileMeta.ContentSpec.ByteSize}
+			t.files[signature] = state
+		}
+		state.count++
+		t.progress.TotalBytes += f.FileMeta.ContentSpec.ByteSize
+	}
+
+	return downloader.AddProgressListener(t.onProgress)
+}
+
+// fileState is the download state of the files with the same signature in a release
+type fileState struct {
+	total uint64
+	done  uint64
+	count int
+	ended bool
+}
+
+// releaseTracker aggregates the progress of the files into the release progress
+type releaseTracker struct {
+	lock     sync.Mutex
+	handler  func(p ReleaseProgress)
+	files    map[string]*fileState
+	start    time.Time
+	progress ReleaseProgress
+}
+
+// onProgress updates the release progress with the file progress
+func (t *releaseTracker) onProgress(p downloader.Progress) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state, ok := t.files[p.Signature]
+	if !ok || state.ended {
+		return
+	}
+
+	done := p.DoneBytes
+	if p.Done || done > state.total {
+		done = state.total
+	}
+	t.progress.DoneBytes = t.progress.DoneBytes - uint64(state.count)*state.done + uint64(state.count)*done
+	state.done = done
+	if p.Done {
+		state.ended = true
+		t.progress.DoneFiles += state.count
+	}
+
+	t.progress.BytesPerSecond, t.progress.ETA = 0, 0
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 && t.progress.DoneBytes > 0 {
+		t.progress.BytesPerSecond = float64(t.progress.DoneBytes) / elapsed
+		if t.progress.TotalBytes > t.progress.DoneBytes {
+			t.progress.ETA = time.Duration(float64(t.progress.TotalBytes-t.progress.DoneBytes) /
+				t.progress.BytesPerSecond * float64(time.Second))
+		}
+	}
+	t.progress.File = FileProgress(p)
+	t.handler(t.progress)
+}
@@ -14,6 +14,7 @@ package client
 
 import (
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/TencentBlueKing/bk-bscp/pkg/tools"
@@ -22,6 +23,10 @@ import (
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
 )
 
+// defaultDrainTimeout is the max time to wait for the processing release change events when
+// drain the watch stream gracefully.
+const defaultDrainTimeout = 3 * time.Minute
+
 // NotifyReconnect notify the watcher to reconnect the upstream server.
 func (w *watcher) NotifyReconnect(signal reconnectSignal) {
 	select {
@@ -39,6 +44,11 @@ func (w *watcher) waitForReconnectSignal() {
 		case signal := <-w.reconnectChan:
 			logger.Info("received reconnect signal", slog.String("reason", signal.String()), slog.String("rid", w.vas.Rid))
 
+			// wait for the processing release change events to be done before stop the watch stream.
+			if signal.Graceful {
+				w.drainSubscribers(defaultDrainTimeout)
+			}
+
 			// stop the previous watch stream before close conn.
 			w.StopWatch()
 			w.tryReconnect(w.vas.Rid)
@@ -81,3 +91,41 @@ func (w *watcher) tryReconnect(rid string) {
 	logger.Info("reconnect and re-watch the upstream server done",
 		slog.String("rid", rid), slog.Duration("duration", time.Since(st)))
 }
+
+// bounce rebalance the upstream server, if the watcher is watching, drain the watch stream gracefully
+// and then reconnect, otherwise reconnect the upstream server directly.
+func (w *watcher) bounce() error {
+	if !w.watching.Load() {
+		return w.upstream.ReconnectUpstreamServer()
+	}
+
+	w.NotifyReconnect(reconnectSignal{Reason: "bounce to rebalance upstream server", Graceful: true})
+	return nil
+}
+
+// drainSubscribers wait for all the subscribers' processing release change events to be done, or timeout.
+func (w *watcher) drainSubscribers(timeout time.Duration) {
+	st := time.Now()
+	done := make(chan struct{})
+	go func() {
+		wg := sync.WaitGroup{}
+		for _, sub := range w.subscribers {
+			wg.Add(1)
+			go func(s *subscriber) {
+				defer wg.Done()
+				// the processing lock is held while handling release change event
+				s.processing.Lock()
+				s.processing.Unlock() // nolint:staticcheck
+			}(sub)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("drain watch stream done", slog.Duration("duration", time.Since(st)))
+	case <-time.After(timeout):
+		logger.Warn("drain watch stream timeout, stop it anyway", slog.Duration("timeout", timeout))
+	}
+}
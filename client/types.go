@@ -46,6 +46,13 @@ import (
 const (
 	// updateFileConcurrentLimit is the limit of concurrent for update file.
 	updateFileConcurrentLimit = 10
+	// materializeTmpSuffix is the suffix of the temp file which is written before replacing the target file.
+	materializeTmpSuffix = ".bscp-tmp"
+	// asyncFallbackAnnotation is the annotation key of the files which fall back to http download from p2p
+	// download and the reasons in the release report.
+	asyncFallbackAnnotation = "async_download_fallbacks"
+	// hookTimeoutAnnotation is the annotation key of the failure which is caused by the hook timeout
+	hookTimeoutAnnotation = "hook_timeout"
 )
 
 // Release bscp 服务版本
@@ -65,6 +72,13 @@ type Release struct {
 	BizID       uint32
 	ClientMode  sfs.ClientMode
 	AppMate     *sfs.SideAppMeta
+	HookTimeout HookTimeout
+	// historyLimit is the count of the release snapshots kept in the app dir, 0 means no snapshot is saved
+	historyLimit int
+	// rollback means the release is restored from the local history
+	rollback bool
+	// rollbackFrom is the release which is rolled back from
+	rollbackFrom uint32
 }
 
 // ConfigItemFile defines config item file
@@ -79,10 +93,16 @@ type ConfigItemFile struct {
 	Permission *pbci.FilePermission `json:"permission"`
 	// FileMeta data
 	FileMeta *sfs.ConfigItemMetaV1 `json:"fileMeta"`
+	// contentDir is the local dir which the content is read from instead of downloading, such as the offline
+	// bundle store, the contents in it are named by their SHA256
+	contentDir string
 }
 
 // GetContent Get file binary content from cache or download from remote
 func (c *ConfigItemFile) GetContent() ([]byte, error) {
+	if c.contentDir != "" {
+		return os.ReadFile(filepath.Join(c.contentDir, c.FileMeta.ContentSpec.Signature))
+	}
 	if cache.Enable {
 		if hit, bytes := cache.GetCache().GetFileContent(c.FileMeta); hit {
 			logger.Debug("get file content from cache success", slog.String("file", filepath.Join(c.Path, c.Name)))
@@ -102,8 +122,31 @@ func (c *ConfigItemFile) GetContent() ([]byte, error) {
 
 // SaveToFile save file content and write to local file
 func (c *ConfigItemFile) SaveToFile(dst string) error {
+	return c.saveToFile(dst, false)
+}
+
+// saveToFile save file content and write to local file, the file is hard linked from the cache if linkable and
+// the cache is configured to do so, the linked file must not be modified in place.
+func (c *ConfigItemFile) saveToFile(dst string, linkable bool) error {
+	// the dst may be a temp file hard linked from the cache before, remove it rather than overwrite the cache
+	if nlink, err := util.HardLinkCount(dst); err == nil && nlink > 1 {
+		if err = os.Remove(dst); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+					Err: fmt.Errorf("remove hard linked file %s failed, err: %s", dst, err.Error())})
+		}
+	}
+
 	// 1. check if cache hit, copy from cache
-	if cache.Enable && cache.GetCache().CopyToFile(c.FileMeta, dst) {
+	if c.contentDir != "" {
+		if err := util.CopyFile(filepath.Join(c.contentDir, c.FileMeta.ContentSpec.Signature), dst); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed,
+					Err: fmt.Errorf("copy content from %s failed, err: %s", c.contentDir, err.Error())})
+		}
+	} else if cache.Enable && linkable && cache.GetCache().LinkToFile(c.FileMeta, dst) {
+		logger.Debug("link file from cache success", slog.String("dst", dst))
+	} else if cache.Enable && !linkable && cache.GetCache().CopyToFile(c.FileMeta, dst) {
 		logger.Debug("copy file from cache success", slog.String("dst", dst))
 	} else {
 		// 2. if cache not hit, download file from remote
@@ -113,6 +156,8 @@ func (c *ConfigItemFile) SaveToFile(dst string) error {
 			return err
 		}
 	}
+	// the file may be copied from cache without downloading, report it as done
+	downloader.PublishDone(c.FileMeta.PbFileMeta())
 
 	return nil
 }
@@ -171,7 +216,8 @@ func (p *PreScriptStrategy) executeScript(r *Release) error {
 	if r.PreHook == nil {
 		return nil
 	}
-	err := util.ExecuteHook(r.PreHook, table.PreHook, r.TempDir, r.BizID, r.AppMate.App, r.ReleaseName)
+	err := util.ExecuteHook(r.PreHook, table.PreHook, r.TempDir, r.BizID, r.AppMate.App, r.ReleaseName,
+		r.HookTimeout.PreHook)
 	if err != nil {
 		logger.Error("execute pre hook", logger.ErrAttr(err))
 		// 断言错误
@@ -196,7 +242,8 @@ func (p *PostScriptStrategy) executeScript(r *Release) error {
 	if r.PostHook == nil {
 		return nil
 	}
-	err := util.ExecuteHook(r.PostHook, table.PostHook, r.TempDir, r.BizID, r.AppMate.App, r.ReleaseName)
+	err := util.ExecuteHook(r.PostHook, table.PostHook, r.TempDir, r.BizID, r.AppMate.App, r.ReleaseName,
+		r.HookTimeout.PostHook)
 	if err != nil {
 		logger.Error("execute post hook", logger.ErrAttr(err))
 		// 断言错误
@@ -225,12 +272,17 @@ func (r *Release) ExecuteHook(hook ScriptStrategy) Function {
 func (r *Release) UpdateFiles() Function {
 	return func() error {
 		filesDir := filepath.Join(r.AppDir, "files")
-		if err := updateFiles(filesDir, r.FileItems, &r.AppMate.DownloadFileNum, &r.AppMate.DownloadFileSize,
-			r.SemaphoreCh); err != nil {
+		asyncFiles := submitAsyncDownloads(filesDir, r.FileItems)
+		err := updateFiles(filesDir, r.FileItems, &r.AppMate.DownloadFileNum, &r.AppMate.DownloadFileSize,
+			r.SemaphoreCh)
+		// the tasks are not consumed if the release is aborted, their temp files are removed once finished
+		downloader.AbandonAsyncDownloads(asyncFiles)
+		if err != nil {
 			logger.Error("update file failed", logger.ErrAttr(err))
 			return err
 		}
-		if r.ClientMode == sfs.Pull {
+		// 回滚需要清理目标版本中不存在的文件
+		if r.ClientMode == sfs.Pull && !r.rollback {
 			return nil
 		}
 		if err := clearOldFiles(filesDir, r.FileItems); err != nil {
@@ -251,6 +303,47 @@ func (r *Release) UpdateFiles() Function {
 	}
 }
 
+// submitAsyncDownloads submits the p2p download tasks of the files which need to be downloaded together,
+// the files which probably exist locally or are handled by the file cache are skipped, returns the submitted files
+func submitAsyncDownloads(filesDir string, files []*ConfigItemFile) []downloader.AsyncFile {
+	var asyncFiles []downloader.AsyncFile
+	for _, f := range files {
+		fileDir := filepath.Join(filesDir, f.Path)
+		info, err := os.Stat(filepath.Join(fileDir, f.Name))
+		if err == nil && uint64(info.Size()) == f.FileMeta.ContentSpec.ByteSize {
+			continue
+		}
+		// the cacheable files are downloaded into the cache work dir by the cache, submitting them here would
+		// download them twice and leave the unused task files in the app files dir
+		if cache.Enable && cache.GetCache().Cacheable(f.FileMeta) {
+			continue
+		}
+		asyncFiles = append(asyncFiles, downloader.AsyncFile{FileMeta: f.FileMeta.PbFileMeta(), Dir: fileDir})
+	}
+	downloader.SubmitAsyncDownloads(asyncFiles)
+	return asyncFiles
+}
+
+// annotateAsyncFallbacks records the files which fall back to http download from p2p download in the report
+func (r *Release) annotateAsyncFallbacks(annotations map[string]interface{}) {
+	signatures := make([]string, 0, len(r.FileItems))
+	for _, f := range r.FileItems {
+		signatures = append(signatures, f.FileMeta.ContentSpec.Signature)
+	}
+	reasons := downloader.TakeAsyncFallbacks(signatures)
+	if len(reasons) == 0 {
+		return
+	}
+
+	fallbacks := make(map[string]string, len(reasons))
+	for _, f := range r.FileItems {
+		if reason, ok := reasons[f.FileMeta.ContentSpec.Signature]; ok {
+			fallbacks[filepath.ToSlash(filepath.Join(f.Path, f.Name))] = reason
+		}
+	}
+	annotations[asyncFallbackAnnotation] = fallbacks
+}
+
 // UpdateMetadata 4.更新meatdata数据方法
 func (r *Release) UpdateMetadata() Function {
 	return func() error {
@@ -264,11 +357,21 @@ func (r *Release) UpdateMetadata() Function {
 			ConfigMatches: match,
 			EventTime:     time.Now().Format(time.RFC3339),
 		}
+		if r.rollback {
+			metadata.Message = fmt.Sprintf("rollback from release %d", r.rollbackFrom)
+		}
 		err := eventmeta.AppendMetadataToFile(r.AppDir, metadata)
 		if err != nil {
 			logger.Error("append metadata to file failed", logger.ErrAttr(err))
 			return err
 		}
+		// 快照保存失败不影响本次变更，只是无法回滚到该版本
+		if r.historyLimit > 0 {
+			if err = r.saveSnapshot(); err != nil {
+				logger.Warn("save release snapshot failed", slog.String("app", r.AppMate.App),
+					slog.Any("releaseID", r.ReleaseID), logger.ErrAttr(err))
+			}
+		}
 		return nil
 	}
 }
@@ -359,6 +462,7 @@ func (r *Release) Execute(steps ...Function) error {
 	r.AppMate.ReleaseChangeStatus = sfs.Processing
 	// 初始化基础数据
 	bd := r.handleBasicData(r.ClientMode, map[string]interface{}{})
+	r.annotateRollback(bd.Annotations)
 
 	// 发送变更事件
 	defer func() {
@@ -376,11 +480,15 @@ func (r *Release) Execute(steps ...Function) error {
 				r.AppMate.FailedReason = e.FailedReason
 				r.AppMate.SpecificFailedReason = e.SpecificFailedReason
 				r.AppMate.FailedDetailReason = e.Err.Error()
+				if errors.Is(e.Err, util.ErrHookTimeout) {
+					bd.Annotations[hookTimeoutAnnotation] = true
+				}
 			}
 		}
 
 		// 如果是跳过版本变更则不上报数据
 		if !skip {
+			r.annotateAsyncFallbacks(bd.Annotations)
 			if err = r.sendVersionChangeMessaging(bd); err != nil {
 				logger.Error("description failed to report the client change event",
 					slog.String("client_mode", r.ClientMode.String()), slog.Uint64("biz", uint64(r.BizID)),
@@ -409,8 +517,8 @@ func (r *Release) Execute(steps ...Function) error {
 			slog.String("app", r.AppMate.App), logger.ErrAttr(err))
 	}
 
-	// 发送心跳数据
-	if r.ClientMode == sfs.Pull {
+	// 发送心跳数据，离线模式没有上游服务
+	if r.ClientMode == sfs.Pull && r.upstream != nil {
 		r.loopHeartbeat(bd)
 	}
 
@@ -445,6 +553,11 @@ func (r *Release) sendVersionChangeMessaging(bd *sfs.BasicData) (err error) {
 		}
 	}
 
+	// 离线模式没有上游服务，只记录变更事件
+	if r.upstream == nil {
+		return nil
+	}
+
 	pullPayload := sfs.VersionChangePayload{
 		BasicData:     bd,
 		Application:   r.AppMate,
@@ -598,30 +711,34 @@ func updateFiles(filesDir string, files []*ConfigItemFile, successDownloads *int
 					sfs.SecondaryError{SpecificFailedReason: sfs.CheckFileExistsFailed,
 						Err: fmt.Errorf("check file exists failed, err: %s", err.Error())})
 			}
-			if !exists {
-				err := file.SaveToFile(filePath)
-				if err != nil {
+			needConvert := file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != ""
+			switch {
+			case !exists:
+				if err := file.materialize(filePath, false, needConvert); err != nil {
 					atomic.AddInt32(&failed, 1)
 					return err
 				}
 				atomic.AddInt32(&success, 1)
 				logger.Info("update file success", slog.String("file", filePath))
-			} else {
+			case needConvert:
+				// the content is not changed, but still need to convert the line break
+				if err := file.materialize(filePath, true, needConvert); err != nil {
+					atomic.AddInt32(&failed, 1)
+					return err
+				}
+				atomic.AddInt32(&skip, 1)
+				downloader.PublishDone(file.FileMeta.PbFileMeta())
+			default:
 				atomic.AddInt32(&skip, 1)
 				logger.Debug("file is already exists and has not been modified, skip download",
 					slog.String("file", filePath))
-			}
-			// 4. check whether need to convert line break
-			if file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != "" {
-				if err := util.ConvertTextLineBreak(filePath, file.TextLineBreak); err != nil {
-					logger.Error("convert text file line break failed", slog.String("file", filePath), logger.ErrAttr(err))
-					return err
-				}
-			}
-			// 5. set file permission
-			if runtime.GOOS != "windows" {
-				if err := util.SetFilePermission(filePath, file.FileMeta.ConfigItemSpec.Permission); err != nil {
-					logger.Warn("set file permission failed", slog.String("file", filePath), logger.ErrAttr(err))
+				downloader.PublishDone(file.FileMeta.PbFileMeta())
+				// set file permission, chmod and chown are atomic, no need to replace the file
+				if runtime.GOOS != "windows" {
+					if err := file.setFilePermission(filePath); err != nil {
+						atomic.AddInt32(&failed, 1)
+						return err
+					}
 				}
 			}
 			atomic.AddInt32(successDownloads, 1)
@@ -649,6 +766,91 @@ func updateFiles(filesDir string, files []*ConfigItemFile, successDownloads *int
 	return nil
 }
 
+// materialize writes the config item to a temp file in the same directory of the target file, verifies the
+// content, converts the line break, sets the permission and flushes it to the disk, then renames it to the
+// target file atomically, so that the applications never read a half-written or wrongly permissioned file.
+// the temp file is kept when download failed, so that the download can be resumed next time.
+func (c *ConfigItemFile) materialize(filePath string, exists, needConvert bool) error {
+	tmpPath := filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+materializeTmpSuffix)
+
+	// 1. write the content to the temp file
+	if exists {
+		// the temp file may be left hard linked from the cache, remove it rather than overwrite the cache
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+					Err: fmt.Errorf("remove temp file %s failed, err: %s", tmpPath, err.Error())})
+		}
+		if err := util.CopyFile(filePath, tmpPath); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+					Err: fmt.Errorf("copy file %s failed, err: %s", filePath, err.Error())})
+		}
+	} else if err := c.saveToFile(tmpPath, !needConvert); err != nil {
+		return err
+	}
+
+	// 2. verify the content with the signature
+	sha, err := tools.FileSHA256(tmpPath)
+	if err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed,
+				Err: fmt.Errorf("calculate file %s sha256 failed, err: %s", tmpPath, err.Error())})
+	}
+	if sha != c.FileMeta.ContentSpec.Signature {
+		_ = os.Remove(tmpPath)
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ValidateDownloadFailed,
+				Err: fmt.Errorf("file %s sha256 %s is not match with the signature %s", filePath, sha,
+					c.FileMeta.ContentSpec.Signature)})
+	}
+
+	// 3. check whether need to convert line break
+	if needConvert {
+		if err := util.ConvertTextLineBreak(tmpPath, c.TextLineBreak); err != nil {
+			logger.Error("convert text file line break failed", slog.String("file", filePath), logger.ErrAttr(err))
+			return err
+		}
+	}
+
+	// 4. set file permission
+	if runtime.GOOS != "windows" {
+		if err := util.SetFilePermission(tmpPath, c.FileMeta.ConfigItemSpec.Permission); err != nil {
+			logger.Warn("set file permission failed", slog.String("file", filePath), logger.ErrAttr(err))
+		}
+	}
+
+	// 5. flush to the disk and replace the target file
+	if err := util.SyncFile(tmpPath); err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+				Err: fmt.Errorf("sync file %s failed, err: %s", tmpPath, err.Error())})
+	}
+	if err := util.ReplaceFile(tmpPath, filePath); err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+				Err: fmt.Errorf("replace file %s failed, err: %s", filePath, err.Error())})
+	}
+
+	return nil
+}
+
+// setFilePermission sets the permission of the existing file, the file hard linked from the cache is replaced by a
+// copy if its permission is changed, so that the cache and the other files linked to it are not affected.
+func (c *ConfigItemFile) setFilePermission(filePath string) error {
+	pm := c.FileMeta.ConfigItemSpec.Permission
+	if nlink, err := util.HardLinkCount(filePath); err == nil && nlink > 1 {
+		if matched, e := util.FilePermissionMatched(filePath, pm); e == nil && matched {
+			return nil
+		}
+		return c.materialize(filePath, true, false)
+	}
+	if err := util.SetFilePermission(filePath, pm); err != nil {
+		logger.Warn("set file permission failed", slog.String("file", filePath), logger.ErrAttr(err))
+	}
+	return nil
+}
+
 // recordChangeEvent 记录变更事件
 func (r *Release) recordChangeEvent() error {
 	var eventStatus eventmeta.EventStatus
@@ -660,6 +862,11 @@ func (r *Release) recordChangeEvent() error {
 	metadata := &eventmeta.ChangeEvent{
 		ReleaseID: r.ReleaseID,
 		Status:    eventStatus,
+		EventTime: time.Now().Format(time.RFC3339),
+	}
+	if eventStatus == eventmeta.EventStatusFailed {
+		metadata.FailedReason = r.AppMate.FailedReason.String()
+		metadata.Message = r.AppMate.FailedDetailReason
 	}
 	err := eventmeta.RecordChangeEvent(r.AppDir, metadata)
 	if err != nil {
@@ -33,6 +33,8 @@ import (
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
 
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/internal/util/process_collect"
@@ -44,6 +46,8 @@ import (
 // watcher to reconnect the remote upstream server.
 type reconnectSignal struct {
 	Reason string
+	// Graceful means wait for the processing release change events to be done before reconnect.
+	Graceful bool
 }
 
 // String format the reconnect signal to a string.
@@ -61,6 +65,8 @@ type watcher struct {
 	reconnectChan   chan reconnectSignal
 	Conn            *grpc.ClientConn
 	upstream        upstream.Upstream
+	// watching is whether the watch stream is running
+	watching atomic.Bool
 }
 
 func (w *watcher) buildVas() (*kit.Vas, context.CancelFunc) {
@@ -157,6 +163,7 @@ func (w *watcher) StartWatch() error {
 		w.cancel()
 		return fmt.Errorf("start loop hearbeat failed, err: %s", err.Error())
 	}
+	w.watching.Store(true)
 	return nil
 }
 
@@ -167,6 +174,7 @@ func (w *watcher) StopWatch() {
 		return
 	}
 
+	w.watching.Store(false)
 	w.cancel()
 
 	// Close all subscriber event queues to stop event processing goroutines
@@ -244,7 +252,7 @@ func (w *watcher) loopReceiveWatchedEvent(wStream pbfs.Upstream_WatchClient) {
 			switch sfs.FeedMessageType(event.Type) {
 			case sfs.Bounce:
 				logger.Info("received upstream bounce request, need to reconnect upstream server", slog.String("rid", event.Rid))
-				w.NotifyReconnect(reconnectSignal{Reason: "received bounce request"})
+				w.NotifyReconnect(reconnectSignal{Reason: "received bounce request", Graceful: true})
 				return
 
 			case sfs.PublishRelease:
@@ -285,22 +293,30 @@ func (w *watcher) OnReleaseChange(event *sfs.ReleaseChangeEvent) { // nolint
 	}
 
 	// TODO: encode subscriber options(App, UID, Labels) to a unique string key
+	var subscribed bool
 	for _, subscriber := range w.subscribers {
 		if subscriber.App == pl.Instance.App &&
 			subscriber.UID == pl.Instance.Uid &&
 			reflect.DeepEqual(subscriber.Labels, pl.Instance.Labels) {
+			subscribed = true
 
 			// Create release change event
 			releaseEvent := &releaseChangeEvent{
 				event:    event,
 				payload:  pl,
 				cursorID: cursorID,
+				scope:    newDownloadScope(pl.ReleaseMeta.CIMetas),
 			}
 
 			// Enqueue the latest event, replacing any pending event
 			subscriber.enqueueLatestEvent(releaseEvent)
 		}
 	}
+
+	// warm the cache in the background, so that the callbacks mostly hit the cache even if they are delayed
+	if subscribed && cache.Enable {
+		cache.GetCache().Prefetch(pl.Instance.App+"/"+pl.Instance.Uid, pl.ReleaseMeta.CIMetas)
+	}
 }
 
 // Subscribe subscribe the instance release change event
@@ -337,11 +353,66 @@ func (w *watcher) Subscribers() []*subscriber {
 	return w.subscribers
 }
 
+// WatchStatus is the live state of the watch
+type WatchStatus struct {
+	// Watching is whether the watch stream is running
+	Watching bool `json:"watching"`
+	// Upstream is the feed server address of the current connection
+	Upstream string `json:"upstream"`
+	// ConnState is the state of the connection to the feed server
+	ConnState string `json:"conn_state"`
+	// Apps is the state of the watched apps
+	Apps []*AppWatchStatus `json:"apps"`
+}
+
+// AppWatchStatus is the live state of the watched app
+type AppWatchStatus struct {
+	App              string `json:"app"`
+	CurrentReleaseID uint32 `json:"current_release_id"`
+	TargetReleaseID  uint32 `json:"target_release_id"`
+	ChangeStatus     string `json:"change_status"`
+	DownloadFileNum  int32  `json:"download_file_num"`
+	DownloadFileSize uint64 `json:"download_file_size"`
+}
+
+// status returns the live state of the watch
+func (w *watcher) status() *WatchStatus {
+	endpoint, state := w.upstream.ConnState()
+	st := &WatchStatus{
+		Watching:  w.watching.Load(),
+		Upstream:  endpoint,
+		ConnState: state.String(),
+		Apps:      make([]*AppWatchStatus, 0, len(w.subscribers)),
+	}
+	for _, s := range w.subscribers {
+		st.Apps = append(st.Apps, &AppWatchStatus{
+			App:              s.App,
+			CurrentReleaseID: s.CurrentReleaseID,
+			TargetReleaseID:  s.TargetReleaseID,
+			ChangeStatus:     s.ReleaseChangeStatus.String(),
+			DownloadFileNum:  atomic.LoadInt32(&s.DownloadFileNum),
+			DownloadFileSize: atomic.LoadUint64(&s.DownloadFileSize),
+		})
+	}
+	return st
+}
+
 // releaseChangeEvent represents a release change event to be processed
 type releaseChangeEvent struct {
 	event    *sfs.ReleaseChangeEvent
 	payload  *sfs.ReleaseChangePayload
 	cursorID string
+	// scope is the download scope of the release, it is cancelled when the event is superseded by a newer one
+	scope *downloader.Scope
+}
+
+// newDownloadScope creates the download scope which needs the contents of the config items
+func newDownloadScope(cis []*sfs.ConfigItemMetaV1) *downloader.Scope {
+	signatures := make([]string, 0, len(cis))
+	for _, ci := range cis {
+		signatures = append(signatures, ci.ContentSpec.Signature)
+	}
+	return downloader.NewScope(signatures)
 }
 
 // Subscriber is the subscriber of the instance
@@ -373,6 +444,8 @@ type subscriber struct {
 	eventQueue   chan *releaseChangeEvent
 	processing   sync.Mutex
 	enqueueMutex sync.Mutex // Protects event enqueuing operations
+	// runningScope is the download scope of the event being handled
+	runningScope atomic.Pointer[downloader.Scope]
 	watcher      *watcher
 	closed       int32
 }
@@ -445,9 +518,16 @@ func (s *subscriber) enqueueLatestEvent(event *releaseChangeEvent) {
 			slog.String("app", s.App),
 			slog.Any("releaseID", event.payload.ReleaseMeta.ReleaseID),
 			slog.String("rid", event.event.Rid))
+		event.scope.Close()
 		return
 	}
 
+	// the downloads of the handling release which are not needed by the newer one are cancelled,
+	// the newer scope has been activated so that the shared contents are carried over
+	if running := s.runningScope.Load(); running != nil {
+		running.Cancel()
+	}
+
 	select {
 	case s.eventQueue <- event:
 		// Successfully enqueued the event
@@ -460,6 +540,7 @@ func (s *subscriber) enqueueLatestEvent(event *releaseChangeEvent) {
 		select {
 		case oldEvent := <-s.eventQueue:
 			// Successfully drained the old event, now enqueue the new one
+			oldEvent.scope.Close()
 			s.eventQueue <- event
 			logger.Info("replaced pending release change event with newer one",
 				slog.String("app", s.App),
@@ -479,6 +560,11 @@ func (s *subscriber) enqueueLatestEvent(event *releaseChangeEvent) {
 
 // handleReleaseChangeEvent handles a single release change event
 func (s *subscriber) handleReleaseChangeEvent(event *releaseChangeEvent) {
+	s.runningScope.Store(event.scope)
+	defer func() {
+		s.runningScope.Store(nil)
+		event.scope.Close()
+	}()
 
 	// 更新心跳数据需要cursorID
 	s.CursorID = event.cursorID
@@ -503,18 +589,20 @@ func (s *subscriber) handleReleaseChangeEvent(event *releaseChangeEvent) {
 	}
 
 	release := &Release{
-		ReleaseID:   event.payload.ReleaseMeta.ReleaseID,
-		ReleaseName: event.payload.ReleaseMeta.ReleaseName,
-		FileItems:   configItemFiles,
-		KvItems:     event.payload.ReleaseMeta.KvMetas,
-		PreHook:     event.payload.ReleaseMeta.PreHook,
-		PostHook:    event.payload.ReleaseMeta.PostHook,
-		vas:         s.watcher.vas,
-		upstream:    s.watcher.upstream,
-		BizID:       s.watcher.opts.bizID,
-		CursorID:    event.cursorID,
-		ClientMode:  sfs.Watch,
-		SemaphoreCh: make(chan struct{}),
+		ReleaseID:    event.payload.ReleaseMeta.ReleaseID,
+		ReleaseName:  event.payload.ReleaseMeta.ReleaseName,
+		FileItems:    configItemFiles,
+		KvItems:      event.payload.ReleaseMeta.KvMetas,
+		PreHook:      event.payload.ReleaseMeta.PreHook,
+		PostHook:     event.payload.ReleaseMeta.PostHook,
+		vas:          s.watcher.vas,
+		upstream:     s.watcher.upstream,
+		BizID:        s.watcher.opts.bizID,
+		CursorID:     event.cursorID,
+		ClientMode:   sfs.Watch,
+		SemaphoreCh:  make(chan struct{}),
+		HookTimeout:  s.watcher.opts.hookTimeout,
+		historyLimit: s.watcher.opts.releaseHistory,
 		AppMate: &sfs.SideAppMeta{
 			App:              s.App,
 			Uid:              s.UID,
@@ -548,6 +636,12 @@ func (s *subscriber) handleReleaseChangeEvent(event *releaseChangeEvent) {
 	if err := s.Callback(release); err != nil {
 		cancel()
 		s.ReleaseChangeStatus = sfs.Failed
+		if event.scope.Cancelled() && isCancelled(err) {
+			logger.Warn("watch callback is interrupted by a newer release", slog.String("app", s.App),
+				slog.Any("releaseID", event.payload.ReleaseMeta.ReleaseID), logger.ErrAttr(err))
+			s.reportReleaseChangeCallbackMetrics("cancelled", start)
+			return
+		}
 		logger.Error("execute watch callback failed", slog.String("app", s.App), logger.ErrAttr(err))
 		s.reportReleaseChangeCallbackMetrics("failed", start)
 	} else {
@@ -558,6 +652,27 @@ func (s *subscriber) handleReleaseChangeEvent(event *releaseChangeEvent) {
 	}
 }
 
+// isCancelled returns whether the error is caused by the cancelled download, the sfs errors are unwrapped
+// by their Err as they do not implement Unwrap
+func isCancelled(err error) bool {
+	for err != nil {
+		if errors.Is(err, context.Canceled) {
+			return true
+		}
+		var pe sfs.PrimaryError
+		var se sfs.SecondaryError
+		switch {
+		case errors.As(err, &pe):
+			err = pe.Err
+		case errors.As(err, &se):
+			err = se.Err
+		default:
+			return false
+		}
+	}
+	return false
+}
+
 // sendClientMessaging 发送客户端连接信息
 func (w *watcher) sendClientMessaging(meta []sfs.SideAppMeta, annotations map[string]interface{}) error {
 	clientInfoPayload := sfs.HeartbeatPayload{
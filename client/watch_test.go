@@ -0,0 +1,48 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+)
+
+func TestIsCancelled(t *testing.T) {
+	cancelled := fmt.Errorf("download is cancelled, %w, err: %w", context.Canceled, errors.New("read body failed"))
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil},
+		{name: "cancelled", err: cancelled, want: true},
+		{name: "wrapped by sfs", err: sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.UnknownSpecificFailed, Err: cancelled}), want: true},
+		{name: "hook failed", err: sfs.WrapPrimaryError(sfs.PostHookFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ScriptExecutionFailed, Err: errors.New("exit status 1")})},
+		{name: "checksum failed", err: sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ValidateDownloadFailed, Err: errors.New("sha256 mismatch")})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCancelled(tt.err); got != tt.want {
+				t.Errorf("isCancelled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
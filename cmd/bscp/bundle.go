@@ -0,0 +1,297 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/config"
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+)
+
+// bundleStoreDir is the dir of the bundle store under the temp dir
+const bundleStoreDir = "bundles"
+
+var (
+	bundleFile     string
+	privateKeyFile string
+	publicKeyFile  string
+	keygenPrivFile string
+	keygenPubFile  string
+	bundleTempDir  string
+	bundleBiz      uint32
+	bundleApp      string
+	bundleRelease  uint32
+	// bundleHookTimeout is the timeouts of the hooks when applying the bundle
+	bundleHookTimeout config.HookTimeoutConfig
+)
+
+var (
+	// bundleCmd is parent cmd for offline bundle sub cmds
+	bundleCmd = &cobra.Command{
+		Use:   "bundle",
+		Short: "Export, import and apply offline release bundles",
+		Long:  `Export, import and apply offline release bundles for the hosts which can not reach the repository`,
+	}
+
+	// bundleKeygenCmd generates the key pair to sign and verify bundles
+	bundleKeygenCmd = &cobra.Command{
+		Use:   "keygen",
+		Short: "Generate the ed25519 key pair to sign and verify bundles",
+		Long:  `Generate the ed25519 key pair to sign and verify bundles`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBundleKeygen()
+		},
+	}
+
+	// bundleExportCmd exports the release of an app into a bundle
+	bundleExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export the release of an app into a signed bundle",
+		Long:  `Export the file metas, contents, kvs and hooks of the release of an app into a signed bundle`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBundleExport()
+		},
+	}
+
+	// bundleImportCmd verifies and imports a bundle into the local bundle store
+	bundleImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Verify and import a bundle into the local bundle store",
+		Long:  `Verify and import a bundle into the local bundle store`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := importBundle()
+			return err
+		},
+	}
+
+	// bundleApplyCmd materializes a bundle into the app dir
+	bundleApplyCmd = &cobra.Command{
+		Use:   "apply",
+		Short: "Materialize a bundle into the app dir without feed server",
+		Long: `Materialize a bundle into the app dir without feed server, the bundle file is imported first if set,
+otherwise the bundle imported before is applied by biz, app and release id`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBundleApply()
+		},
+	}
+)
+
+func init() {
+	bundleKeygenCmd.Flags().StringVarP(&keygenPrivFile, "private-key-file", "", "bscp-bundle.key",
+		"file to save the private key")
+	bundleKeygenCmd.Flags().StringVarP(&keygenPubFile, "public-key-file", "", "bscp-bundle.pub",
+		"file to save the public key")
+
+	// export 参数
+	bundleExportCmd.Flags().SortFlags = false
+	bundleExportCmd.Flags().StringP("feed-addrs", "f", "", "feed server address, eg: 'bscp-feed.example.com:9510'")
+	mustBindPFlag(bundleExportViper, "feed_addrs", bundleExportCmd.Flags().Lookup("feed-addrs"))
+	bundleExportCmd.Flags().IntP("biz", "b", 0, "biz id")
+	mustBindPFlag(bundleExportViper, "biz", bundleExportCmd.Flags().Lookup("biz"))
+	bundleExportCmd.Flags().StringP("app", "a", "", "app name")
+	mustBindPFlag(bundleExportViper, "app", bundleExportCmd.Flags().Lookup("app"))
+	bundleExportCmd.Flags().StringP("token", "t", "", "sdk token")
+	mustBindPFlag(bundleExportViper, "token", bundleExportCmd.Flags().Lookup("token"))
+	bundleExportCmd.Flags().StringP("labels", "l", "", "labels")
+	mustBindPFlag(bundleExportViper, "labels_str", bundleExportCmd.Flags().Lookup("labels"))
+	bundleExportCmd.Flags().StringP("labels-file", "", "", "labels file path")
+	mustBindPFlag(bundleExportViper, "labels_file", bundleExportCmd.Flags().Lookup("labels-file"))
+	bundleExportCmd.Flags().StringP("config-matches", "m", "", "app config item's match conditions，eg:'/etc/a*,/etc/b*'")
+	mustBindPFlag(bundleExportViper, "config_matches", bundleExportCmd.Flags().Lookup("config-matches"))
+	bundleExportCmd.Flags().StringVarP(&bundleFile, "output", "o", "", "bundle file to export to")
+	bundleExportCmd.Flags().StringVarP(&privateKeyFile, "private-key-file", "", "",
+		"private key file to sign the bundle")
+	for key, envName := range commonEnvs {
+		if err := bundleExportViper.BindEnv(key, envName); err != nil {
+			panic(err)
+		}
+		if f := bundleExportCmd.Flags().Lookup(strings.ReplaceAll(key, "_", "-")); f != nil {
+			f.Usage = fmt.Sprintf("%v [env %v]", f.Usage, envName)
+		}
+	}
+
+	// import/apply 参数
+	for _, cmd := range []*cobra.Command{bundleImportCmd, bundleApplyCmd} {
+		cmd.Flags().StringVarP(&bundleFile, "file", "", "", "bundle file to import")
+		cmd.Flags().StringVarP(&publicKeyFile, "public-key-file", "", "", "public key file to verify the bundle")
+		cmd.Flags().StringVarP(&bundleTempDir, "temp-dir", "d", constant.DefaultTempDir, "bscp temp dir")
+	}
+	bundleApplyCmd.Flags().Uint32VarP(&bundleBiz, "biz", "b", 0, "biz id of the imported bundle")
+	bundleApplyCmd.Flags().StringVarP(&bundleApp, "app", "a", "", "app name of the imported bundle")
+	bundleApplyCmd.Flags().Uint32VarP(&bundleRelease, "release-id", "", 0, "release id of the imported bundle")
+	bundleApplyCmd.Flags().Int64VarP(&bundleHookTimeout.PreHookSeconds, "pre-hook-timeout-seconds", "", 0,
+		"timeout seconds of the pre hook, 0 means 600, negative means no timeout")
+	bundleApplyCmd.Flags().Int64VarP(&bundleHookTimeout.PostHookSeconds, "post-hook-timeout-seconds", "", 0,
+		"timeout seconds of the post hook, 0 means 600, negative means no timeout")
+}
+
+// runBundleKeygen 生成签名密钥对，密钥以十六进制编码保存
+func runBundleKeygen() error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate key pair failed, err: %s", err.Error())
+	}
+	if err = os.WriteFile(keygenPrivFile, []byte(hex.EncodeToString(priv)), 0600); err != nil {
+		return fmt.Errorf("save private key failed, err: %s", err.Error())
+	}
+	if err = os.WriteFile(keygenPubFile, []byte(hex.EncodeToString(pub)), 0644); err != nil {
+		return fmt.Errorf("save public key failed, err: %s", err.Error())
+	}
+	fmt.Printf("private key saved to %s, public key saved to %s\n", keygenPrivFile, keygenPubFile)
+	return nil
+}
+
+// readKeyFile 读取十六进制编码的密钥文件
+func readKeyFile(path string, size int) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("key file is required")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file %s failed, err: %s", path, err.Error())
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("key file %s is invalid", path)
+	}
+	return key, nil
+}
+
+// runBundleExport 导出服务的当前版本为离线包
+func runBundleExport() error {
+	if err := initConf(bundleExportViper); err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if len(conf.Apps) != 1 {
+		return fmt.Errorf("only one app can be exported into a bundle")
+	}
+	if bundleFile == "" {
+		return fmt.Errorf("output bundle file is required")
+	}
+	key, err := readKeyFile(privateKeyFile, ed25519.PrivateKeySize)
+	if err != nil {
+		return err
+	}
+
+	bscp, err := client.New(
+		client.WithFeedAddrs(conf.FeedAddrs),
+		client.WithBizID(conf.Biz),
+		client.WithToken(conf.Token),
+		client.WithLabels(conf.Labels),
+		client.WithUID(conf.UID),
+	)
+	if err != nil {
+		return err
+	}
+	defer bscp.Close()
+
+	app := conf.Apps[0]
+	tmp := bundleFile + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("create bundle file failed, err: %s", err.Error())
+	}
+	defer os.Remove(tmp)
+	m, err := bscp.ExportBundle(app.Name, file, ed25519.PrivateKey(key),
+		client.WithAppConfigMatch(app.ConfigMatches), client.WithAppLabels(app.Labels), client.WithAppUID(app.UID))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("close bundle file failed, err: %s", err.Error())
+	}
+	if err = os.Rename(tmp, bundleFile); err != nil {
+		return fmt.Errorf("save bundle file failed, err: %s", err.Error())
+	}
+
+	fmt.Printf("exported app %s release %d (%d files, %d kvs) to %s\n", m.App, m.ReleaseID, len(m.Files),
+		len(m.Kvs), bundleFile)
+	return nil
+}
+
+// importBundle 校验并导入离线包到本地离线包仓库
+func importBundle() (*client.Bundle, error) {
+	if bundleFile == "" {
+		return nil, fmt.Errorf("bundle file is required")
+	}
+	key, err := readKeyFile(publicKeyFile, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(bundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("open bundle file failed, err: %s", err.Error())
+	}
+	defer file.Close()
+
+	b, err := client.ImportBundle(file, filepath.Join(bundleTempDir, bundleStoreDir), ed25519.PublicKey(key))
+	if err != nil {
+		return nil, err
+	}
+	m := b.Manifest()
+	fmt.Printf("imported biz %d app %s release %d (%d files, %d kvs)\n", m.BizID, m.App, m.ReleaseID,
+		len(m.Files), len(m.Kvs))
+	return b, nil
+}
+
+// runBundleApply 将离线包物化到服务目录，执行前后置脚本并更新 metadata
+func runBundleApply() error {
+	var b *client.Bundle
+	var err error
+	if bundleFile != "" {
+		b, err = importBundle()
+	} else {
+		var key []byte
+		if key, err = readKeyFile(publicKeyFile, ed25519.PublicKeySize); err != nil {
+			return err
+		}
+		b, err = client.LoadBundle(filepath.Join(bundleTempDir, bundleStoreDir), bundleBiz, bundleApp, bundleRelease,
+			ed25519.PublicKey(key))
+	}
+	if err != nil {
+		return err
+	}
+
+	m := b.Manifest()
+	appDir := filepath.Join(bundleTempDir, strconv.Itoa(int(m.BizID)), m.App)
+	if err = os.MkdirAll(appDir, os.ModePerm); err != nil {
+		return err
+	}
+	release := b.Release(appDir, bundleTempDir)
+	release.HookTimeout = hookTimeout(&bundleHookTimeout)
+	// 1.执行前置脚本
+	// 2.更新文件和kv
+	// 3.执行后置脚本
+	// 4.更新Metadata
+	if err = release.Execute(release.ExecuteHook(&client.PreScriptStrategy{}), release.UpdateFiles(),
+		b.UpdateKvs(appDir), release.ExecuteHook(&client.PostScriptStrategy{}), release.UpdateMetadata()); err != nil {
+		return err
+	}
+	fmt.Printf("applied app %s release %d to %s\n", m.App, m.ReleaseID, appDir)
+	return nil
+}
@@ -0,0 +1,352 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+)
+
+var (
+	pruneMaxSize    string
+	pruneOlderThan  time.Duration
+	warmConcurrency int
+)
+
+var (
+	// cacheCmd is parent cmd for file cache management sub cmds
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect and manage the file cache",
+		Long:  `Inspect and manage the file cache`,
+	}
+
+	// cacheStatsCmd shows the statistics of the file cache
+	cacheStatsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Show the size, file count, threshold and hit ratio of the file cache",
+		Long:  `Show the size, file count, threshold and hit ratio of the file cache`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheStats(cacheStatsViper)
+		},
+	}
+
+	// cacheLsCmd lists the cache files and the app files referencing them
+	cacheLsCmd = &cobra.Command{
+		Use:   "ls",
+		Short: "List the cache files and the app files referencing them",
+		Long:  `List the cache files and the app files under the temp dir referencing them`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheLs(cacheLsViper)
+		},
+	}
+
+	// cacheVerifyCmd re-hashes the cache files and removes the corrupted ones
+	cacheVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Re-hash the cache files and remove the corrupted ones",
+		Long: `Re-hash every cache file against its file name, which is the sha256 of the content,
+and remove the corrupted ones`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheVerify(cacheVerifyViper)
+		},
+	}
+
+	// cachePruneCmd removes the cache files by size or access time
+	cachePruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the cache files by size or last access time",
+		Long: `Remove the cache files not accessed within --older-than, then evict the cache files in the order of
+the eviction policy until the cache size is not larger than --max-size`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCachePrune(cachePruneViper)
+		},
+	}
+
+	// cacheWarmCmd downloads the latest release of the apps to the file cache
+	cacheWarmCmd = &cobra.Command{
+		Use:   "warm",
+		Short: "Download the latest release of the apps to the file cache",
+		Long:  `Download the files of the latest release of the apps which are missing in the file cache`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheWarm()
+		},
+	}
+)
+
+func init() {
+	// 文件缓存参数覆盖配置文件中的 file_cache 配置
+	cacheVipers := map[*cobra.Command]*viper.Viper{cacheStatsCmd: cacheStatsViper, cacheLsCmd: cacheLsViper,
+		cacheVerifyCmd: cacheVerifyViper, cachePruneCmd: cachePruneViper}
+	for cmd, v := range cacheVipers {
+		cmd.Flags().StringP("file-cache-dir", "", constant.DefaultFileCacheDir, "bscp file cache dir")
+		mustBindPFlag(v, "file_cache.cache_dir", cmd.Flags().Lookup("file-cache-dir"))
+		cmd.Flags().Float64P("cache-threshold-gb", "", constant.DefaultCacheThresholdGB,
+			"bscp file cache threshold gigabyte")
+		mustBindPFlag(v, "file_cache.threshold_gb", cmd.Flags().Lookup("cache-threshold-gb"))
+		cmd.Flags().StringP("cache-eviction-policy", "", constant.DefaultCacheEvictionPolicy,
+			"bscp file cache eviction policy, one of lru, lfu")
+		mustBindPFlag(v, "file_cache.eviction_policy", cmd.Flags().Lookup("cache-eviction-policy"))
+	}
+	cacheStatsCmd.Flags().StringVarP(&outputFormat, "output", "o", "", "output format, One of: json")
+	cacheLsCmd.Flags().StringVarP(&outputFormat, "output", "o", "", "output format, One of: json")
+	cacheLsCmd.Flags().StringP("temp-dir", "d", constant.DefaultTempDir,
+		"bscp temp dir to find the app files referencing the cache files")
+	mustBindPFlag(cacheLsViper, "temp_dir", cacheLsCmd.Flags().Lookup("temp-dir"))
+	if err := cacheLsViper.BindEnv("temp_dir", commonEnvs["temp_dir"]); err != nil {
+		panic(err)
+	}
+	cachePruneCmd.Flags().StringVarP(&pruneMaxSize, "max-size", "", "",
+		"max size of the cache after pruning, eg: 500MiB, 1GB")
+	cachePruneCmd.Flags().DurationVarP(&pruneOlderThan, "older-than", "", 0,
+		"remove the cache files not accessed within the duration, eg: 72h")
+
+	// warm 参数
+	cacheWarmCmd.Flags().SortFlags = false
+	cacheWarmCmd.Flags().StringP("feed-addrs", "f", "", "feed server address, eg: 'bscp-feed.example.com:9510'")
+	mustBindPFlag(cacheWarmViper, "feed_addrs", cacheWarmCmd.Flags().Lookup("feed-addrs"))
+	cacheWarmCmd.Flags().IntP("biz", "b", 0, "biz id")
+	mustBindPFlag(cacheWarmViper, "biz", cacheWarmCmd.Flags().Lookup("biz"))
+	cacheWarmCmd.Flags().StringP("app", "a", "", "app name")
+	mustBindPFlag(cacheWarmViper, "app", cacheWarmCmd.Flags().Lookup("app"))
+	cacheWarmCmd.Flags().StringP("token", "t", "", "sdk token")
+	mustBindPFlag(cacheWarmViper, "token", cacheWarmCmd.Flags().Lookup("token"))
+	cacheWarmCmd.Flags().StringP("labels", "l", "", "labels")
+	mustBindPFlag(cacheWarmViper, "labels_str", cacheWarmCmd.Flags().Lookup("labels"))
+	cacheWarmCmd.Flags().StringP("labels-file", "", "", "labels file path")
+	mustBindPFlag(cacheWarmViper, "labels_file", cacheWarmCmd.Flags().Lookup("labels-file"))
+	cacheWarmCmd.Flags().StringP("config-matches", "m", "", "app config item's match conditions，eg:'/etc/a*,/etc/b*'")
+	mustBindPFlag(cacheWarmViper, "config_matches", cacheWarmCmd.Flags().Lookup("config-matches"))
+	cacheWarmCmd.Flags().StringP("file-cache-dir", "", constant.DefaultFileCacheDir, "bscp file cache dir")
+	mustBindPFlag(cacheWarmViper, "file_cache.cache_dir", cacheWarmCmd.Flags().Lookup("file-cache-dir"))
+	cacheWarmCmd.Flags().Float64P("cache-threshold-gb", "", constant.DefaultCacheThresholdGB,
+		"bscp file cache threshold gigabyte")
+	mustBindPFlag(cacheWarmViper, "file_cache.threshold_gb", cacheWarmCmd.Flags().Lookup("cache-threshold-gb"))
+	addBandwidthLimitFlags(cacheWarmCmd.Flags(), cacheWarmViper)
+	// -c 已用于全局参数 --config
+	cacheWarmCmd.Flags().IntVarP(&warmConcurrency, "concurrency", "", 4, "max concurrent downloads")
+	for key, envName := range commonEnvs {
+		if err := cacheWarmViper.BindEnv(key, envName); err != nil {
+			panic(err)
+		}
+		if f := cacheWarmCmd.Flags().Lookup(strings.ReplaceAll(key, "_", "-")); f != nil {
+			f.Usage = fmt.Sprintf("%v [env %v]", f.Usage, envName)
+		}
+	}
+}
+
+// openCache 按配置文件及命令行参数打开本地文件缓存，不启动自动清理，使用后需关闭
+func openCache(v *viper.Viper) (*cache.Cache, error) {
+	if err := initConf(v); err != nil {
+		return nil, err
+	}
+	if err := conf.FileCache.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cache.Init(cache.Options{
+		Path:           conf.FileCache.CacheDir,
+		ThresholdGB:    conf.FileCache.ThresholdGB,
+		EvictionPolicy: cache.EvictionPolicy(conf.FileCache.EvictionPolicy),
+	}); err != nil {
+		return nil, fmt.Errorf("open file cache failed, err: %s", err.Error())
+	}
+	return cache.GetCache(), nil
+}
+
+// runCacheStats 展示文件缓存统计信息
+func runCacheStats(v *viper.Viper) error {
+	c, err := openCache(v)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stats := c.Stats()
+
+	switch outputFormat {
+	case outputFormatJson:
+		return jsonOutput(stats)
+	case outputFormatTable:
+		table := newTable()
+		table.SetHeader([]string{"Dir", "Size", "Files", "Threshold", "Usage", "Hits", "Misses", "HitRatio"})
+		table.Append([]string{
+			stats.Dir,
+			humanize.IBytes(uint64(stats.Size)),
+			strconv.Itoa(stats.Count),
+			humanize.IBytes(uint64(stats.ThresholdBytes)),
+			fmt.Sprintf("%.1f%%", float64(stats.Size)*100/math.Max(float64(stats.ThresholdBytes), 1)),
+			strconv.FormatUint(stats.Hits, 10),
+			strconv.FormatUint(stats.Misses, 10),
+			fmt.Sprintf("%.3f", stats.HitRatio()),
+		})
+		table.Render()
+		return nil
+	default:
+		return fmt.Errorf(
+			`unable to match a printer suitable for the output format "%s", allowed formats are: json`, outputFormat)
+	}
+}
+
+// cacheFileRef 缓存文件及引用它的服务文件
+type cacheFileRef struct {
+	cache.IndexEntry
+	Files []string `json:"files"`
+}
+
+// runCacheLs 列出缓存文件及引用它的服务文件
+func runCacheLs(v *viper.Viper) error {
+	c, err := openCache(v)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	refs, err := c.References(conf.TempDir)
+	if err != nil {
+		return fmt.Errorf("find app files referencing the cache files failed, err: %s", err.Error())
+	}
+	entries := c.Entries()
+	result := make([]cacheFileRef, 0, len(entries))
+	for _, e := range entries {
+		files := refs[e.Signature]
+		sort.Strings(files)
+		result = append(result, cacheFileRef{IndexEntry: e, Files: files})
+	}
+
+	switch outputFormat {
+	case outputFormatJson:
+		return jsonOutput(result)
+	case outputFormatTable:
+		table := newTable()
+		table.SetHeader([]string{"SHA256", "Size", "Hits", "LastAccess", "Files"})
+		for _, r := range result {
+			table.Append([]string{
+				r.Signature,
+				humanize.IBytes(uint64(r.Size)),
+				strconv.FormatUint(r.Hits, 10),
+				r.LastAccess.Local().Format(time.DateTime),
+				strings.Join(r.Files, "\n"),
+			})
+		}
+		table.Render()
+		return nil
+	default:
+		return fmt.Errorf(
+			`unable to match a printer suitable for the output format "%s", allowed formats are: json`, outputFormat)
+	}
+}
+
+// runCacheVerify 校验缓存文件并删除损坏的文件
+func runCacheVerify(v *viper.Viper) error {
+	c, err := openCache(v)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	total := c.Stats().Count
+	corrupted, err := c.Verify()
+	for _, sig := range corrupted {
+		fmt.Printf("removed corrupted cache file %s\n", c.FilePath(sig))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verified %d cache files, %d corrupted\n", total, len(corrupted))
+	return nil
+}
+
+// runCachePrune 按大小或最近访问时间清理缓存文件
+func runCachePrune(v *viper.Viper) error {
+	if pruneMaxSize == "" && pruneOlderThan <= 0 {
+		return fmt.Errorf("at least one of --max-size and --older-than is required")
+	}
+	maxSize := int64(-1)
+	if pruneMaxSize != "" {
+		size, err := humanize.ParseBytes(pruneMaxSize)
+		if err != nil {
+			return fmt.Errorf("invalid max size %s, err: %s", pruneMaxSize, err.Error())
+		}
+		maxSize = int64(size)
+	}
+
+	c, err := openCache(v)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	count, freed, err := c.Prune(maxSize, pruneOlderThan)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d cache files, freed %s\n", count, humanize.IBytes(uint64(freed)))
+	return nil
+}
+
+// runCacheWarm 下载服务最新版本中缓存缺失的文件
+func runCacheWarm() error {
+	if err := initConf(cacheWarmViper); err != nil {
+		return err
+	}
+	// warm 必须开启文件缓存
+	conf.FileCache.Enabled = true
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if warmConcurrency <= 0 {
+		return fmt.Errorf("concurrency should be greater than 0")
+	}
+
+	bscp, err := client.New(
+		client.WithFeedAddrs(conf.FeedAddrs),
+		client.WithBizID(conf.Biz),
+		client.WithToken(conf.Token),
+		client.WithLabels(conf.Labels),
+		client.WithUID(conf.UID),
+		client.WithFileCache(fileCache(conf.FileCache)),
+		client.WithBandwidthLimit(bandwidthLimit(conf.BandwidthLimit)),
+	)
+	if err != nil {
+		return err
+	}
+	defer bscp.Close()
+
+	for _, app := range conf.Apps {
+		release, err := bscp.PullFiles(app.Name, client.WithAppConfigMatch(app.ConfigMatches),
+			client.WithAppLabels(app.Labels), client.WithAppUID(app.UID))
+		if err != nil {
+			return fmt.Errorf("pull files of app %s failed, err: %s", app.Name, err.Error())
+		}
+		metas := make([]*sfs.ConfigItemMetaV1, 0, len(release.FileItems))
+		for _, f := range release.FileItems {
+			metas = append(metas, f.FileMeta)
+		}
+		warmed, err := cache.GetCache().Warm(metas, warmConcurrency)
+		if err != nil {
+			return fmt.Errorf("warm app %s failed, err: %s", app.Name, err.Error())
+		}
+		fmt.Printf("warmed app %s release %d, %d of %d files downloaded\n", app.Name, release.ReleaseID, warmed,
+			len(metas))
+	}
+	return nil
+}
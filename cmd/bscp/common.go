@@ -28,6 +28,7 @@ import (
 	"github.com/spf13/viper"
 	"golang.org/x/exp/slog"
 
+	"github.com/TencentBlueKing/bscp-go/client"
 	"github.com/TencentBlueKing/bscp-go/internal/config"
 	"github.com/TencentBlueKing/bscp-go/internal/constant"
 	"github.com/TencentBlueKing/bscp-go/pkg/env"
@@ -47,7 +48,18 @@ var (
 	getFileViper = viper.New()
 	getKvViper   = viper.New()
 
-	allVipers = []*viper.Viper{rootViper, pullViper, watchViper, getViper, getAppViper, getFileViper, getKvViper}
+	bundleExportViper = viper.New()
+	cacheStatsViper   = viper.New()
+	cacheLsViper      = viper.New()
+	cacheVerifyViper  = viper.New()
+	cachePruneViper   = viper.New()
+	cacheWarmViper    = viper.New()
+	rollbackViper     = viper.New()
+	statusViper       = viper.New()
+
+	allVipers = []*viper.Viper{rootViper, pullViper, watchViper, getViper, getAppViper, getFileViper, getKvViper,
+		bundleExportViper, cacheStatsViper, cacheLsViper, cacheVerifyViper, cachePruneViper, cacheWarmViper,
+		rollbackViper, statusViper}
 	getVipers = []*viper.Viper{getViper, getAppViper, getFileViper, getKvViper}
 )
 
@@ -226,6 +238,128 @@ func readLabelsFile(path string) (map[string]string, error) {
 	return fileLabels, nil
 }
 
+// bandwidthLimit 转换带宽限制配置为 client 选项
+func bandwidthLimit(c *config.BandwidthLimitConfig) client.BandwidthLimit {
+	l := client.BandwidthLimit{
+		BytesPerSecond:       c.BytesPerSecond,
+		BurstBytes:           c.BurstBytes,
+		WarmupBytesPerSecond: c.WarmupBytesPerSecond,
+	}
+	for _, s := range c.Schedules {
+		l.Schedules = append(l.Schedules, client.BandwidthSchedule{
+			Start:          s.Start,
+			End:            s.End,
+			BytesPerSecond: s.BytesPerSecond,
+		})
+	}
+	return l
+}
+
+// addBandwidthLimitFlags 添加带宽限制相关的命令行参数
+func addBandwidthLimitFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int64P("bandwidth-limit-bytes", "", 0, "download bandwidth limit in bytes per second, 0 means unlimited")
+	mustBindPFlag(v, "bandwidth_limit.bytes_per_second", flags.Lookup("bandwidth-limit-bytes"))
+	flags.Int64P("bandwidth-burst-bytes", "", 0,
+		"max bytes allowed to be downloaded at once, 0 means the same as the bandwidth limit")
+	mustBindPFlag(v, "bandwidth_limit.burst_bytes", flags.Lookup("bandwidth-burst-bytes"))
+	flags.Int64P("warmup-bandwidth-limit-bytes", "", 0,
+		"cache warm-up download bandwidth limit in bytes per second, 0 means unlimited")
+	mustBindPFlag(v, "bandwidth_limit.warmup_bytes_per_second", flags.Lookup("warmup-bandwidth-limit-bytes"))
+}
+
+// fileCache 转换文件缓存配置为 client 选项
+func fileCache(c *config.FileCacheConfig) client.FileCache {
+	return client.FileCache{
+		Enabled:                c.Enabled,
+		CacheDir:               c.CacheDir,
+		ThresholdGB:            c.ThresholdGB,
+		CleanupIntervalSeconds: c.CleanupIntervalSeconds,
+		RetentionRate:          c.RetentionRate,
+		EvictionPolicy:         c.EvictionPolicy,
+		Materialize:            c.Materialize,
+		PrefetchConcurrency:    c.PrefetchConcurrency,
+	}
+}
+
+// addFileCacheCleanupFlags 添加文件缓存清理相关的命令行参数
+func addFileCacheCleanupFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int64P("cache-cleanup-interval-seconds", "", constant.DefaultCleanupIntervalSeconds,
+		"bscp file cache cleanup interval seconds")
+	mustBindPFlag(v, "file_cache.cleanup_interval_seconds", flags.Lookup("cache-cleanup-interval-seconds"))
+	flags.Float64P("cache-retention-rate", "", constant.DefaultCacheRetentionRate,
+		"rate of the cache threshold retained after cleanup")
+	mustBindPFlag(v, "file_cache.retention_rate", flags.Lookup("cache-retention-rate"))
+	flags.StringP("cache-eviction-policy", "", constant.DefaultCacheEvictionPolicy,
+		"bscp file cache eviction policy, one of lru, lfu")
+	mustBindPFlag(v, "file_cache.eviction_policy", flags.Lookup("cache-eviction-policy"))
+	flags.StringP("cache-materialize", "", constant.DefaultCacheMaterialize,
+		"the way to materialize files from the file cache, one of copy, reflink, hardlink")
+	mustBindPFlag(v, "file_cache.materialize", flags.Lookup("cache-materialize"))
+}
+
+// rangeDownload 转换分片下载配置为 client 选项
+func rangeDownload(c *config.RangeDownloadConfig) client.RangeDownload {
+	return client.RangeDownload{
+		MaxPartBytes:   c.MaxPartBytes,
+		MaxConcurrency: c.MaxConcurrency,
+		WaitTimeMil:    c.WaitTimeMs,
+	}
+}
+
+// addRangeDownloadFlags 添加分片下载相关的命令行参数
+func addRangeDownloadFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Uint64P("range-max-part-bytes", "", 0, "max size of a range download part, 0 means the default value")
+	mustBindPFlag(v, "range_download.max_part_bytes", flags.Lookup("range-max-part-bytes"))
+	flags.Int64P("range-max-concurrency", "", 0,
+		"max concurrent range download parts, 0 means the max http download goroutines")
+	mustBindPFlag(v, "range_download.max_concurrency", flags.Lookup("range-max-concurrency"))
+	flags.Int64P("download-wait-time-ms", "", 0,
+		"delay in milliseconds before downloading, 0 means use the server suggested one, negative means no delay")
+	mustBindPFlag(v, "range_download.wait_time_ms", flags.Lookup("download-wait-time-ms"))
+}
+
+// asyncDownload 转换 p2p 下载配置为 client 选项
+func asyncDownload(c *config.P2PDownloadConfig) client.AsyncDownload {
+	return client.AsyncDownload{
+		MinFileBytes:    c.MinFileBytes,
+		Timeout:         time.Duration(c.TimeoutSeconds) * time.Second,
+		PollInterval:    time.Duration(c.PollIntervalSeconds) * time.Second,
+		MaxPollInterval: time.Duration(c.MaxPollIntervalSeconds) * time.Second,
+	}
+}
+
+// hookTimeout 转换前后置脚本超时配置为 client 选项
+func hookTimeout(c *config.HookTimeoutConfig) client.HookTimeout {
+	return client.HookTimeout{
+		PreHook:  c.PreHook(),
+		PostHook: c.PostHook(),
+	}
+}
+
+// addHookTimeoutFlags 添加前后置脚本超时相关的命令行参数
+func addHookTimeoutFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int64P("pre-hook-timeout-seconds", "", 0,
+		"timeout seconds of the pre hook, 0 means 600, negative means no timeout")
+	mustBindPFlag(v, "hook_timeout.pre_hook_seconds", flags.Lookup("pre-hook-timeout-seconds"))
+	flags.Int64P("post-hook-timeout-seconds", "", 0,
+		"timeout seconds of the post hook, 0 means 600, negative means no timeout")
+	mustBindPFlag(v, "hook_timeout.post_hook_seconds", flags.Lookup("post-hook-timeout-seconds"))
+}
+
+// addP2PDownloadFlags 添加 p2p 下载相关的命令行参数
+func addP2PDownloadFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Uint64P("p2p-min-file-bytes", "", 0, "min size of the file downloaded via p2p, 0 means 2MB")
+	mustBindPFlag(v, "p2p_download.min_file_bytes", flags.Lookup("p2p-min-file-bytes"))
+	flags.Int64P("p2p-timeout-seconds", "", 0, "max seconds waiting for a p2p download task, 0 means 600")
+	mustBindPFlag(v, "p2p_download.timeout_seconds", flags.Lookup("p2p-timeout-seconds"))
+	flags.Int64P("p2p-poll-interval-seconds", "", 0,
+		"initial interval seconds of polling the p2p download task status, 0 means 5")
+	mustBindPFlag(v, "p2p_download.poll_interval_seconds", flags.Lookup("p2p-poll-interval-seconds"))
+	flags.Int64P("p2p-max-poll-interval-seconds", "", 0,
+		"max interval seconds of polling the p2p download task status, 0 means 30")
+	mustBindPFlag(v, "p2p_download.max_poll_interval_seconds", flags.Lookup("p2p-max-poll-interval-seconds"))
+}
+
 // newTable 统一风格表格, 风格参考 kubectl
 func newTable() *tablewriter.Table {
 	table := tablewriter.NewWriter(os.Stdout)
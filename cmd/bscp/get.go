@@ -126,6 +126,7 @@ func init() {
 	getFileCmd.Flags().Float64P("cache-threshold-gb", "", constant.DefaultCacheThresholdGB,
 		"bscp file cache threshold gigabyte")
 	mustBindPFlag(getFileViper, "file_cache.threshold_gb", getFileCmd.Flags().Lookup("cache-threshold-gb"))
+	addFileCacheCleanupFlags(getFileCmd.Flags(), getFileViper)
 	getFileCmd.Flags().StringVarP(&outputFormat, "output", "o", "", "output format, One of: json|content")
 	getFileCmd.Flags().StringVarP(&downloadDir, "download-dir", "d", "",
 		"the directory for saving the downloaded content")
@@ -361,6 +362,7 @@ func runDownloadFile(bscp client.Client, app string, match []string) error {
 	}
 
 	// save content to dst file
+	stopProgress := trackProgress(release, app)
 	g, _ := errgroup.WithContext(context.Background())
 	g.SetLimit(10)
 	for i, f := range release.FileItems {
@@ -375,7 +377,9 @@ func runDownloadFile(bscp client.Client, app string, match []string) error {
 			return file.SaveToFile(dstFiles[idx])
 		})
 	}
-	if err := g.Wait(); err != nil {
+	err = g.Wait()
+	stopProgress()
+	if err != nil {
 		return err
 	}
 
@@ -402,11 +406,7 @@ func runGetFile(args []string) error {
 		client.WithFeedAddrs(conf.FeedAddrs),
 		client.WithBizID(conf.Biz),
 		client.WithToken(conf.Token),
-		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
-		}),
+		client.WithFileCache(fileCache(conf.FileCache)),
 	)
 
 	if err != nil {
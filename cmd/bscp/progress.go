@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+)
+
+// progressRenderInterval 进度刷新间隔
+const progressRenderInterval = 200 * time.Millisecond
+
+// isTerminal 判断文件是否为终端
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressPrinter 在终端单行实时输出下载进度
+type progressPrinter struct {
+	lock    sync.Mutex
+	prefix  string
+	last    time.Time
+	printed bool
+}
+
+// trackProgress 标准错误输出为终端时，实时输出版本的下载进度，返回停止输出的函数
+func trackProgress(release *client.Release, prefix string) (stop func()) {
+	if !isTerminal(os.Stderr) {
+		return func() {}
+	}
+
+	p := &progressPrinter{prefix: prefix}
+	remove := release.TrackProgress(p.render)
+	return func() {
+		remove()
+		p.finish()
+	}
+}
+
+// render 输出进度，按刷新间隔限流，全部完成时强制输出
+func (p *progressPrinter) render(rp client.ReleaseProgress) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	if rp.DoneFiles < rp.TotalFiles && now.Sub(p.last) < progressRenderInterval {
+		return
+	}
+	p.last = now
+	p.printed = true
+
+	line := fmt.Sprintf("%s files %d/%d  %s/%s", p.prefix, rp.DoneFiles, rp.TotalFiles,
+		humanize.IBytes(rp.DoneBytes), humanize.IBytes(rp.TotalBytes))
+	if rp.BytesPerSecond > 0 {
+		line += fmt.Sprintf("  %s/s", humanize.IBytes(uint64(rp.BytesPerSecond)))
+	}
+	if rp.ETA > 0 {
+		line += fmt.Sprintf("  ETA %s", rp.ETA.Round(time.Second))
+	}
+	if !rp.File.Done {
+		line += fmt.Sprintf("  %s", rp.File.File)
+		if len(rp.File.ActiveParts) > 0 {
+			line += fmt.Sprintf(" (%d parts)", len(rp.File.ActiveParts))
+		}
+	}
+	// 回到行首并清除当前行
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+}
+
+// finish 结束输出，换行
+func (p *progressPrinter) finish() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.printed {
+		fmt.Fprintln(os.Stderr)
+	}
+}
@@ -77,12 +77,14 @@ func Pull(cmd *cobra.Command, args []string) {
 		client.WithClusterID(conf.ClusterID),
 		client.WithPodID(conf.PodID),
 		client.WithContainerName(conf.ContainerName),
-		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
-		}),
+		client.WithFileCache(fileCache(conf.FileCache)),
 		client.WithTextLineBreak(conf.TextLineBreak),
+		client.WithEventRetention(conf.EventRetention),
+		client.WithReleaseHistory(conf.ReleaseHistory),
+		client.WithHookTimeout(hookTimeout(conf.HookTimeout)),
+		client.WithBandwidthLimit(bandwidthLimit(conf.BandwidthLimit)),
+		client.WithRangeDownload(rangeDownload(conf.RangeDownload)),
+		client.WithAsyncDownload(asyncDownload(conf.P2PDownload)),
 	)
 	if err != nil {
 		logger.Error("init client", logger.ErrAttr(err))
@@ -139,6 +141,8 @@ func pullAppFiles(ctx context.Context, bscp client.Client, tempDir string, biz u
 	// 生成事件ID
 	release.CursorID = util.GenerateCursorID(biz)
 	release.SemaphoreCh = make(chan struct{})
+	stopProgress := trackProgress(release, app)
+	defer stopProgress()
 	go func() {
 		for {
 			select {
@@ -202,10 +206,21 @@ func init() {
 	PullCmd.Flags().Float64P("cache-threshold-gb", "", constant.DefaultCacheThresholdGB,
 		"bscp file cache threshold gigabyte")
 	mustBindPFlag(pullViper, "file_cache.threshold_gb", PullCmd.Flags().Lookup("cache-threshold-gb"))
+	addFileCacheCleanupFlags(PullCmd.Flags(), pullViper)
 	PullCmd.Flags().BoolP("enable-resource", "e", true, "enable report resource usage")
 	mustBindPFlag(pullViper, "enable_resource", PullCmd.Flags().Lookup("enable-resource"))
 	PullCmd.Flags().StringP("text-line-break", "", "", "text file line break, default as LF")
 	mustBindPFlag(pullViper, "text_line_break", PullCmd.Flags().Lookup("text-line-break"))
+	PullCmd.Flags().IntP("event-retention", "", constant.DefaultEventRetention,
+		"count of the events retained in metadata.json and changeevent.json")
+	mustBindPFlag(pullViper, "event_retention", PullCmd.Flags().Lookup("event-retention"))
+	PullCmd.Flags().IntP("release-history", "", constant.DefaultReleaseHistory,
+		"count of the release snapshots kept for rollback, negative means disabled")
+	mustBindPFlag(pullViper, "release_history", PullCmd.Flags().Lookup("release-history"))
+	addBandwidthLimitFlags(PullCmd.Flags(), pullViper)
+	addHookTimeoutFlags(PullCmd.Flags(), pullViper)
+	addRangeDownloadFlags(PullCmd.Flags(), pullViper)
+	addP2PDownloadFlags(PullCmd.Flags(), pullViper)
 
 	for key, envName := range commonEnvs {
 		// bind env variable with viper
@@ -0,0 +1,115 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+)
+
+var rollbackTo uint32
+
+var (
+	// RollbackCmd command to rollback the app to a release in the local history
+	RollbackCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "Rollback the app files to a release applied before",
+		Long: `Restore the app files in temp-dir to a release in the local history, the previous release is chosen
+if --to is not set, then execute the post hook and update the metadata`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRollback()
+		},
+	}
+)
+
+func init() {
+	RollbackCmd.Flags().SortFlags = false
+	RollbackCmd.Flags().StringP("feed-addrs", "f", "", "feed server address, eg: 'bscp-feed.example.com:9510'")
+	mustBindPFlag(rollbackViper, "feed_addrs", RollbackCmd.Flags().Lookup("feed-addrs"))
+	RollbackCmd.Flags().IntP("biz", "b", 0, "biz id")
+	mustBindPFlag(rollbackViper, "biz", RollbackCmd.Flags().Lookup("biz"))
+	RollbackCmd.Flags().StringP("app", "a", "", "app name")
+	mustBindPFlag(rollbackViper, "app", RollbackCmd.Flags().Lookup("app"))
+	RollbackCmd.Flags().StringP("token", "t", "", "sdk token")
+	mustBindPFlag(rollbackViper, "token", RollbackCmd.Flags().Lookup("token"))
+	RollbackCmd.Flags().StringP("labels", "l", "", "labels")
+	mustBindPFlag(rollbackViper, "labels_str", RollbackCmd.Flags().Lookup("labels"))
+	RollbackCmd.Flags().StringP("labels-file", "", "", "labels file path")
+	mustBindPFlag(rollbackViper, "labels_file", RollbackCmd.Flags().Lookup("labels-file"))
+	RollbackCmd.Flags().StringP("temp-dir", "d", constant.DefaultTempDir, "bscp temp dir")
+	mustBindPFlag(rollbackViper, "temp_dir", RollbackCmd.Flags().Lookup("temp-dir"))
+	RollbackCmd.Flags().Uint32VarP(&rollbackTo, "to", "", 0, "release id to rollback to, default as the previous one")
+	RollbackCmd.Flags().BoolP("file-cache-enabled", "", constant.DefaultFileCacheEnabled, "enable file cache or not")
+	mustBindPFlag(rollbackViper, "file_cache.enabled", RollbackCmd.Flags().Lookup("file-cache-enabled"))
+	RollbackCmd.Flags().StringP("file-cache-dir", "", constant.DefaultFileCacheDir, "bscp file cache dir")
+	mustBindPFlag(rollbackViper, "file_cache.cache_dir", RollbackCmd.Flags().Lookup("file-cache-dir"))
+	RollbackCmd.Flags().Float64P("cache-threshold-gb", "", constant.DefaultCacheThresholdGB,
+		"bscp file cache threshold gigabyte")
+	mustBindPFlag(rollbackViper, "file_cache.threshold_gb", RollbackCmd.Flags().Lookup("cache-threshold-gb"))
+	RollbackCmd.Flags().IntP("release-history", "", constant.DefaultReleaseHistory,
+		"count of the release snapshots kept for rollback, negative means disabled")
+	mustBindPFlag(rollbackViper, "release_history", RollbackCmd.Flags().Lookup("release-history"))
+	addBandwidthLimitFlags(RollbackCmd.Flags(), rollbackViper)
+	addHookTimeoutFlags(RollbackCmd.Flags(), rollbackViper)
+	for key, envName := range commonEnvs {
+		if err := rollbackViper.BindEnv(key, envName); err != nil {
+			panic(err)
+		}
+		if f := RollbackCmd.Flags().Lookup(strings.ReplaceAll(key, "_", "-")); f != nil {
+			f.Usage = fmt.Sprintf("%v [env %v]", f.Usage, envName)
+		}
+	}
+}
+
+// runRollback 回滚服务到本地历史中的版本
+func runRollback() error {
+	if err := initConf(rollbackViper); err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if len(conf.Apps) != 1 {
+		return fmt.Errorf("rollback only supports one app, but got %d", len(conf.Apps))
+	}
+
+	bscp, err := client.New(
+		client.WithFeedAddrs(conf.FeedAddrs),
+		client.WithBizID(conf.Biz),
+		client.WithToken(conf.Token),
+		client.WithLabels(conf.Labels),
+		client.WithUID(conf.UID),
+		client.WithFileCache(fileCache(conf.FileCache)),
+		client.WithTextLineBreak(conf.TextLineBreak),
+		client.WithReleaseHistory(conf.ReleaseHistory),
+		client.WithHookTimeout(hookTimeout(conf.HookTimeout)),
+		client.WithBandwidthLimit(bandwidthLimit(conf.BandwidthLimit)),
+	)
+	if err != nil {
+		return err
+	}
+	defer bscp.Close()
+
+	app := conf.Apps[0].Name
+	release, err := bscp.Rollback(app, conf.TempDir, rollbackTo)
+	if err != nil {
+		return fmt.Errorf("rollback app %s failed, err: %s", app, err.Error())
+	}
+	fmt.Printf("rollback app %s to release %d(%s) success\n", app, release.ReleaseID, release.ReleaseName)
+	return nil
+}
@@ -54,8 +54,23 @@ func init() {
 	getCmd.AddCommand(getKvCmd)
 	rootCmd.AddCommand(getCmd)
 
+	bundleCmd.AddCommand(bundleKeygenCmd)
+	bundleCmd.AddCommand(bundleExportCmd)
+	bundleCmd.AddCommand(bundleImportCmd)
+	bundleCmd.AddCommand(bundleApplyCmd)
+	rootCmd.AddCommand(bundleCmd)
+
+	cacheCmd.AddCommand(cacheStatsCmd)
+	cacheCmd.AddCommand(cacheLsCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cacheCmd.AddCommand(cacheWarmCmd)
+	rootCmd.AddCommand(cacheCmd)
+
 	rootCmd.AddCommand(PullCmd)
 	rootCmd.AddCommand(WatchCmd)
+	rootCmd.AddCommand(RollbackCmd)
+	rootCmd.AddCommand(StatusCmd)
 	rootCmd.AddCommand(VersionCmd)
 	rootCmd.PersistentFlags().StringP(
 		"log-level", "", "", "log filtering level, One of: debug|info|warn|error. (default info)")
@@ -0,0 +1,321 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TencentBlueKing/bk-bscp/pkg/tools"
+	"github.com/spf13/cobra"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+// watchStatusTimeout is the timeout of querying the live state from the local watch process
+const watchStatusTimeout = 2 * time.Second
+
+var (
+	// StatusCmd command to show the local apply state of the apps
+	StatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the local apply state of the apps",
+		Long: `Show the current release, the last change event, the files drift and the file cache state of the apps
+in temp-dir, and the live connection state from the local watch process if it is running`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runStatus()
+		},
+	}
+)
+
+// bscpStatus 本地服务状态
+type bscpStatus struct {
+	// Watch is the live state of the local watch process, nil if it is not running
+	Watch *client.WatchStatus `json:"watch"`
+	Apps  []*appStatus        `json:"apps"`
+}
+
+// appStatus 服务本地变更状态
+type appStatus struct {
+	App           string   `json:"app"`
+	ReleaseID     uint32   `json:"release_id"`
+	EventTime     string   `json:"event_time"`
+	Status        string   `json:"status"`
+	FailedReason  string   `json:"failed_reason"`
+	Message       string   `json:"message"`
+	ConfigMatches []string `json:"config_matches"`
+	FileNum       int      `json:"file_num"`
+	// CachedFileNum is the count of the files of the release in the file cache, nil if the cache is not found
+	CachedFileNum *int `json:"cached_file_num"`
+	// Drift is the difference between the files dir and the release, nil if the release snapshot is not found
+	Drift *fileDrift             `json:"drift"`
+	Watch *client.AppWatchStatus `json:"watch"`
+}
+
+// fileDrift 服务目录下的文件与版本的差异
+type fileDrift struct {
+	Modified []string `json:"modified"`
+	Missing  []string `json:"missing"`
+	Extra    []string `json:"extra"`
+}
+
+// count returns the count of the drifted files
+func (d *fileDrift) count() int {
+	return len(d.Modified) + len(d.Missing) + len(d.Extra)
+}
+
+func init() {
+	StatusCmd.Flags().SortFlags = false
+	StatusCmd.Flags().IntP("biz", "b", 0, "biz id")
+	mustBindPFlag(statusViper, "biz", StatusCmd.Flags().Lookup("biz"))
+	StatusCmd.Flags().StringP("app", "a", "", "app name, multiple apps are separated by commas")
+	mustBindPFlag(statusViper, "app", StatusCmd.Flags().Lookup("app"))
+	StatusCmd.Flags().StringP("temp-dir", "d", constant.DefaultTempDir, "bscp temp dir")
+	mustBindPFlag(statusViper, "temp_dir", StatusCmd.Flags().Lookup("temp-dir"))
+	StatusCmd.Flags().StringP("file-cache-dir", "", constant.DefaultFileCacheDir, "bscp file cache dir")
+	mustBindPFlag(statusViper, "file_cache.cache_dir", StatusCmd.Flags().Lookup("file-cache-dir"))
+	StatusCmd.Flags().IntP("port", "p", constant.DefaultHttpPort, "http port of the local watch process")
+	mustBindPFlag(statusViper, "port", StatusCmd.Flags().Lookup("port"))
+	StatusCmd.Flags().StringVarP(&outputFormat, "output", "o", "", "output format, One of: json")
+	for key, envName := range commonEnvs {
+		if err := statusViper.BindEnv(key, envName); err != nil {
+			panic(err)
+		}
+		if f := StatusCmd.Flags().Lookup(strings.ReplaceAll(key, "_", "-")); f != nil {
+			f.Usage = fmt.Sprintf("%v [env %v]", f.Usage, envName)
+		}
+	}
+}
+
+// runStatus 展示服务本地变更状态
+func runStatus() error {
+	if err := initConf(statusViper); err != nil {
+		return err
+	}
+	if conf.Biz == 0 {
+		return fmt.Errorf("biz should not be 0")
+	}
+	if len(conf.Apps) == 0 {
+		return fmt.Errorf("at least one app should be set")
+	}
+
+	result := &bscpStatus{Watch: queryWatchStatus(conf.Port)}
+	// the cache dir is only read, opening the cache would create its lock and work dirs and rewrite its index
+	var fileCacheDir string
+	if _, err := os.Stat(conf.FileCache.CacheDir); err == nil {
+		fileCacheDir = conf.FileCache.CacheDir
+	}
+	for _, app := range conf.Apps {
+		s, err := loadAppStatus(app.Name, fileCacheDir)
+		if err != nil {
+			return fmt.Errorf("load the status of app %s failed, err: %s", app.Name, err.Error())
+		}
+		if result.Watch != nil {
+			for _, w := range result.Watch.Apps {
+				if w.App == app.Name {
+					s.Watch = w
+				}
+			}
+		}
+		result.Apps = append(result.Apps, s)
+	}
+
+	switch outputFormat {
+	case outputFormatJson:
+		return jsonOutput(result)
+	case outputFormatTable:
+		printStatusTable(result)
+		return nil
+	default:
+		return fmt.Errorf(
+			`unable to match a printer suitable for the output format "%s", allowed formats are: json`, outputFormat)
+	}
+}
+
+// queryWatchStatus 从本地 watch 进程获取实时状态，未运行时返回 nil
+func queryWatchStatus(port int) *client.WatchStatus {
+	c := &http.Client{Timeout: watchStatusTimeout}
+	resp, err := c.Get(fmt.Sprintf("http://127.0.0.1:%d/status", port))
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	st := new(client.WatchStatus)
+	if err := json.NewDecoder(resp.Body).Decode(st); err != nil {
+		return nil
+	}
+	return st
+}
+
+// loadAppStatus 读取服务目录下的 metadata.json、changeevent.json 和版本快照，fileCacheDir 为空时不统计缓存命中
+func loadAppStatus(app string, fileCacheDir string) (*appStatus, error) {
+	appDir := filepath.Join(conf.TempDir, strconv.Itoa(int(conf.Biz)), app)
+	s := &appStatus{App: app}
+
+	meta, exists, err := eventmeta.GetLatestMetadataFromFile(appDir)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		s.ReleaseID = meta.ReleaseID
+		s.ConfigMatches = meta.ConfigMatches
+	}
+	event, err := eventmeta.GetLatestChangeEventFromFile(appDir)
+	if err != nil {
+		return nil, err
+	}
+	if event != nil {
+		s.EventTime = event.EventTime
+		s.Status = string(event.Status)
+		s.FailedReason = event.FailedReason
+		s.Message = event.Message
+	}
+
+	filesDir := filepath.Join(appDir, "files")
+	local, err := listLocalFiles(filesDir)
+	if err != nil {
+		return nil, err
+	}
+	s.FileNum = len(local)
+
+	snapshots, err := client.ListReleaseHistory(appDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if !exists || snapshot.ReleaseID != s.ReleaseID {
+			continue
+		}
+		s.FileNum = len(snapshot.Files)
+		if s.Drift, err = diffFiles(filesDir, local, snapshot); err != nil {
+			return nil, err
+		}
+		if fileCacheDir != "" {
+			cached := 0
+			for _, f := range snapshot.Files {
+				// the cache files are named by the signatures of the contents
+				if _, err = os.Stat(filepath.Join(fileCacheDir, f.ContentSpec.Signature)); err == nil {
+					cached++
+				}
+			}
+			s.CachedFileNum = &cached
+		}
+		break
+	}
+	return s, nil
+}
+
+// listLocalFiles 列出服务文件目录下的文件，返回相对路径
+func listLocalFiles(filesDir string) (map[string]bool, error) {
+	files := make(map[string]bool)
+	err := filepath.Walk(filesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(filesDir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list the files of %s failed, err: %s", filesDir, err.Error())
+	}
+	return files, nil
+}
+
+// diffFiles 对比服务文件目录下的文件与版本快照中的文件
+func diffFiles(filesDir string, local map[string]bool, snapshot *client.ReleaseSnapshot) (*fileDrift, error) {
+	drift := &fileDrift{Modified: []string{}, Missing: []string{}, Extra: []string{}}
+	expected := make(map[string]bool, len(snapshot.Files))
+	for _, f := range snapshot.Files {
+		rel := filepath.Join(f.ConfigItemSpec.Path, f.ConfigItemSpec.Name)
+		rel = strings.TrimPrefix(rel, string(filepath.Separator))
+		expected[rel] = true
+		if !local[rel] {
+			drift.Missing = append(drift.Missing, rel)
+			continue
+		}
+		sha, err := tools.FileSHA256(filepath.Join(filesDir, rel))
+		if err != nil {
+			return nil, fmt.Errorf("check the SHA256 of %s failed, err: %s", rel, err.Error())
+		}
+		if sha != f.ContentSpec.Signature {
+			drift.Modified = append(drift.Modified, rel)
+		}
+	}
+	for rel := range local {
+		if !expected[rel] {
+			drift.Extra = append(drift.Extra, rel)
+		}
+	}
+	return drift, nil
+}
+
+// printStatusTable 以表格展示服务本地变更状态
+func printStatusTable(result *bscpStatus) {
+	if result.Watch == nil {
+		fmt.Println("Watch: not running")
+	} else {
+		fmt.Printf("Watch: watching=%t, upstream=%s, state=%s\n\n", result.Watch.Watching, result.Watch.Upstream,
+			result.Watch.ConnState)
+	}
+
+	table := newTable()
+	table.SetHeader([]string{"App", "Release", "EventTime", "Status", "FailedReason", "ConfigMatches", "Files",
+		"Cached", "Drift", "Watch"})
+	for _, s := range result.Apps {
+		cached, drift, watch := "-", "-", "-"
+		if s.CachedFileNum != nil {
+			cached = strconv.Itoa(*s.CachedFileNum)
+		}
+		if s.Drift != nil {
+			drift = strconv.Itoa(s.Drift.count())
+		}
+		if s.Watch != nil {
+			watch = fmt.Sprintf("%d->%d %s", s.Watch.CurrentReleaseID, s.Watch.TargetReleaseID,
+				s.Watch.ChangeStatus)
+		}
+		table.Append([]string{
+			s.App,
+			strconv.FormatUint(uint64(s.ReleaseID), 10),
+			refineOutputTime(s.EventTime),
+			s.Status,
+			s.FailedReason,
+			strings.Join(s.ConfigMatches, ","),
+			strconv.Itoa(s.FileNum),
+			cached,
+			drift,
+			watch,
+		})
+	}
+	table.Render()
+}
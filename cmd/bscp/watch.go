@@ -14,6 +14,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof" // nolint
@@ -31,6 +32,7 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/config"
 	"github.com/TencentBlueKing/bscp-go/internal/constant"
 	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
@@ -45,6 +47,9 @@ var (
 		Long:  `watch release then pull file, exec hooks`,
 		Run:   Watch,
 	}
+
+	// bandwidthLimitLock 保护运行时调整的带宽限制配置，由 sidecar 端口和管理端口的处理函数共享
+	bandwidthLimitLock sync.Mutex
 )
 
 // Watch run as a daemon to watch the config changes.
@@ -139,7 +144,7 @@ func Watch(cmd *cobra.Command, args []string) {
 		}
 	}()
 
-	serveHttp()
+	serveHttp(bscp)
 }
 
 func newWatchClient(labels map[string]string) (client.Client, error) {
@@ -154,30 +159,103 @@ func newWatchClient(labels map[string]string) (client.Client, error) {
 		client.WithClusterID(conf.ClusterID),
 		client.WithPodID(conf.PodID),
 		client.WithContainerName(conf.ContainerName),
-		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
-		}),
+		client.WithFileCache(fileCache(conf.FileCache)),
 		client.WithKvCache(client.KvCache{
-			Enabled:     conf.KvCache.Enabled,
-			ThresholdMB: conf.KvCache.ThresholdMB,
+			Enabled:         conf.KvCache.Enabled,
+			ThresholdMB:     conf.KvCache.ThresholdMB,
+			DiskEnabled:     conf.KvCache.DiskEnabled,
+			DiskDir:         conf.KvCache.DiskDir,
+			DiskThresholdMB: conf.KvCache.DiskThresholdMB,
+			EncryptionKey:   conf.KvCache.EncryptionKey,
+			MaxStaleness:    time.Duration(conf.KvCache.MaxStalenessSeconds) * time.Second,
 		}),
 		client.WithEnableMonitorResourceUsage(conf.EnableMonitorResourceUsage),
 		client.WithTextLineBreak(conf.TextLineBreak),
+		client.WithEventRetention(conf.EventRetention),
+		client.WithReleaseHistory(conf.ReleaseHistory),
+		client.WithHookTimeout(hookTimeout(conf.HookTimeout)),
+		client.WithBounce(client.Bounce{
+			Enabled:  conf.Bounce.Enabled,
+			Interval: time.Duration(conf.Bounce.IntervalSeconds) * time.Second,
+			Jitter:   time.Duration(conf.Bounce.JitterSeconds) * time.Second,
+		}),
+		client.WithBandwidthLimit(bandwidthLimit(conf.BandwidthLimit)),
+		client.WithRangeDownload(rangeDownload(conf.RangeDownload)),
+		client.WithAsyncDownload(asyncDownload(conf.P2PDownload)),
 	)
 }
 
-func serveHttp() {
+func serveHttp(bscp client.Client) {
 	// register metrics
 	metrics.RegisterMetrics()
 	http.Handle("/metrics", promhttp.Handler())
+	// the sidecar port is listened on all interfaces without authentication, so that it is read only
+	http.Handle("/bandwidth-limit", bandwidthLimitHandler(bscp, false))
+	http.Handle("/status", watchStatusHandler(bscp))
+	if conf.AdminPort > 0 {
+		go serveAdminHttp(bscp)
+	}
 	if e := http.ListenAndServe(fmt.Sprintf(":%d", conf.Port), nil); e != nil {
 		logger.Error("start http server failed", logger.ErrAttr(e))
 		os.Exit(1)
 	}
 }
 
+// serveAdminHttp 在 127.0.0.1 上监听管理端口，提供运行时调整配置的接口
+func serveAdminHttp(bscp client.Client) {
+	mux := http.NewServeMux()
+	mux.Handle("/bandwidth-limit", bandwidthLimitHandler(bscp, true))
+	if e := http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", conf.AdminPort), mux); e != nil {
+		logger.Error("start admin http server failed", logger.ErrAttr(e))
+		os.Exit(1)
+	}
+}
+
+// bandwidthLimitHandler 查询(GET)下载带宽限制，writable 时支持运行时调整(PUT)
+func bandwidthLimitHandler(bscp client.Client, writable bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bandwidthLimitLock.Lock()
+		defer bandwidthLimitLock.Unlock()
+
+		switch {
+		case r.Method == http.MethodGet:
+		case r.Method == http.MethodPut && writable:
+			limit := new(config.BandwidthLimitConfig)
+			if err := json.NewDecoder(r.Body).Decode(limit); err != nil {
+				http.Error(w, fmt.Sprintf("decode bandwidth limit failed, err: %s", err.Error()), http.StatusBadRequest)
+				return
+			}
+			if err := limit.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := bscp.SetBandwidthLimit(bandwidthLimit(limit)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			conf.BandwidthLimit = limit
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(conf.BandwidthLimit)
+	}
+}
+
+// watchStatusHandler 查询(GET) watch 的连接及服务变更状态
+func watchStatusHandler(bscp client.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(bscp.WatchStatus())
+	}
+}
+
 // WatchHandler watch handler
 type WatchHandler struct {
 	// Biz BSCP biz id
@@ -279,6 +357,9 @@ func init() {
 	mustBindPFlag(watchViper, "temp_dir", WatchCmd.Flags().Lookup("temp-dir"))
 	WatchCmd.Flags().IntP("port", "p", constant.DefaultHttpPort, "sidecar http port")
 	mustBindPFlag(watchViper, "port", WatchCmd.Flags().Lookup("port"))
+	WatchCmd.Flags().IntP("admin-port", "", 0,
+		"http port listened on 127.0.0.1 to adjust the runtime config, 0 means disabled")
+	mustBindPFlag(watchViper, "admin_port", WatchCmd.Flags().Lookup("admin-port"))
 	WatchCmd.Flags().BoolP("enable-p2p-download", "", false, "enable p2p download or not")
 	mustBindPFlag(watchViper, "enable-p2p-download", WatchCmd.Flags().Lookup("enable-p2p-download"))
 	WatchCmd.Flags().StringP("bk-agent-id", "", "", "gse agent id")
@@ -296,15 +377,53 @@ func init() {
 	WatchCmd.Flags().Float64P("cache-threshold-gb", "", constant.DefaultCacheThresholdGB,
 		"bscp file cache threshold gigabyte")
 	mustBindPFlag(watchViper, "file_cache.threshold_gb", WatchCmd.Flags().Lookup("cache-threshold-gb"))
+	addFileCacheCleanupFlags(WatchCmd.Flags(), watchViper)
+	WatchCmd.Flags().IntP("cache-prefetch-concurrency", "", 0,
+		"max concurrent downloads prefetching the published releases to the file cache, 0 means disabled")
+	mustBindPFlag(watchViper, "file_cache.prefetch_concurrency", WatchCmd.Flags().Lookup("cache-prefetch-concurrency"))
 	WatchCmd.Flags().BoolP("kv-cache-enabled", "", constant.DefaultKvCacheEnabled, "enable kv cache or not")
 	mustBindPFlag(watchViper, "kv_cache.enabled", WatchCmd.Flags().Lookup("kv-cache-enabled"))
 	WatchCmd.Flags().Float64P("kv-cache-threshold-mb", "", constant.DefaultKvCacheThresholdMB,
 		"bscp kv cache threshold megabyte in memory")
 	mustBindPFlag(watchViper, "kv_cache.threshold_mb", WatchCmd.Flags().Lookup("kv-cache-threshold-mb"))
+	WatchCmd.Flags().BoolP("kv-disk-cache-enabled", "", false, "enable on-disk kv cache or not")
+	mustBindPFlag(watchViper, "kv_cache.disk_enabled", WatchCmd.Flags().Lookup("kv-disk-cache-enabled"))
+	WatchCmd.Flags().StringP("kv-disk-cache-dir", "", constant.DefaultKvDiskCacheDir, "bscp on-disk kv cache dir")
+	mustBindPFlag(watchViper, "kv_cache.disk_dir", WatchCmd.Flags().Lookup("kv-disk-cache-dir"))
+	WatchCmd.Flags().Float64P("kv-disk-cache-threshold-mb", "", constant.DefaultKvDiskCacheThresholdMB,
+		"bscp on-disk kv cache threshold megabyte")
+	mustBindPFlag(watchViper, "kv_cache.disk_threshold_mb", WatchCmd.Flags().Lookup("kv-disk-cache-threshold-mb"))
+	WatchCmd.Flags().StringP("kv-cache-encryption-key-file", "", "",
+		"file of the hex encoded 32 bytes key to encrypt the secret kvs on disk, secret kvs are not stored without it")
+	mustBindPFlag(watchViper, "kv_cache.encryption_key_file",
+		WatchCmd.Flags().Lookup("kv-cache-encryption-key-file"))
+	WatchCmd.Flags().Int64P("kv-cache-max-staleness-seconds", "", 0,
+		"max seconds since the cached kv was verified when feed server is unavailable, 0 means unlimited")
+	mustBindPFlag(watchViper, "kv_cache.max_staleness_seconds",
+		WatchCmd.Flags().Lookup("kv-cache-max-staleness-seconds"))
 	WatchCmd.Flags().BoolP("enable-resource", "e", true, "enable report resource usage")
 	mustBindPFlag(watchViper, "enable_resource", WatchCmd.Flags().Lookup("enable-resource"))
 	WatchCmd.Flags().StringP("text-line-break", "", "", "text line break, default as LF")
 	mustBindPFlag(watchViper, "text_line_break", WatchCmd.Flags().Lookup("text-line-break"))
+	WatchCmd.Flags().IntP("event-retention", "", constant.DefaultEventRetention,
+		"count of the events retained in metadata.json and changeevent.json")
+	mustBindPFlag(watchViper, "event_retention", WatchCmd.Flags().Lookup("event-retention"))
+	WatchCmd.Flags().IntP("release-history", "", constant.DefaultReleaseHistory,
+		"count of the release snapshots kept for rollback, negative means disabled")
+	mustBindPFlag(watchViper, "release_history", WatchCmd.Flags().Lookup("release-history"))
+	WatchCmd.Flags().BoolP("bounce-enabled", "", constant.DefaultBounceEnabled,
+		"enable periodic reconnecting to another feed server or not")
+	mustBindPFlag(watchViper, "bounce.enabled", WatchCmd.Flags().Lookup("bounce-enabled"))
+	WatchCmd.Flags().Int64P("bounce-interval-seconds", "", constant.DefaultBounceIntervalSeconds,
+		"interval seconds of reconnecting to another feed server, 0 means use the server suggested one")
+	mustBindPFlag(watchViper, "bounce.interval_seconds", WatchCmd.Flags().Lookup("bounce-interval-seconds"))
+	WatchCmd.Flags().Int64P("bounce-jitter-seconds", "", constant.DefaultBounceJitterSeconds,
+		"max random seconds added to each bounce interval")
+	mustBindPFlag(watchViper, "bounce.jitter_seconds", WatchCmd.Flags().Lookup("bounce-jitter-seconds"))
+	addBandwidthLimitFlags(WatchCmd.Flags(), watchViper)
+	addHookTimeoutFlags(WatchCmd.Flags(), watchViper)
+	addRangeDownloadFlags(WatchCmd.Flags(), watchViper)
+	addP2PDownloadFlags(WatchCmd.Flags(), watchViper)
 
 	envs := map[string]string{}
 	for key, envName := range commonEnvs {
@@ -14,14 +14,11 @@
 package cache
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
-	"sort"
 	"time"
 
 	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
@@ -30,7 +27,9 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
@@ -47,22 +46,82 @@ var instance *Cache
 // Enable define whether to enable local cache
 var Enable bool
 
+// Options is the options of the file cache
+type Options struct {
+	// Path is the file cache dir
+	Path string
+	// ThresholdGB is threshold gigabyte of cleanup
+	ThresholdGB float64
+	// CleanupIntervalSeconds is interval seconds of cleanup
+	CleanupIntervalSeconds int64
+	// RetentionRate is the rate of the threshold retained after cleanup
+	RetentionRate float64
+	// EvictionPolicy is the policy to choose the files to evict
+	EvictionPolicy EvictionPolicy
+	// Materialize is the way to materialize the app files from the cache
+	Materialize MaterializeMode
+	// PrefetchConcurrency is the max concurrent prefetch downloads, 0 means prefetch is disabled
+	PrefetchConcurrency int
+}
+
 // Cache is the bscp sdk cache
 type Cache struct {
 	path       string
 	thrsholdGB float64
+	opts       Options
+	index      *index
+	// cleanupCh triggers a cleanup once the cache grows beyond the threshold
+	cleanupCh chan struct{}
+	// workDir is the dir which the process downloads the contents to, workLock is held during the lifetime
+	workDir  string
+	workLock *util.FileLock
+	// cleanupLock is held if the process is elected as the cleaner of the cache
+	cleanupLock *util.FileLock
+	// prefetcher warms the cache in the background when a release is published
+	prefetcher *prefetcher
 }
 
 // Init return a bscp sdk cache instance
-func Init(path string, thresholdGB float64) error {
-	Enable = true
-	instance = &Cache{
-		path:       path,
-		thrsholdGB: thresholdGB,
+func Init(opts Options) error {
+	if opts.EvictionPolicy == "" {
+		opts.EvictionPolicy = EvictionLRU
+	}
+	if err := opts.EvictionPolicy.Validate(); err != nil {
+		return err
+	}
+	if opts.Materialize == "" {
+		opts.Materialize = MaterializeCopy
+	}
+	if err := opts.Materialize.Validate(); err != nil {
+		return err
 	}
 
 	// prepare cache dir
-	return os.MkdirAll(path, os.ModePerm)
+	if err := os.MkdirAll(filepath.Join(opts.Path, lockDirName), os.ModePerm); err != nil {
+		return err
+	}
+	idx, err := loadIndex(opts.Path)
+	if err != nil {
+		return err
+	}
+	workDir, workLock, err := newWorkDir(opts.Path)
+	if err != nil {
+		return err
+	}
+
+	Enable = true
+	metrics.CacheThresholdBytes.WithLabelValues(metrics.CacheFile).Set(opts.ThresholdGB * GByte)
+	instance = &Cache{
+		path:       opts.Path,
+		thrsholdGB: opts.ThresholdGB,
+		opts:       opts,
+		index:      idx,
+		cleanupCh:  make(chan struct{}, 1),
+		workDir:    workDir,
+		workLock:   workLock,
+		prefetcher: newPrefetcher(opts.PrefetchConcurrency),
+	}
+	return nil
 }
 
 // GetCache return the cache instance
@@ -70,39 +129,10 @@ func GetCache() *Cache {
 	return instance
 }
 
-// OnReleaseChange is the callback to refresh cache when release change event was received.
-func (c *Cache) OnReleaseChange(event *sfs.ReleaseChangeEvent) {
-	pl := new(sfs.ReleaseChangePayload)
-	if err := json.Unmarshal(event.Payload, pl); err != nil {
-		logger.Error("decode release change event payload failed, skip the event",
-			logger.ErrAttr(err), slog.String("rid", event.Rid))
-		return
-	}
-
-	if err := os.MkdirAll(c.path, os.ModePerm); err != nil {
-		logger.Error("mkdir cache path failed", slog.String("path", c.path), logger.ErrAttr(err))
-		return
-	}
-
-	for _, ci := range pl.ReleaseMeta.CIMetas {
-		exists, err := c.checkFileCacheExists(ci)
-		if err != nil {
-			logger.Error("check config item exists failed", logger.ErrAttr(err), slog.String("rid", event.Rid))
-			continue
-		}
-		if exists {
-			continue
-		}
-		filePath := filepath.Join(c.path, ci.ContentSpec.Signature)
-		// TODO: gse 现在分发文件时，target 的目录必须一致，因此这里 Cache 和 SDK 的下载目录会被视为同一个目录，并发下载时会有问题
-		// 两个并发下载任务下载到同一个文件中，但是 Downloader 中并发移动这个文件时会导致其中一个任务失败
-		// 在 GSE 解决这个问题（支持根据 target 设置目录）之前，先不启用 Cahce.OnReleaseChange 回调
-		if err := downloader.GetDownloader().Download(ci.PbFileMeta(), ci.RepositoryPath, ci.ContentSpec.ByteSize,
-			downloader.DownloadToFile, nil, filePath); err != nil {
-			logger.Error("download file failed", logger.ErrAttr(err), slog.String("rid", event.Rid))
-			return
-		}
-	}
+// Has returns whether the config content may be in the cache, the content is not verified.
+func (c *Cache) Has(ci *sfs.ConfigItemMetaV1) bool {
+	_, err := os.Stat(filepath.Join(c.path, ci.ContentSpec.Signature))
+	return err == nil
 }
 
 // checkFileCacheExists verify the config content is exist or not in the local.
@@ -132,53 +162,148 @@ func (c *Cache) checkFileCacheExists(ci *sfs.ConfigItemMetaV1) (bool, error) {
 
 // GetFileContent return the config content bytes.
 func (c *Cache) GetFileContent(ci *sfs.ConfigItemMetaV1) (bool, []byte) {
-	exists, err := c.checkFileCacheExists(ci)
+	lock, err := c.lockEntry(ci.ContentSpec.Signature, false)
 	if err != nil {
-		logger.Error("check config item cache exists failed",
-			slog.String("item", ci.ContentSpec.Signature), logger.ErrAttr(err))
-		return false, nil
-	}
-	if !exists {
+		logger.Error("lock config item cache file failed", logger.ErrAttr(err))
 		return false, nil
 	}
+	defer lock.Unlock()
+
 	filePath := filepath.Join(c.path, ci.ContentSpec.Signature)
 	bytes, err := os.ReadFile(filePath)
 	if err != nil {
-		logger.Error("read config item cache file failed",
-			slog.String("file", filePath), logger.ErrAttr(err))
+		if !os.IsNotExist(err) {
+			logger.Error("read config item cache file failed",
+				slog.String("file", filePath), logger.ErrAttr(err))
+		}
+		c.index.miss()
 		return false, nil
 	}
+	if tools.ByteSHA256(bytes) != ci.ContentSpec.Signature {
+		c.index.miss()
+		return false, nil
+	}
+	c.index.touch(ci.ContentSpec.Signature)
 	return true, bytes
 }
 
 // CopyToFile copy the config content to the specified file.
 // get from cache first, if not exist, then get from remote repo and add it to cache
 func (c *Cache) CopyToFile(ci *sfs.ConfigItemMetaV1, filePath string) bool {
-	if ci.ContentSpec.ByteSize > uint64(MaxSingleFileCacheSizeRate*c.thrsholdGB*GByte) {
+	cacheFilePath, lock, ok := c.prepare(ci, false)
+	if !ok {
+		return false
+	}
+	defer lock.Unlock()
+	return c.copyToFile(cacheFilePath, filePath)
+}
+
+// Cacheable returns whether the config content is small enough to be cached
+func (c *Cache) Cacheable(ci *sfs.ConfigItemMetaV1) bool {
+	return ci.ContentSpec.ByteSize <= uint64(MaxSingleFileCacheSizeRate*c.thrsholdGB*GByte)
+}
+
+// prepare makes sure the config content is in the cache, returns the cache file path and the lock of it, the
+// lock is shared unless exclusive is true, the caller must release the lock after used the cache file.
+func (c *Cache) prepare(ci *sfs.ConfigItemMetaV1, exclusive bool) (string, *util.FileLock, bool) {
+	signature := ci.ContentSpec.Signature
+	if !c.Cacheable(ci) {
 		logger.Warn("config item size is too large, skip cache",
 			slog.String("item", filepath.Join(ci.ConfigItemSpec.Path, ci.ConfigItemSpec.Name)),
 			slog.Int64("size", int64(ci.ContentSpec.ByteSize)))
-		return false
+		metrics.CacheOversizedSkipCounter.WithLabelValues(metrics.CacheFile).Inc()
+		return "", nil, false
+	}
+
+	cacheFilePath := filepath.Join(c.path, signature)
+	if !exclusive {
+		lock, exists, ok := c.lockExisting(ci, false)
+		if !ok {
+			return "", nil, false
+		}
+		if exists {
+			c.index.touch(signature)
+			return cacheFilePath, lock, true
+		}
+		_ = lock.Unlock()
+		// the content is being prefetched, check it again after the prefetch is done
+		c.prefetcher.wait(signature)
+	}
+
+	// the content may be downloaded by others while waiting for the exclusive lock
+	lock, exists, ok := c.lockExisting(ci, true)
+	if !ok {
+		return "", nil, false
+	}
+	if exists {
+		c.index.touch(signature)
+		return cacheFilePath, lock, true
+	}
+
+	c.index.miss()
+	// the broken cache file may be hard linked by the app files, remove it rather than overwrite it
+	if err := os.Remove(cacheFilePath); err != nil && !os.IsNotExist(err) {
+		logger.Error("remove broken cache file failed", slog.String("file", cacheFilePath), logger.ErrAttr(err))
+		_ = lock.Unlock()
+		return "", nil, false
+	}
+	// get from remote repo and add it to cache
+	if err := c.download(downloader.GetDownloader(), ci); err != nil {
+		logger.Error("download file failed", logger.ErrAttr(err))
+		_ = lock.Unlock()
+		return "", nil, false
+	}
+	return cacheFilePath, lock, true
+}
+
+// lockExisting locks the cache file and checks whether the content exists in the cache
+func (c *Cache) lockExisting(ci *sfs.ConfigItemMetaV1, exclusive bool) (*util.FileLock, bool, bool) {
+	lock, err := c.lockEntry(ci.ContentSpec.Signature, exclusive)
+	if err != nil {
+		logger.Error("lock config item cache file failed", logger.ErrAttr(err))
+		return nil, false, false
 	}
 	exists, err := c.checkFileCacheExists(ci)
 	if err != nil {
 		logger.Error("check config item cache exists failed",
 			slog.String("item", ci.ContentSpec.Signature), logger.ErrAttr(err))
-		return false
+		_ = lock.Unlock()
+		return nil, false, false
+	}
+	return lock, exists, true
+}
+
+// download downloads the content to the work dir and moves it to the cache dir, the caller must hold the
+// exclusive lock of the cache file.
+func (c *Cache) download(dl downloader.Downloader, ci *sfs.ConfigItemMetaV1) error {
+	signature := ci.ContentSpec.Signature
+	workPath := filepath.Join(c.workDir, signature)
+	if err := dl.Download(ci.PbFileMeta(), ci.RepositoryPath, ci.ContentSpec.ByteSize,
+		downloader.DownloadToFile, nil, workPath); err != nil {
+		_ = os.Remove(workPath)
+		return err
+	}
+	if err := util.ReplaceFile(workPath, filepath.Join(c.path, signature)); err != nil {
+		_ = os.Remove(workPath)
+		return fmt.Errorf("move file to cache failed, err: %s", err.Error())
 	}
+	c.added(ci)
+	return nil
+}
 
-	cacheFilePath := filepath.Join(c.path, ci.ContentSpec.Signature)
-	if !exists {
-		// get from remote repo and add it to cache
-		if err = downloader.GetDownloader().Download(ci.PbFileMeta(), ci.RepositoryPath, ci.ContentSpec.ByteSize,
-			downloader.DownloadToFile, nil, cacheFilePath); err != nil {
-			logger.Error("download file failed", logger.ErrAttr(err))
-			return false
+// copyToFile copies the cache file to the specified file, the file is cloned by reflink if enabled and supported.
+func (c *Cache) copyToFile(cacheFilePath, filePath string) bool {
+	if c.opts.Materialize != MaterializeCopy {
+		err := util.CloneFile(cacheFilePath, filePath)
+		if err == nil {
+			return true
 		}
+		logger.Debug("clone config item cache file failed, fall back to copy",
+			slog.String("cache_file", cacheFilePath), slog.String("file", filePath), logger.ErrAttr(err))
 	}
 
 	var src, dst *os.File
-	src, err = os.Open(cacheFilePath)
+	src, err := os.Open(cacheFilePath)
 	if err != nil {
 		logger.Error("open config item cache file failed", slog.String("file", cacheFilePath), logger.ErrAttr(err))
 		return false
@@ -200,83 +325,95 @@ func (c *Cache) CopyToFile(ci *sfs.ConfigItemMetaV1, filePath string) bool {
 	return true
 }
 
-// AutoCleanupFileCache auto cleanup file cache
-func AutoCleanupFileCache(cacheDir string, cleanupIntervalSeconds int64, thresholdGB, retentionRate float64) {
-	logger.Info("start auto cleanup file cache ",
-		slog.String("cacheDir", cacheDir),
-		slog.String("cleanupIntervalSeconds", fmt.Sprintf("%ds", cleanupIntervalSeconds)),
-		slog.String("thresholdGB", fmt.Sprintf("%sGB", humanize.Ftoa(thresholdGB))),
-		slog.String("retentionRate", fmt.Sprintf("%s%%", humanize.Ftoa(retentionRate*100))))
+// added records the config content newly added to the cache, and triggers a cleanup if the cache is full
+func (c *Cache) added(ci *sfs.ConfigItemMetaV1) {
+	c.index.add(ci.ContentSpec.Signature, int64(ci.ContentSpec.ByteSize))
+	if c.index.size() > int64(c.thrsholdGB*GByte) {
+		select {
+		case c.cleanupCh <- struct{}{}:
+		default:
+		}
+	}
+}
 
+// AutoCleanupFileCache auto cleanup file cache, the cleanup runs every cleanup interval and once the cache grows
+// beyond the threshold, the index is persisted as well. when the cache dir is shared by several processes, only the
+// elected one cleans up the cache and persists the index, the others reconcile their index with the cache dir.
+func (c *Cache) AutoCleanupFileCache() {
+	logger.Info("start auto cleanup file cache ",
+		slog.String("cacheDir", c.path),
+		slog.String("cleanupIntervalSeconds", fmt.Sprintf("%ds", c.opts.CleanupIntervalSeconds)),
+		slog.String("thresholdGB", fmt.Sprintf("%sGB", humanize.Ftoa(c.thrsholdGB))),
+		slog.String("retentionRate", fmt.Sprintf("%s%%", humanize.Ftoa(c.opts.RetentionRate*100))),
+		slog.String("evictionPolicy", string(c.opts.EvictionPolicy)))
+
+	ticker := time.NewTicker(time.Duration(c.opts.CleanupIntervalSeconds) * time.Second)
+	defer ticker.Stop()
 	for {
-		currentSize, err := calculateDirSize(cacheDir)
-		if err != nil {
-			logger.Error("calculate current cache directory size failed", logger.ErrAttr(err))
-			time.Sleep(time.Duration(cleanupIntervalSeconds) * time.Second)
+		select {
+		case <-ticker.C:
+		case <-c.cleanupCh:
+		}
+
+		// the cache files may be added or removed by other processes
+		if err := c.index.reconcile(); err != nil {
+			logger.Warn("reconcile cache index failed", logger.ErrAttr(err))
+		}
+		// merge the accesses into the persisted index, so that the cleaner evicts by the accesses of all processes
+		if err := c.index.save(); err != nil {
+			logger.Error("save cache index failed", logger.ErrAttr(err))
+		}
+		if !c.electCleaner() {
 			continue
 		}
-		logger.Debug("calculate current cache directory size", slog.String("currentSize",
-			humanize.IBytes(uint64(currentSize))))
+		c.cleanupWorkDirs()
 
-		if currentSize > int64(thresholdGB*GByte) {
+		currentSize := c.index.size()
+		logger.Debug("current cache size", slog.String("currentSize", humanize.IBytes(uint64(currentSize))))
+		if currentSize > int64(c.thrsholdGB*GByte) {
 			logger.Info("cleaning up directory...")
-			cleanupOldestFiles(cacheDir, currentSize-int64(math.Floor(thresholdGB*GByte*retentionRate)))
+			start := time.Now()
+			c.Evict(currentSize - int64(math.Floor(c.thrsholdGB*GByte*c.opts.RetentionRate)))
+			metrics.CacheCleanupSecond.WithLabelValues(metrics.CacheFile).Observe(time.Since(start).Seconds())
+		}
+		if err := c.index.save(); err != nil {
+			logger.Error("save cache index failed", logger.ErrAttr(err))
 		}
-		time.Sleep(time.Duration(cleanupIntervalSeconds) * time.Second)
 	}
 }
 
-func calculateDirSize(dir string) (int64, error) {
-	var size int64
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// Evict removes the cache files in the order of the eviction policy until the space is freed, the files in use
+// are skipped, returns the count and size of the removed files.
+func (c *Cache) Evict(spaceToFree int64) (int, int64) {
+	var count int
+	var freed int64
+	for _, entry := range c.index.list(c.opts.EvictionPolicy) {
+		if freed >= spaceToFree {
+			break
 		}
-		size += info.Size()
-		return nil
-	})
-	return size, err
-}
-
-func cleanupOldestFiles(dir string, spaceToFree int64) {
-	files, err := listFilesByModTime(dir)
-	if err != nil {
-		logger.Error("list files by mod time failed", logger.ErrAttr(err))
-	}
-
-	for _, file := range files {
-		filePath := filepath.Join(dir, file.Name())
-		err = os.Remove(filePath)
+		filePath := filepath.Join(c.path, entry.Signature)
+		removed, err := c.removeEntry(entry.Signature)
 		if err != nil {
 			logger.Error("deleting file failed", slog.String("file", filePath), logger.ErrAttr(err))
-		} else {
-			logger.Info("deleted file", slog.String("file", filePath))
-			spaceToFree -= file.Size()
+			continue
 		}
-
-		if spaceToFree <= 0 {
-			break
+		if !removed {
+			logger.Debug("file is in use, skip deleting", slog.String("file", filePath))
+			continue
 		}
+		logger.Info("deleted file", slog.String("file", filePath), slog.Uint64("hits", entry.Hits),
+			slog.Time("lastAccess", entry.LastAccess))
+		metrics.CacheEvictionCounter.WithLabelValues(metrics.CacheFile).Inc()
+		count++
+		freed += entry.Size
 	}
+	return count, freed
 }
 
-func listFilesByModTime(dir string) ([]os.FileInfo, error) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, err
+// RebuildIndex rebuilds the cache index from the files in the cache dir and persists it
+func (c *Cache) RebuildIndex() error {
+	if err := c.index.reconcile(); err != nil {
+		return err
 	}
-	files := make([]fs.FileInfo, 0, len(entries))
-	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, info)
-	}
-
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].ModTime().Before(files[j].ModTime())
-	})
-
-	return files, nil
+	return c.index.save()
 }
@@ -0,0 +1,379 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+// EvictionPolicy is the policy to choose the cache files to evict
+type EvictionPolicy string
+
+const (
+	// EvictionLRU evicts the least recently used files first
+	EvictionLRU EvictionPolicy = "lru"
+	// EvictionLFU evicts the least frequently used files first, ties are broken by the last access time
+	EvictionLFU EvictionPolicy = "lfu"
+)
+
+// Validate validates the eviction policy
+func (p EvictionPolicy) Validate() error {
+	switch p {
+	case EvictionLRU, EvictionLFU:
+		return nil
+	default:
+		return fmt.Errorf("invalid cache eviction policy %s, should be one of lru, lfu", p)
+	}
+}
+
+// indexFileName is the file name of the persisted cache index under the cache dir
+const indexFileName = ".bscp-cache-index.json"
+
+// indexLockName is the lock file under the cache dir which serializes the saves of the index among the processes,
+// the cleanup lock is not used since the cleaner holds it during its lifetime
+const indexLockName = indexFileName + ".lock"
+
+// cacheFileRe matches the name of the cache files, which is the sha256 signature of the content
+var cacheFileRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// IndexEntry is the index entry of a cache file
+type IndexEntry struct {
+	// Signature is the sha256 signature of the content, which is also the cache file name
+	Signature string `json:"signature"`
+	// Size is the byte size of the cache file
+	Size int64 `json:"size"`
+	// LastAccess is the last time the cache file was hit or added
+	LastAccess time.Time `json:"last_access"`
+	// Hits is the hit count of the cache file
+	Hits uint64 `json:"hits"`
+	// pending is the hit count of the process which is not saved yet
+	pending uint64
+}
+
+// indexFile is the persisted cache index
+type indexFile struct {
+	// Hits is the total hit count of the cache
+	Hits uint64 `json:"hits"`
+	// Misses is the total miss count of the cache
+	Misses uint64 `json:"misses"`
+	// Entries is the index entries of the cache files
+	Entries []*IndexEntry `json:"entries"`
+}
+
+// index tracks the size and access of the cache files, so that the cleanup neither walks the cache dir
+// nor depends on the mod time which a cache hit never updates. the index file is shared by the processes using
+// the cache dir, each process merges its accesses into it on save.
+type index struct {
+	lock    sync.Mutex
+	dir     string
+	entries map[string]*IndexEntry
+	total   int64
+	hits    uint64
+	misses  uint64
+	// pendingHits and pendingMisses are the counts of the process which are not saved yet
+	pendingHits   uint64
+	pendingMisses uint64
+	dirty         bool
+}
+
+// loadIndex loads the persisted index of the cache dir and reconciles it with the files in the dir,
+// the index is rebuilt from the files when it is missing or broken, eg. the process crashed while saving it.
+func loadIndex(dir string) (*index, error) {
+	idx := &index{dir: dir, entries: make(map[string]*IndexEntry)}
+
+	f, err := readIndexFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		logger.Info("cache index not found or broken, rebuild it", slog.String("dir", dir))
+	} else {
+		idx.hits, idx.misses, idx.entries = f.Hits, f.Misses, f.entries()
+	}
+
+	if err = idx.reconcile(); err != nil {
+		return nil, err
+	}
+	return idx, idx.save()
+}
+
+// readIndexFile reads the persisted index of the cache dir, returns nil if it is missing or broken
+func readIndexFile(dir string) (*indexFile, error) {
+	b, err := os.ReadFile(filepath.Join(dir, indexFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read cache index failed, err: %s", err.Error())
+	}
+	f := new(indexFile)
+	if err = json.Unmarshal(b, f); err != nil {
+		logger.Warn("cache index is broken", slog.String("dir", dir), logger.ErrAttr(err))
+		return nil, nil
+	}
+	return f, nil
+}
+
+// entries returns the valid entries of the persisted index by signature
+func (f *indexFile) entries() map[string]*IndexEntry {
+	entries := make(map[string]*IndexEntry, len(f.Entries))
+	for _, e := range f.Entries {
+		if e != nil && cacheFileRe.MatchString(e.Signature) {
+			entries[e.Signature] = e
+		}
+	}
+	return entries
+}
+
+// reconcile drops the entries whose files are gone and adds the files missing in the index,
+// the mod time is taken as the last access time of the added files.
+func (i *index) reconcile() error {
+	dirEntries, err := os.ReadDir(i.dir)
+	if err != nil {
+		return fmt.Errorf("read cache dir failed, err: %s", err.Error())
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	entries := make(map[string]*IndexEntry, len(dirEntries))
+	var total int64
+	for _, de := range dirEntries {
+		if !de.Type().IsRegular() || !cacheFileRe.MatchString(de.Name()) {
+			continue
+		}
+		info, e := de.Info()
+		if e != nil {
+			// the file is removed after listed
+			continue
+		}
+		entry, ok := i.entries[de.Name()]
+		if !ok {
+			entry = &IndexEntry{Signature: de.Name(), LastAccess: info.ModTime()}
+		}
+		entry.Size = info.Size()
+		entries[de.Name()] = entry
+		total += entry.Size
+	}
+	i.entries, i.total, i.dirty = entries, total, true
+	metrics.CacheSizeBytes.WithLabelValues(metrics.CacheFile).Set(float64(i.total))
+	return nil
+}
+
+// touch records a hit of the cache file, the file is added to the index if it is not indexed yet
+func (i *index) touch(signature string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	entry, ok := i.entries[signature]
+	if !ok {
+		info, err := os.Stat(filepath.Join(i.dir, signature))
+		if err != nil {
+			return
+		}
+		entry = &IndexEntry{Signature: signature, Size: info.Size()}
+		i.entries[signature] = entry
+		i.total += entry.Size
+		metrics.CacheSizeBytes.WithLabelValues(metrics.CacheFile).Set(float64(i.total))
+	}
+	entry.LastAccess = time.Now()
+	entry.Hits++
+	entry.pending++
+	i.hits++
+	i.pendingHits++
+	i.dirty = true
+	metrics.CacheHitCounter.WithLabelValues(metrics.CacheFile).Inc()
+	metrics.CacheServedBytesCounter.WithLabelValues(metrics.CacheFile).Add(float64(entry.Size))
+}
+
+// miss records a miss of the cache
+func (i *index) miss() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.misses++
+	i.pendingMisses++
+	i.dirty = true
+	metrics.CacheMissCounter.WithLabelValues(metrics.CacheFile).Inc()
+}
+
+// add records a cache file which is newly added or replaced
+func (i *index) add(signature string, size int64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if entry, ok := i.entries[signature]; ok {
+		i.total += size - entry.Size
+		entry.Size = size
+		entry.LastAccess = time.Now()
+	} else {
+		i.entries[signature] = &IndexEntry{Signature: signature, Size: size, LastAccess: time.Now()}
+		i.total += size
+	}
+	i.dirty = true
+	metrics.CacheSizeBytes.WithLabelValues(metrics.CacheFile).Set(float64(i.total))
+}
+
+// remove drops the cache file from the index
+func (i *index) remove(signature string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if entry, ok := i.entries[signature]; ok {
+		i.total -= entry.Size
+		delete(i.entries, signature)
+		i.dirty = true
+		metrics.CacheSizeBytes.WithLabelValues(metrics.CacheFile).Set(float64(i.total))
+	}
+}
+
+// size returns the total size of the indexed cache files
+func (i *index) size() int64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.total
+}
+
+// list returns the copy of the index entries in the eviction order of the policy
+func (i *index) list(policy EvictionPolicy) []IndexEntry {
+	i.lock.Lock()
+	entries := make([]IndexEntry, 0, len(i.entries))
+	for _, e := range i.entries {
+		entries = append(entries, *e)
+	}
+	i.lock.Unlock()
+
+	sort.Slice(entries, func(a, b int) bool {
+		if policy == EvictionLFU && entries[a].Hits != entries[b].Hits {
+			return entries[a].Hits < entries[b].Hits
+		}
+		return entries[a].LastAccess.Before(entries[b].LastAccess)
+	})
+	return entries
+}
+
+// save merges the index into the persisted one if it is changed since the last save, the file is replaced
+// atomically under the index lock, so that the accesses of all the processes are visible to the cleaner
+func (i *index) save() error {
+	i.lock.Lock()
+	dirty := i.dirty
+	i.lock.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	lock, err := util.LockFile(filepath.Join(i.dir, indexLockName), true)
+	if err != nil {
+		return fmt.Errorf("lock cache index failed, err: %s", err.Error())
+	}
+	defer lock.Unlock()
+	persisted, err := readIndexFile(i.dir)
+	if err != nil {
+		return err
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if persisted != nil {
+		i.merge(persisted)
+	}
+	f := &indexFile{Hits: i.hits, Misses: i.misses, Entries: make([]*IndexEntry, 0, len(i.entries))}
+	for _, e := range i.entries {
+		entry := *e
+		f.Entries = append(f.Entries, &entry)
+	}
+	if err = i.write(f); err != nil {
+		return err
+	}
+	for _, e := range i.entries {
+		e.pending = 0
+	}
+	i.pendingHits, i.pendingMisses, i.dirty = 0, 0, false
+	return nil
+}
+
+// merge merges the persisted index saved by the other processes into the index, the counts not saved yet are
+// added to the persisted ones, the entries whose files are removed by the others are dropped, and the entries
+// added by the others are taken. the caller must hold the lock of the index.
+func (i *index) merge(f *indexFile) {
+	i.hits, i.misses = f.Hits+i.pendingHits, f.Misses+i.pendingMisses
+	persisted := f.entries()
+	for signature, entry := range i.entries {
+		p, ok := persisted[signature]
+		if !ok {
+			// added by the process and not saved yet, or removed by the others
+			if _, err := os.Stat(filepath.Join(i.dir, signature)); err != nil {
+				i.total -= entry.Size
+				delete(i.entries, signature)
+			}
+			continue
+		}
+		entry.Hits = p.Hits + entry.pending
+		if p.LastAccess.After(entry.LastAccess) {
+			entry.LastAccess = p.LastAccess
+		}
+	}
+	for signature, p := range persisted {
+		if _, ok := i.entries[signature]; ok {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(i.dir, signature))
+		if err != nil {
+			continue
+		}
+		p.Size = info.Size()
+		i.entries[signature] = p
+		i.total += p.Size
+	}
+	metrics.CacheSizeBytes.WithLabelValues(metrics.CacheFile).Set(float64(i.total))
+}
+
+// write replaces the persisted index with f atomically
+func (i *index) write(f *indexFile) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("encode cache index failed, err: %s", err.Error())
+	}
+	// the temp file is unique since the cache dir may be shared by several processes
+	tmp, err := os.CreateTemp(i.dir, indexFileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create cache index temp file failed, err: %s", err.Error())
+	}
+	if err = tmp.Chmod(0644); err == nil {
+		_, err = tmp.Write(b)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = util.ReplaceFile(tmp.Name(), filepath.Join(i.dir, indexFileName))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("write cache index failed, err: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCacheFile(t *testing.T, dir, signature string, size int) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, signature), make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexEvictionOrder(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	for _, sig := range []string{a, b, c} {
+		writeCacheFile(t, dir, sig, 10)
+	}
+	idx, err := loadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.size() != 30 {
+		t.Fatalf("expect size 30, got %d", idx.size())
+	}
+
+	// a is hit twice, b once, c is the most recently used one
+	idx.touch(a)
+	idx.touch(a)
+	idx.touch(b)
+	idx.touch(c)
+
+	if got := idx.list(EvictionLRU)[0].Signature; got != a {
+		t.Fatalf("lru should evict a first, got %s", got[:1])
+	}
+	if got := idx.list(EvictionLFU)[0].Signature; got != b {
+		t.Fatalf("lfu should evict b first, got %s", got[:1])
+	}
+}
+
+func TestIndexRebuild(t *testing.T) {
+	dir := t.TempDir()
+	a, b := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	writeCacheFile(t, dir, a, 10)
+	idx, err := loadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.touch(a)
+	if err = idx.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file added without index update is picked up, and the persisted hits are kept
+	writeCacheFile(t, dir, b, 20)
+	if idx, err = loadIndex(dir); err != nil {
+		t.Fatal(err)
+	}
+	if idx.size() != 30 || idx.entries[a].Hits != 1 {
+		t.Fatalf("unexpected index after reload, size %d, hits %d", idx.size(), idx.entries[a].Hits)
+	}
+
+	// broken index is rebuilt from the files
+	if err = os.WriteFile(filepath.Join(dir, indexFileName), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(dir, a)); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err = loadIndex(dir); err != nil {
+		t.Fatal(err)
+	}
+	if idx.size() != 20 || len(idx.entries) != 1 {
+		t.Fatalf("unexpected index after rebuild, size %d, entries %d", idx.size(), len(idx.entries))
+	}
+}
+
+func TestIndexMergeAccesses(t *testing.T) {
+	dir := t.TempDir()
+	a, b := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	writeCacheFile(t, dir, a, 10)
+	writeCacheFile(t, dir, b, 10)
+
+	// the cleaner and another process share the cache dir
+	cleaner, err := loadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := loadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleaner.touch(a)
+	other.touch(b)
+	other.touch(b)
+	other.miss()
+	if err = other.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cleaner.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cleaner.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the accesses of the other process are merged, a is the least recently used one now
+	if cleaner.entries[a].Hits != 1 || cleaner.entries[b].Hits != 2 || cleaner.hits != 3 || cleaner.misses != 1 {
+		t.Fatalf("unexpected merged index, hits a %d, b %d, total %d, misses %d",
+			cleaner.entries[a].Hits, cleaner.entries[b].Hits, cleaner.hits, cleaner.misses)
+	}
+	if got := cleaner.list(EvictionLRU)[0].Signature; got != a {
+		t.Fatalf("lru should evict a first, got %s", got[:1])
+	}
+
+	// the file removed by the cleaner is not brought back by the other process
+	if err = os.Remove(filepath.Join(dir, a)); err != nil {
+		t.Fatal(err)
+	}
+	cleaner.remove(a)
+	if err = cleaner.save(); err != nil {
+		t.Fatal(err)
+	}
+	other.touch(b)
+	if err = other.save(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.entries[a]; ok || len(reloaded.entries) != 1 || reloaded.entries[b].Hits != 3 {
+		t.Fatalf("unexpected index after removal, entries %d", len(reloaded.entries))
+	}
+}
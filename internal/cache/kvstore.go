@@ -0,0 +1,381 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+const (
+	// kvStoreFileExt is the extension of the kv store files
+	kvStoreFileExt = ".json"
+	// kvStoreTempExt is the extension of the temp files written before replacing the kv store files
+	kvStoreTempExt = ".tmp"
+	// kvStoreLockName is the lock file of the kv store dir, which may be shared by the processes on the host
+	kvStoreLockName = ".kv-store.lock"
+	// kvTypeSecret is the kv type of the secret kvs
+	kvTypeSecret = "secret"
+)
+
+var kvStore *KvStore
+
+// EnableKvStore define whether to enable the on-disk kv cache store
+var EnableKvStore bool
+
+// ErrKvStoreSecret is returned when a secret kv is stored without the encryption key
+var ErrKvStoreSecret = errors.New("secret kv is not stored on disk without encryption key")
+
+// KvStoreOptions is the options of the on-disk kv cache store
+type KvStoreOptions struct {
+	// Dir is the dir of the kv store files
+	Dir string
+	// ThresholdMB is the max megabytes of the kv store files, the least recently used kvs are evicted beyond it
+	ThresholdMB float64
+	// EncryptionKey is the 32 bytes AES-256 key to encrypt the secret kvs, which are not stored without it
+	EncryptionKey []byte
+}
+
+// KvEntry is the kv stored on the disk
+type KvEntry struct {
+	// Key is the kv cache key, which is composed of biz, app and kv key
+	Key string `json:"key"`
+	// ReleaseID is the release id which the value belongs to
+	ReleaseID uint32 `json:"release_id"`
+	// Md5 is the md5 of the value
+	Md5 string `json:"md5"`
+	// KvType is the type of the kv
+	KvType string `json:"kv_type"`
+	// Value is the kv value, which is base64 encoded AES-GCM sealed value if encrypted
+	Value string `json:"value"`
+	// Encrypted is whether the value is encrypted
+	Encrypted bool `json:"encrypted"`
+	// UpdatedAt is the time the kv is stored
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// size is the byte size of the kv store file
+	size int64
+	// lastAccess is the last time the kv is read or stored
+	lastAccess time.Time
+}
+
+// KvStore is the on-disk kv cache store, the kvs are loaded to the memory when initialized and written through
+// when stored, each kv is stored in a file named by the sha256 of its key. the dir may be shared by the processes
+// on the host, the files are written and removed under the lock of the dir.
+type KvStore struct {
+	opts    KvStoreOptions
+	aead    cipher.AEAD
+	lock    sync.Mutex
+	entries map[string]*KvEntry
+	total   int64
+}
+
+// InitKvStore loads the on-disk kv cache store
+func InitKvStore(opts KvStoreOptions) error {
+	s := &KvStore{opts: opts, entries: make(map[string]*KvEntry)}
+	if len(opts.EncryptionKey) > 0 {
+		block, err := aes.NewCipher(opts.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("invalid kv store encryption key, err: %s", err.Error())
+		}
+		if s.aead, err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("init kv store cipher failed, err: %s", err.Error())
+		}
+	}
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
+		return fmt.Errorf("create kv store dir failed, err: %s", err.Error())
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	metrics.CacheThresholdBytes.WithLabelValues(metrics.CacheKvDisk).Set(opts.ThresholdMB * 1024 * 1024)
+	metrics.CacheSizeBytes.WithLabelValues(metrics.CacheKvDisk).Set(float64(s.total))
+	kvStore = s
+	EnableKvStore = true
+	return nil
+}
+
+// GetKvStore return the on-disk kv cache store instance
+func GetKvStore() *KvStore {
+	return kvStore
+}
+
+// load reads the kv store files, the broken ones and the temp ones left by the crash are removed,
+// the other files in the dir are not created by the store and kept as they are
+func (s *KvStore) load() error {
+	dirLock, err := s.lockDir()
+	if err != nil {
+		return err
+	}
+	defer dirLock.Unlock()
+
+	dirEntries, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return fmt.Errorf("read kv store dir failed, err: %s", err.Error())
+	}
+	for _, de := range dirEntries {
+		path := filepath.Join(s.opts.Dir, de.Name())
+		if !de.Type().IsRegular() {
+			continue
+		}
+		if isKvStoreTempFile(de.Name()) {
+			_ = os.Remove(path)
+			continue
+		}
+		if !isKvStoreFile(de.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read kv store file failed, err: %s", err.Error())
+		}
+		entry := new(KvEntry)
+		if err = json.Unmarshal(b, entry); err != nil || kvStoreFileName(entry.Key) != de.Name() ||
+			(entry.Encrypted && s.aead == nil) {
+			// the secret kvs encrypted by the key which is not configured anymore are useless
+			logger.Warn("drop invalid kv store file", slog.String("file", path))
+			_ = os.Remove(path)
+			continue
+		}
+		entry.size, entry.lastAccess = int64(len(b)), entry.UpdatedAt
+		s.entries[entry.Key] = entry
+		s.total += entry.size
+	}
+	logger.Info("load kv store success", slog.String("dir", s.opts.Dir), slog.Int("count", len(s.entries)),
+		slog.Int64("bytes", s.total))
+	return nil
+}
+
+// kvStoreFileName returns the file name of the kv, the key is hashed since it may contain any characters
+func kvStoreFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + kvStoreFileExt
+}
+
+// isKvStoreFile returns whether the file is named by the store, which is the hex encoded sha256 with the extension
+func isKvStoreFile(name string) bool {
+	hash, ok := strings.CutSuffix(name, kvStoreFileExt)
+	if !ok || len(hash) != hex.EncodedLen(sha256.Size) || strings.ToLower(hash) != hash {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// isKvStoreTempFile returns whether the file is the temp file of a kv store file
+func isKvStoreTempFile(name string) bool {
+	size := hex.EncodedLen(sha256.Size) + len(kvStoreFileExt)
+	return len(name) > size && strings.HasSuffix(name, kvStoreTempExt) && isKvStoreFile(name[:size])
+}
+
+// Get returns the stored kv and its decrypted value
+func (s *KvStore) Get(key string) (*KvEntry, string, bool) {
+	s.lock.Lock()
+	entry, ok := s.entries[key]
+	if ok {
+		entry.lastAccess = time.Now()
+	}
+	s.lock.Unlock()
+	if !ok {
+		metrics.CacheMissCounter.WithLabelValues(metrics.CacheKvDisk).Inc()
+		return nil, "", false
+	}
+
+	value := entry.Value
+	if entry.Encrypted {
+		var err error
+		if value, err = s.decrypt(entry.Value); err != nil {
+			logger.Error("decrypt kv store value failed", slog.String("key", key), logger.ErrAttr(err))
+			metrics.CacheMissCounter.WithLabelValues(metrics.CacheKvDisk).Inc()
+			return nil, "", false
+		}
+	}
+	metrics.CacheHitCounter.WithLabelValues(metrics.CacheKvDisk).Inc()
+	metrics.CacheServedBytesCounter.WithLabelValues(metrics.CacheKvDisk).Add(float64(len(value)))
+	return entry, value, true
+}
+
+// Set stores the kv to the disk, the secret kv is encrypted or refused without the encryption key
+func (s *KvStore) Set(key string, releaseID uint32, md5, kvType, value string) error {
+	entry := &KvEntry{Key: key, ReleaseID: releaseID, Md5: md5, KvType: kvType, Value: value,
+		UpdatedAt: time.Now()}
+	if kvType == kvTypeSecret {
+		if s.aead == nil {
+			s.Delete(key)
+			return ErrKvStoreSecret
+		}
+		sealed, err := s.encrypt(value)
+		if err != nil {
+			return err
+		}
+		entry.Value, entry.Encrypted = sealed, true
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encode kv store entry failed, err: %s", err.Error())
+	}
+	entry.size, entry.lastAccess = int64(len(b)), entry.UpdatedAt
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dirLock, err := s.lockDir()
+	if err != nil {
+		return err
+	}
+	defer dirLock.Unlock()
+
+	if err = s.writeFile(key, b); err != nil {
+		return err
+	}
+	if old, ok := s.entries[key]; ok {
+		s.total -= old.size
+	}
+	s.entries[key] = entry
+	s.total += entry.size
+	s.evict()
+	metrics.CacheSizeBytes.WithLabelValues(metrics.CacheKvDisk).Set(float64(s.total))
+	return nil
+}
+
+// writeFile writes the kv store file of the key atomically, the caller holds the lock of the store dir
+func (s *KvStore) writeFile(key string, b []byte) error {
+	path := filepath.Join(s.opts.Dir, kvStoreFileName(key))
+	// the temp file is unique so that the processes sharing the dir never write the same one
+	f, err := os.CreateTemp(s.opts.Dir, kvStoreFileName(key)+".*"+kvStoreTempExt)
+	if err != nil {
+		return fmt.Errorf("create kv store temp file failed, err: %s", err.Error())
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write kv store file failed, err: %s", err.Error())
+	}
+	if err = util.ReplaceFile(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("replace kv store file failed, err: %s", err.Error())
+	}
+	return nil
+}
+
+// lockDir locks the store dir exclusively while the files are written or removed, so that the temp files found
+// under the lock are all left by the crash
+func (s *KvStore) lockDir() (*util.FileLock, error) {
+	l, err := util.LockFile(filepath.Join(s.opts.Dir, kvStoreLockName), true)
+	if err != nil {
+		return nil, fmt.Errorf("lock kv store dir failed, err: %s", err.Error())
+	}
+	return l, nil
+}
+
+// Delete removes the kv from the store
+func (s *KvStore) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dirLock, err := s.lockDir()
+	if err != nil {
+		logger.Error("delete kv from store failed", slog.String("key", key), logger.ErrAttr(err))
+		return
+	}
+	defer dirLock.Unlock()
+	s.remove(key)
+	metrics.CacheSizeBytes.WithLabelValues(metrics.CacheKvDisk).Set(float64(s.total))
+}
+
+func (s *KvStore) remove(key string) {
+	entry, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	if err := os.Remove(filepath.Join(s.opts.Dir, kvStoreFileName(key))); err != nil && !os.IsNotExist(err) {
+		logger.Error("remove kv store file failed", slog.String("key", key), logger.ErrAttr(err))
+		return
+	}
+	delete(s.entries, key)
+	s.total -= entry.size
+}
+
+// evict removes the least recently used kvs until the store is under the threshold, the caller holds the lock
+func (s *KvStore) evict() {
+	threshold := int64(s.opts.ThresholdMB * 1024 * 1024)
+	if threshold <= 0 || s.total <= threshold {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		metrics.CacheCleanupSecond.WithLabelValues(metrics.CacheKvDisk).Observe(time.Since(start).Seconds())
+	}()
+	entries := make([]*KvEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+	for _, e := range entries {
+		if s.total <= threshold {
+			return
+		}
+		s.remove(e.Key)
+		metrics.CacheEvictionCounter.WithLabelValues(metrics.CacheKvDisk).Inc()
+	}
+}
+
+func (s *KvStore) encrypt(value string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("generate kv store nonce failed, err: %s", err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+func (s *KvStore) decrypt(value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKvStore(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	if err := InitKvStore(KvStoreOptions{Dir: dir, ThresholdMB: 1, EncryptionKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	s := GetKvStore()
+	if err := s.Set("1_app_a", 1, "md5-a", "string", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("1_app_b", 2, "md5-b", kvTypeSecret, "password"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, kvStoreFileName("1_app_b")))
+	if err != nil || strings.Contains(string(b), "password") {
+		t.Fatalf("secret value should be encrypted on disk, err: %v", err)
+	}
+
+	// reload from disk
+	if err = InitKvStore(KvStoreOptions{Dir: dir, ThresholdMB: 1, EncryptionKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	entry, v, ok := GetKvStore().Get("1_app_b")
+	if !ok || v != "password" || entry.ReleaseID != 2 || entry.Md5 != "md5-b" {
+		t.Fatalf("unexpected secret kv after reload, %v %s", ok, v)
+	}
+
+	// the secret kvs are dropped and refused without the encryption key
+	if err = InitKvStore(KvStoreOptions{Dir: dir, ThresholdMB: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s = GetKvStore()
+	if _, _, ok = s.Get("1_app_b"); ok {
+		t.Fatal("secret kv should be dropped without encryption key")
+	}
+	if err = s.Set("1_app_b", 3, "md5-b", kvTypeSecret, "password"); !errors.Is(err, ErrKvStoreSecret) {
+		t.Fatalf("expect ErrKvStoreSecret, got %v", err)
+	}
+	if _, v, ok = s.Get("1_app_a"); !ok || v != "plain" {
+		t.Fatalf("unexpected kv after reload, %v %s", ok, v)
+	}
+
+	// the least recently used kvs are evicted beyond the threshold
+	big := strings.Repeat("x", 600*1024)
+	if err = s.Set("1_app_c", 1, "md5-c", "string", big); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set("1_app_d", 1, "md5-d", "string", big); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok = s.Get("1_app_c"); ok {
+		t.Fatal("least recently used kv should be evicted")
+	}
+	if _, _, ok = s.Get("1_app_d"); !ok {
+		t.Fatal("latest kv should be kept")
+	}
+}
+
+func TestKvStoreLoadKeepsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	broken := strings.Repeat("a", 64) + kvStoreFileExt
+	files := map[string]bool{
+		"app.conf":   true,
+		"notes.json": true,
+		broken:       false,
+		kvStoreFileName("1_app_a") + ".123" + kvStoreTempExt: false,
+	}
+	for name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := InitKvStore(KvStoreOptions{Dir: dir, ThresholdMB: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the broken kv store files and the temp ones left by the crash are removed
+	for name, kept := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("file %s kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+}
+
+func TestKvStoreSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	// the stores of the processes sharing the dir
+	stores := make([]*KvStore, 2)
+	for i := range stores {
+		stores[i] = &KvStore{opts: KvStoreOptions{Dir: dir, ThresholdMB: 1}, entries: make(map[string]*KvEntry)}
+		if err := stores[i].load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s *KvStore) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := s.Set("1_app_a", uint32(i), "md5", "string", strings.Repeat("v", j)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isKvStoreTempFile(e.Name()) {
+			t.Errorf("unexpected temp file %s", e.Name())
+		}
+	}
+	s := &KvStore{opts: KvStoreOptions{Dir: dir, ThresholdMB: 1}, entries: make(map[string]*KvEntry)}
+	if err = s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, ok := s.Get("1_app_a"); !ok || len(v) != 49 {
+		t.Fatalf("unexpected kv %v %q", ok, v)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// the cache dir may be shared by the processes on the same host, eg. the sidecars of the pods or the nodeman
+// plugins, they are coordinated by the advisory file locks under the cache dir:
+//  1. each cache file is guarded by the lock file of its signature, it is locked shared while being read and
+//     exclusively while being downloaded or removed, so a file is never removed while others are copying it.
+//  2. the contents are downloaded to the work dir of the process and renamed into the cache dir,
+//     so the cache file is never seen partially written.
+//  3. the cleanup is done by the only process which holds the cleanup lock, the others just follow the changes.
+const (
+	// lockDirName is the dir under the cache dir which holds the lock files of the cache files
+	lockDirName = ".locks"
+	// stagingDirName is the dir under the cache dir which holds the work dirs of the processes, the contents are
+	// downloaded to the work dir and moved to the cache dir. the p2p download requires the target dir to be unique
+	// among the concurrent tasks, so the downloads never target the cache dir shared by the processes.
+	stagingDirName = ".staging"
+	// cleanupLockName is the lock file under the cache dir held by the process which cleans up the cache
+	cleanupLockName = ".cleanup.lock"
+	// workLockSuffix is the suffix of the lock file of a work dir, which is held by the process during its lifetime
+	workLockSuffix = ".lock"
+)
+
+// lockEntry acquires the lock of the cache file, it blocks until the lock is acquired
+func (c *Cache) lockEntry(signature string, exclusive bool) (*util.FileLock, error) {
+	lock, err := util.LockFile(filepath.Join(c.path, lockDirName, signature), exclusive)
+	if err != nil {
+		return nil, fmt.Errorf("lock cache file %s failed, err: %s", signature, err.Error())
+	}
+	return lock, nil
+}
+
+// removeEntry removes the cache file if no one is using it, returns false if it is in use
+func (c *Cache) removeEntry(signature string) (bool, error) {
+	lock, err := util.TryLockFile(filepath.Join(c.path, lockDirName, signature), true)
+	if errors.Is(err, util.ErrLocked) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("lock cache file %s failed, err: %s", signature, err.Error())
+	}
+	// the lock file is removed as well, so that the lock files do not pile up
+	defer lock.Remove()
+
+	if err = os.Remove(c.FilePath(signature)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	c.index.remove(signature)
+	return true, nil
+}
+
+// newWorkDir creates the work dir of the process under the staging dir, the work dir is locked until the cache
+// is closed or the process exits, the work dirs left by the exited processes are removed by the cleaner.
+func newWorkDir(cacheDir string) (string, *util.FileLock, error) {
+	stagingDir := filepath.Join(cacheDir, stagingDirName)
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return "", nil, fmt.Errorf("create cache staging dir failed, err: %s", err.Error())
+	}
+	f, err := os.CreateTemp(stagingDir, "*"+workLockSuffix)
+	if err != nil {
+		return "", nil, fmt.Errorf("create cache work dir lock failed, err: %s", err.Error())
+	}
+	_ = f.Close()
+	// the dir is created after the lock is held, so the cleaner never removes the dir in use
+	lock, err := util.LockFile(f.Name(), true)
+	if err != nil {
+		return "", nil, fmt.Errorf("lock cache work dir failed, err: %s", err.Error())
+	}
+	workDir := strings.TrimSuffix(f.Name(), workLockSuffix)
+	if err = os.MkdirAll(workDir, os.ModePerm); err != nil {
+		_ = lock.Remove()
+		return "", nil, fmt.Errorf("create cache work dir failed, err: %s", err.Error())
+	}
+	return workDir, lock, nil
+}
+
+// cleanupWorkDirs removes the work dirs of the exited processes
+func (c *Cache) cleanupWorkDirs() {
+	stagingDir := filepath.Join(c.path, stagingDirName)
+	dirEntries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		logger.Warn("read cache staging dir failed", slog.String("dir", stagingDir), logger.ErrAttr(err))
+		return
+	}
+	for _, de := range dirEntries {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), workLockSuffix) {
+			continue
+		}
+		lock, err := util.TryLockFile(filepath.Join(stagingDir, de.Name()), true)
+		if err != nil {
+			// in use, or removed by the owner just now
+			continue
+		}
+		workDir := filepath.Join(stagingDir, strings.TrimSuffix(de.Name(), workLockSuffix))
+		if err = os.RemoveAll(workDir); err != nil {
+			logger.Warn("remove stale cache work dir failed", slog.String("dir", workDir), logger.ErrAttr(err))
+			_ = lock.Unlock()
+			continue
+		}
+		_ = lock.Remove()
+		logger.Info("removed stale cache work dir", slog.String("dir", workDir))
+	}
+}
+
+// electCleaner tries to become the cleaner of the cache, the cleanup lock is held until the process exits,
+// returns whether the process is the cleaner.
+func (c *Cache) electCleaner() bool {
+	if c.cleanupLock != nil {
+		return true
+	}
+	lock, err := util.TryLockFile(filepath.Join(c.path, cleanupLockName), true)
+	if err != nil {
+		if !errors.Is(err, util.ErrLocked) {
+			logger.Warn("acquire cache cleanup lock failed", logger.ErrAttr(err))
+		}
+		return false
+	}
+	logger.Info("elected as the cleaner of the cache", slog.String("cacheDir", c.path))
+	c.cleanupLock = lock
+	return true
+}
+
+// Close flushes the index and removes the work dir of the process, the cache should not be used after closed
+func (c *Cache) Close() error {
+	if c.workLock == nil {
+		return nil
+	}
+	if err := c.index.save(); err != nil {
+		logger.Warn("save cache index failed", slog.String("dir", c.path), logger.ErrAttr(err))
+	}
+	if err := os.RemoveAll(c.workDir); err != nil {
+		return err
+	}
+	err := c.workLock.Remove()
+	c.workLock = nil
+	return err
+}
@@ -0,0 +1,63 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func openTestCache(t *testing.T, dir string) *Cache {
+	t.Helper()
+	if err := Init(Options{Path: dir, ThresholdGB: 1}); err != nil {
+		t.Fatal(err)
+	}
+	c := GetCache()
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestSharedCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	a := strings.Repeat("a", 64)
+	writeCacheFile(t, dir, a, 10)
+	// two caches on the same dir act as two processes
+	c1, c2 := openTestCache(t, dir), openTestCache(t, dir)
+
+	// the file being read by one is not removed by the other
+	lock, err := c1.lockEntry(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := c2.removeEntry(a); err != nil || removed {
+		t.Fatalf("file in use should not be removed, removed: %v, err: %v", removed, err)
+	}
+	_ = lock.Unlock()
+	if removed, err := c2.removeEntry(a); err != nil || !removed {
+		t.Fatalf("file not in use should be removed, removed: %v, err: %v", removed, err)
+	}
+	if _, err = os.Stat(c2.FilePath(a)); !os.IsNotExist(err) {
+		t.Fatalf("file should be removed, err: %v", err)
+	}
+
+	// only one of them cleans up the cache
+	if !c1.electCleaner() || c2.electCleaner() {
+		t.Fatal("only the first one should be elected as the cleaner")
+	}
+	_ = c1.cleanupLock.Unlock()
+	if !c2.electCleaner() {
+		t.Fatal("the second one should be elected after the first one exits")
+	}
+	_ = c2.cleanupLock.Unlock()
+}
@@ -0,0 +1,215 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+	"github.com/TencentBlueKing/bk-bscp/pkg/tools"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// Stats is the statistics of the file cache
+type Stats struct {
+	// Dir is the cache dir
+	Dir string `json:"dir"`
+	// Size is the total byte size of the cache files
+	Size int64 `json:"size"`
+	// Count is the count of the cache files
+	Count int `json:"count"`
+	// ThresholdBytes is the cleanup threshold in bytes
+	ThresholdBytes int64 `json:"threshold_bytes"`
+	// Hits is the total hit count of the cache
+	Hits uint64 `json:"hits"`
+	// Misses is the total miss count of the cache
+	Misses uint64 `json:"misses"`
+}
+
+// HitRatio returns the hit ratio of the cache, 0 if never accessed
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Stats returns the statistics of the cache
+func (c *Cache) Stats() Stats {
+	c.index.lock.Lock()
+	defer c.index.lock.Unlock()
+
+	return Stats{
+		Dir:            c.path,
+		Size:           c.index.total,
+		Count:          len(c.index.entries),
+		ThresholdBytes: int64(c.thrsholdGB * GByte),
+		Hits:           c.index.hits,
+		Misses:         c.index.misses,
+	}
+}
+
+// Entries returns the index entries of the cache files in the eviction order
+func (c *Cache) Entries() []IndexEntry {
+	return c.index.list(c.opts.EvictionPolicy)
+}
+
+// FilePath returns the path of the cache file of the signature
+func (c *Cache) FilePath(signature string) string {
+	return filepath.Join(c.path, signature)
+}
+
+// Verify re-hashes the cache files and removes the ones whose content does not match the signature,
+// returns the signatures of the removed files.
+func (c *Cache) Verify() ([]string, error) {
+	var corrupted []string
+	for _, entry := range c.index.list(c.opts.EvictionPolicy) {
+		filePath := c.FilePath(entry.Signature)
+		sha, err := tools.FileSHA256(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				c.index.remove(entry.Signature)
+				continue
+			}
+			return corrupted, fmt.Errorf("calculate sha256 of %s failed, err: %s", filePath, err.Error())
+		}
+		if sha == entry.Signature {
+			continue
+		}
+		// the file in use is being replaced by the user, which also re-checks it
+		removed, err := c.removeEntry(entry.Signature)
+		if err != nil {
+			return corrupted, fmt.Errorf("remove corrupted cache file %s failed, err: %s", filePath, err.Error())
+		}
+		if !removed {
+			continue
+		}
+		logger.Warn("removed corrupted cache file", slog.String("file", filePath), slog.String("sha256", sha))
+		corrupted = append(corrupted, entry.Signature)
+	}
+	return corrupted, c.index.save()
+}
+
+// Prune removes the cache files not accessed within the duration if olderThan > 0, then evicts the cache files
+// in the order of the eviction policy until the cache size is not larger than maxSize if maxSize >= 0, the files
+// in use are skipped, returns the count and size of the removed files.
+func (c *Cache) Prune(maxSize int64, olderThan time.Duration) (int, int64, error) {
+	var count int
+	var freed int64
+	if olderThan > 0 {
+		deadline := time.Now().Add(-olderThan)
+		for _, entry := range c.index.list(c.opts.EvictionPolicy) {
+			if entry.LastAccess.After(deadline) {
+				continue
+			}
+			removed, err := c.removeEntry(entry.Signature)
+			if err != nil {
+				return count, freed, fmt.Errorf("remove cache file %s failed, err: %s",
+					c.FilePath(entry.Signature), err.Error())
+			}
+			if !removed {
+				continue
+			}
+			count++
+			freed += entry.Size
+		}
+	}
+	if size := c.index.size(); maxSize >= 0 && size > maxSize {
+		n, f := c.Evict(size - maxSize)
+		count += n
+		freed += f
+	}
+	return count, freed, c.index.save()
+}
+
+// Warm downloads the contents of the config items missing in the cache with the warm-up downloader, it returns
+// after all the downloads are done, the contents which are too large to be cached are skipped.
+func (c *Cache) Warm(cis []*sfs.ConfigItemMetaV1, concurrency int) (int, error) {
+	var lock sync.Mutex
+	var warmed int
+	g := new(errgroup.Group)
+	g.SetLimit(concurrency)
+	for _, ci := range cis {
+		if !c.Cacheable(ci) || c.Has(ci) {
+			continue
+		}
+		ci := ci
+		g.Go(func() error {
+			if err := c.fetch(ci); err != nil {
+				return fmt.Errorf("download %s failed, err: %s",
+					filepath.Join(ci.ConfigItemSpec.Path, ci.ConfigItemSpec.Name), err.Error())
+			}
+			lock.Lock()
+			warmed++
+			lock.Unlock()
+			return nil
+		})
+	}
+	err := g.Wait()
+	if e := c.index.save(); e != nil && err == nil {
+		err = e
+	}
+	return warmed, err
+}
+
+// References walks the dir and maps the signatures of the cache files to the files referencing them, which are
+// the files hard linked to the cache files or of the same content, the cache dir itself is skipped.
+func (c *Cache) References(dir string) (map[string][]string, error) {
+	bySize := make(map[int64][]string)
+	for _, entry := range c.index.list(c.opts.EvictionPolicy) {
+		bySize[entry.Size] = append(bySize[entry.Size], entry.Signature)
+	}
+
+	refs := make(map[string][]string)
+	cacheDir, _ := filepath.Abs(c.path)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if abs, _ := filepath.Abs(path); abs == cacheDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		signatures, ok := bySize[info.Size()]
+		if !ok || !info.Mode().IsRegular() {
+			return nil
+		}
+		// the hard linked file is matched without hashing
+		for _, sig := range signatures {
+			if ci, e := os.Stat(c.FilePath(sig)); e == nil && os.SameFile(ci, info) {
+				refs[sig] = append(refs[sig], path)
+				return nil
+			}
+		}
+		sha, err := tools.FileSHA256(path)
+		if err != nil {
+			return err
+		}
+		for _, sig := range signatures {
+			if sig == sha {
+				refs[sig] = append(refs[sig], path)
+			}
+		}
+		return nil
+	})
+	return refs, err
+}
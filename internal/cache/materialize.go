@@ -0,0 +1,102 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// MaterializeMode is the way to materialize the app files from the cache
+type MaterializeMode string
+
+const (
+	// MaterializeCopy copies the cache files byte by byte
+	MaterializeCopy MaterializeMode = "copy"
+	// MaterializeReflink clones the cache files by reflink (copy-on-write) if the file system supports it,
+	// otherwise copies them
+	MaterializeReflink MaterializeMode = "reflink"
+	// MaterializeHardlink hard links the cache files if they can be shared safely, otherwise clones or copies them
+	MaterializeHardlink MaterializeMode = "hardlink"
+)
+
+// Validate validates the materialize mode
+func (m MaterializeMode) Validate() error {
+	switch m {
+	case MaterializeCopy, MaterializeReflink, MaterializeHardlink:
+		return nil
+	default:
+		return fmt.Errorf("invalid cache materialize mode %s, should be one of copy, reflink, hardlink", m)
+	}
+}
+
+// LinkToFile hard links the config content in the cache to the specified file if the hard link mode is enabled,
+// otherwise or if the cache file can not be shared, it is cloned or copied like CopyToFile.
+// the caller must not modify the content of the file in place, eg. convert the text line break, since it
+// shares the data with the cache and the other files linked to it.
+func (c *Cache) LinkToFile(ci *sfs.ConfigItemMetaV1, filePath string) bool {
+	link := c.opts.Materialize == MaterializeHardlink && runtime.GOOS != "windows"
+	// the permission of the cache file may be changed to link it, which excludes the others
+	cacheFilePath, lock, ok := c.prepare(ci, link)
+	if !ok {
+		return false
+	}
+	defer lock.Unlock()
+	if link && c.linkToFile(ci, cacheFilePath, filePath) {
+		return true
+	}
+	return c.copyToFile(cacheFilePath, filePath)
+}
+
+// linkToFile hard links the cache file to the specified file, the mode and owner of a hard link are shared with
+// the cache file, so the cache file is linked only when it is not linked by others and its permission can be set
+// to the expected one, or it is already of the expected permission. the caller must hold the exclusive lock of
+// the cache file.
+func (c *Cache) linkToFile(ci *sfs.ConfigItemMetaV1, cacheFilePath, filePath string) bool {
+	pm := ci.ConfigItemSpec.Permission
+	nlink, err := util.HardLinkCount(cacheFilePath)
+	if err != nil {
+		logger.Warn("get hard link count of cache file failed", slog.String("file", cacheFilePath),
+			logger.ErrAttr(err))
+		return false
+	}
+	if nlink <= 1 {
+		if err = util.SetFilePermission(cacheFilePath, pm); err != nil {
+			logger.Debug("set permission of cache file failed, skip hard link", slog.String("file", cacheFilePath),
+				logger.ErrAttr(err))
+			return false
+		}
+	} else if matched, e := util.FilePermissionMatched(cacheFilePath, pm); e != nil || !matched {
+		logger.Debug("cache file is shared with different permission, skip hard link",
+			slog.String("file", cacheFilePath))
+		return false
+	}
+
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		logger.Warn("remove file before hard link failed", slog.String("file", filePath), logger.ErrAttr(err))
+		return false
+	}
+	if err = os.Link(cacheFilePath, filePath); err != nil {
+		logger.Debug("hard link cache file failed", slog.String("cache_file", cacheFilePath),
+			slog.String("file", filePath), logger.ErrAttr(err))
+		return false
+	}
+	return true
+}
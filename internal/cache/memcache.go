@@ -14,13 +14,24 @@ package cache
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 var mc *bigcache.BigCache
 
+var (
+	// memCacheSetLock serializes the sets of the in-memory cache, so that the replaced values are counted once
+	memCacheSetLock sync.Mutex
+	// memCacheUsed is the bytes of the keys and values in the in-memory cache
+	memCacheUsed atomic.Int64
+)
+
 // EnableMemCache define whether to enable in-memory cache
 var EnableMemCache bool
 
@@ -43,13 +54,23 @@ func InitMemCache(thresholdMb float64) error {
 		// if value is reached then the oldest entries can be overridden for the new ones
 		// 0 value means no size limit
 		HardMaxCacheSize: int(thresholdMb),
+
+		// the oldest entries are removed when there is no space left
+		OnRemoveWithReason: func(key string, entry []byte, reason bigcache.RemoveReason) {
+			memCacheUsed.Add(-int64(len(key) + len(entry)))
+			if reason != bigcache.Deleted {
+				metrics.CacheEvictionCounter.WithLabelValues(metrics.CacheKv).Inc()
+			}
+		},
 	}
 
 	var err error
+	memCacheUsed.Store(0)
 	mc, err = bigcache.New(context.Background(), config)
 	if err != nil {
 		return err
 	}
+	metrics.CacheThresholdBytes.WithLabelValues(metrics.CacheKv).Set(thresholdMb * 1024 * 1024)
 	return nil
 }
 
@@ -57,3 +78,28 @@ func InitMemCache(thresholdMb float64) error {
 func GetMemCache() *bigcache.BigCache {
 	return mc
 }
+
+// SetMemCache sets the value of the key to the in-memory cache, and counts the used bytes. the value replaced by
+// the set is not reported by the remove callback of bigcache, so it is subtracted here.
+func SetMemCache(key string, value []byte) error {
+	memCacheSetLock.Lock()
+	defer memCacheSetLock.Unlock()
+
+	old, getErr := mc.Get(key)
+	err := mc.Set(key, value)
+	// the replaced value is removed even if the set fails
+	if getErr == nil {
+		memCacheUsed.Add(-int64(len(key) + len(old)))
+	}
+	if err != nil {
+		return err
+	}
+	memCacheUsed.Add(int64(len(key) + len(value)))
+	return nil
+}
+
+// MemCacheUsedBytes returns the bytes of the keys and values in the in-memory cache, which is less than
+// the allocated capacity of bigcache
+func MemCacheUsedBytes() int64 {
+	return memCacheUsed.Load()
+}
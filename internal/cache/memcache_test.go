@@ -0,0 +1,60 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// iterateUsedBytes sums the bytes of the keys and values in the in-memory cache by iterating them
+func iterateUsedBytes() int64 {
+	var used int64
+	it := mc.Iterator()
+	for it.SetNext() {
+		if e, err := it.Value(); err == nil {
+			used += int64(len(e.Key()) + len(e.Value()))
+		}
+	}
+	return used
+}
+
+func TestMemCacheUsedBytes(t *testing.T) {
+	if err := InitMemCache(1); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { EnableMemCache = false }()
+
+	if err := SetMemCache("1_app_a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	// the replaced value is not counted
+	if err := SetMemCache("1_app_a", []byte("longer value")); err != nil {
+		t.Fatal(err)
+	}
+	if used := MemCacheUsedBytes(); used != int64(len("1_app_a")+len("longer value")) {
+		t.Fatalf("unexpected used bytes %d", used)
+	}
+
+	// the evicted values are not counted
+	big := []byte(strings.Repeat("x", 600))
+	for i := 0; i < 5000; i++ {
+		if err := SetMemCache(fmt.Sprintf("1_app_%d", i), big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used, want := MemCacheUsedBytes(), iterateUsedBytes(); used != want {
+		t.Fatalf("used bytes %d, want %d", used, want)
+	}
+}
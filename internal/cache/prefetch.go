@@ -0,0 +1,235 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// prefetchTask is the prefetch of a content
+type prefetchTask struct {
+	ci *sfs.ConfigItemMetaV1
+	// releases is the releases needing the content, the task is dropped if all of them are superseded
+	releases []*prefetchRelease
+	// started is whether the download is started, the task not started yet is taken over by the waiter
+	started bool
+	// taken is whether the task is taken over by the waiter, it will not be started
+	taken bool
+	done  chan struct{}
+}
+
+// prefetchRelease is a release being prefetched, it is superseded by the next release of the same app instance
+type prefetchRelease struct {
+	superseded bool
+}
+
+// needed returns whether any release needing the content is not superseded, must be called with lock held
+func (t *prefetchTask) needed() bool {
+	for _, r := range t.releases {
+		if !r.superseded {
+			return true
+		}
+	}
+	return false
+}
+
+// prefetcher downloads the contents of the published releases to the cache in the background, so that the
+// release change callbacks mostly hit the cache, even if they are delayed to apply the release later.
+// the downloads are limited by the warm-up bandwidth limit, and run by at most concurrency workers which pull
+// the tasks from the queue in order.
+type prefetcher struct {
+	// concurrency is the max workers, 0 means prefetch is disabled
+	concurrency int
+	lock        sync.Mutex
+	workers     int
+	queue       []*prefetchTask
+	tasks       map[string]*prefetchTask
+	// releases is the latest release being prefetched of each app instance
+	releases map[string]*prefetchRelease
+}
+
+func newPrefetcher(concurrency int) *prefetcher {
+	return &prefetcher{
+		concurrency: max(concurrency, 0),
+		tasks:       make(map[string]*prefetchTask),
+		releases:    make(map[string]*prefetchRelease),
+	}
+}
+
+// Prefetch downloads the contents of the config items missing in the cache in the background. the key identifies
+// the app instance which the release is published to, the queued tasks of its previous release are dropped
+// unless the contents are needed by the newer releases.
+func (c *Cache) Prefetch(key string, cis []*sfs.ConfigItemMetaV1) {
+	p := c.prefetcher
+	if p.concurrency == 0 {
+		return
+	}
+
+	missing := make([]*sfs.ConfigItemMetaV1, 0, len(cis))
+	for _, ci := range cis {
+		if c.Cacheable(ci) && !c.Has(ci) {
+			missing = append(missing, ci)
+		}
+	}
+	p.add(key, missing)
+	for p.spawn() {
+		go c.prefetchWorker()
+	}
+}
+
+// prefetchWorker downloads the queued contents until the queue is empty
+func (c *Cache) prefetchWorker() {
+	p := c.prefetcher
+	for {
+		task, ok := p.next()
+		if !ok {
+			return
+		}
+		if task != nil {
+			c.prefetch(task)
+		}
+	}
+}
+
+// prefetch downloads the content to the staging dir and moves it to the cache dir
+func (c *Cache) prefetch(task *prefetchTask) {
+	ci := task.ci
+	signature := ci.ContentSpec.Signature
+	defer c.prefetcher.finish(signature, task)
+
+	if err := c.fetch(ci); err != nil {
+		logger.Warn("prefetch file failed", slog.String("signature", signature), logger.ErrAttr(err))
+		return
+	}
+	logger.Info("prefetch file success", slog.String("signature", signature),
+		slog.String("file", filepath.Join(ci.ConfigItemSpec.Path, ci.ConfigItemSpec.Name)))
+}
+
+// fetch downloads the content to the cache with the warm-up downloader if it is not in the cache yet
+func (c *Cache) fetch(ci *sfs.ConfigItemMetaV1) error {
+	lock, err := c.lockEntry(ci.ContentSpec.Signature, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// the content may be downloaded by others while waiting for the lock
+	exists, err := c.checkFileCacheExists(ci)
+	if err != nil || exists {
+		return err
+	}
+	// the broken cache file may be hard linked by the app files, remove it rather than overwrite it
+	if err = os.Remove(c.FilePath(ci.ContentSpec.Signature)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove broken cache file failed, err: %s", err.Error())
+	}
+	return c.download(downloader.GetWarmupDownloader(), ci)
+}
+
+// add supersedes the previous release of the key, and queues the prefetch tasks of the contents, the contents
+// being prefetched already are marked needed by the release instead
+func (p *prefetcher) add(key string, cis []*sfs.ConfigItemMetaV1) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if prev, ok := p.releases[key]; ok {
+		prev.superseded = true
+	}
+	release := new(prefetchRelease)
+	p.releases[key] = release
+	for _, ci := range cis {
+		if task, ok := p.tasks[ci.ContentSpec.Signature]; ok {
+			task.releases = append(task.releases, release)
+			continue
+		}
+		task := &prefetchTask{ci: ci, releases: []*prefetchRelease{release}, done: make(chan struct{})}
+		p.tasks[ci.ContentSpec.Signature] = task
+		p.queue = append(p.queue, task)
+	}
+}
+
+// spawn reserves a worker if there are queued tasks and the workers are not enough, returns whether reserved
+func (p *prefetcher) spawn() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.workers >= p.concurrency || p.workers >= len(p.queue) {
+		return false
+	}
+	p.workers++
+	return true
+}
+
+// next pops the next task from the queue and marks it started, the task taken over by the waiter or not needed
+// by any release is skipped with nil returned. it returns false and releases the worker if the queue is empty.
+func (p *prefetcher) next() (*prefetchTask, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.queue) == 0 {
+		p.workers--
+		return nil, false
+	}
+	task := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	if task.taken {
+		return nil, true
+	}
+	if !task.needed() {
+		logger.Debug("drop the prefetch of the superseded release",
+			slog.String("signature", task.ci.ContentSpec.Signature))
+		delete(p.tasks, task.ci.ContentSpec.Signature)
+		close(task.done)
+		return nil, true
+	}
+	task.started = true
+	return task, true
+}
+
+func (p *prefetcher) finish(signature string, task *prefetchTask) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.tasks[signature] == task {
+		delete(p.tasks, signature)
+	}
+	close(task.done)
+}
+
+// wait waits for the prefetch of the content if it is downloading, returns whether it waited. the task which is
+// not started yet is taken over, the caller downloads the content by itself rather than waiting in the queue.
+func (p *prefetcher) wait(signature string) bool {
+	p.lock.Lock()
+	task, ok := p.tasks[signature]
+	started := ok && task.started
+	if ok && !started {
+		task.taken = true
+		delete(p.tasks, signature)
+	}
+	p.lock.Unlock()
+
+	if !started {
+		return false
+	}
+	<-task.done
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"strings"
+	"testing"
+
+	pbcontent "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/content"
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+)
+
+func testPrefetchCIs(signatures ...string) []*sfs.ConfigItemMetaV1 {
+	cis := make([]*sfs.ConfigItemMetaV1, 0, len(signatures))
+	for _, sig := range signatures {
+		cis = append(cis, &sfs.ConfigItemMetaV1{ContentSpec: &pbcontent.ContentSpec{Signature: sig}})
+	}
+	return cis
+}
+
+func TestPrefetcherBoundedWorkers(t *testing.T) {
+	p := newPrefetcher(2)
+	p.add("app/uid", testPrefetchCIs(strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)))
+
+	spawned := 0
+	for p.spawn() {
+		spawned++
+	}
+	if spawned != 2 {
+		t.Fatalf("expect 2 workers spawned, got %d", spawned)
+	}
+	// the workers pull the tasks in order and exit once the queue is empty
+	for _, want := range []string{"a", "b", "c"} {
+		task, ok := p.next()
+		if !ok || task == nil || task.ci.ContentSpec.Signature != strings.Repeat(want, 64) {
+			t.Fatalf("expect the task of %s, got %v", want, task)
+		}
+		p.finish(task.ci.ContentSpec.Signature, task)
+	}
+	for i := 0; i < spawned; i++ {
+		if _, ok := p.next(); ok {
+			t.Fatal("expect the worker released on the empty queue")
+		}
+	}
+	if p.workers != 0 || len(p.tasks) != 0 {
+		t.Fatalf("expect no workers and tasks left, got %d workers, %d tasks", p.workers, len(p.tasks))
+	}
+}
+
+func TestPrefetcherDropSupersededRelease(t *testing.T) {
+	a, b, c := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	p := newPrefetcher(1)
+	p.add("app/uid", testPrefetchCIs(a, b))
+	p.add("other/uid", testPrefetchCIs(c))
+	// the newer release of the same instance shares the second content only
+	p.add("app/uid", testPrefetchCIs(b))
+
+	if !p.spawn() {
+		t.Fatal("expect a worker spawned")
+	}
+	var fetched []string
+	for {
+		task, ok := p.next()
+		if !ok {
+			break
+		}
+		if task == nil {
+			continue
+		}
+		fetched = append(fetched, task.ci.ContentSpec.Signature)
+		p.finish(task.ci.ContentSpec.Signature, task)
+	}
+	if len(fetched) != 2 || fetched[0] != b || fetched[1] != c {
+		t.Fatalf("expect the contents of the latest releases fetched, got %v", fetched)
+	}
+	if _, ok := p.tasks[a]; ok {
+		t.Fatal("expect the task of the superseded release dropped")
+	}
+}
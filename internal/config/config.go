@@ -14,11 +14,13 @@
 package config
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	// for unmarshal yaml config file
@@ -58,6 +60,8 @@ type ClientConfig struct {
 	ConfigMatches []string `json:"config_matches" mapstructure:"config_matches"`
 	// Port sidecar http server port
 	Port int `json:"port" mapstructure:"port"`
+	// AdminPort http port listened on 127.0.0.1 to adjust the runtime config, 0 means disabled
+	AdminPort int `json:"admin_port" mapstructure:"admin_port"`
 	// EnableP2PDownload enable p2p download file
 	EnableP2PDownload bool `json:"enable_p2p_download" mapstructure:"enable_p2p_download"`
 	// BkAgentID bk gse agent id
@@ -76,6 +80,20 @@ type ClientConfig struct {
 	EnableMonitorResourceUsage bool `json:"enable_resource" mapstructure:"enable_resource"`
 	// TextLineBreak 文本文件换行符
 	TextLineBreak string `json:"text_line_break" mapstructure:"text_line_break"`
+	// EventRetention 服务目录下 metadata.json、changeevent.json 保留的事件数
+	EventRetention int `json:"event_retention" mapstructure:"event_retention"`
+	// ReleaseHistory 服务目录下保留用于回滚的版本快照数，0 为默认值，负数为不保留
+	ReleaseHistory int `json:"release_history" mapstructure:"release_history"`
+	// Bounce upstream bounce config
+	Bounce *BounceConfig `json:"bounce" mapstructure:"bounce"`
+	// BandwidthLimit download bandwidth limit config
+	BandwidthLimit *BandwidthLimitConfig `json:"bandwidth_limit" mapstructure:"bandwidth_limit"`
+	// RangeDownload adaptive range download config
+	RangeDownload *RangeDownloadConfig `json:"range_download" mapstructure:"range_download"`
+	// P2PDownload async p2p download config
+	P2PDownload *P2PDownloadConfig `json:"p2p_download" mapstructure:"p2p_download"`
+	// HookTimeout pre and post hook timeout config
+	HookTimeout *HookTimeoutConfig `json:"hook_timeout" mapstructure:"hook_timeout"`
 }
 
 // String get config string
@@ -236,6 +254,20 @@ func (c *ClientConfig) ValidateBase() error {
 	if c.Port == 0 {
 		c.Port = constant.DefaultHttpPort
 	}
+	if c.AdminPort < 0 || (c.AdminPort != 0 && c.AdminPort == c.Port) {
+		return fmt.Errorf("invalid admin_port %d, should not be negative or the same as port", c.AdminPort)
+	}
+	if c.EventRetention < 0 {
+		return fmt.Errorf("invalid event_retention %d, should not be negative", c.EventRetention)
+	}
+	if c.EventRetention == 0 {
+		c.EventRetention = constant.DefaultEventRetention
+	}
+	if c.ReleaseHistory == 0 {
+		c.ReleaseHistory = constant.DefaultReleaseHistory
+	} else if c.ReleaseHistory < 0 {
+		c.ReleaseHistory = 0
+	}
 	if c.EnableP2PDownload {
 		if c.BkAgentID == "" && (c.ClusterID == "" || c.PodID == "" || c.ContainerName == "") {
 			return errors.New("to enable p2p download, either agent id must be set or cluster id, " +
@@ -254,6 +286,33 @@ func (c *ClientConfig) ValidateBase() error {
 	if err := c.KvCache.Validate(); err != nil {
 		return err
 	}
+	if c.Bounce == nil {
+		c.Bounce = new(BounceConfig)
+	}
+	if err := c.Bounce.Validate(); err != nil {
+		return err
+	}
+	if c.BandwidthLimit == nil {
+		c.BandwidthLimit = new(BandwidthLimitConfig)
+	}
+	if err := c.BandwidthLimit.Validate(); err != nil {
+		return err
+	}
+	if c.RangeDownload == nil {
+		c.RangeDownload = new(RangeDownloadConfig)
+	}
+	if err := c.RangeDownload.Validate(); err != nil {
+		return err
+	}
+	if c.P2PDownload == nil {
+		c.P2PDownload = new(P2PDownloadConfig)
+	}
+	if err := c.P2PDownload.Validate(); err != nil {
+		return err
+	}
+	if c.HookTimeout == nil {
+		c.HookTimeout = new(HookTimeoutConfig)
+	}
 
 	return nil
 }
@@ -305,12 +364,18 @@ type FileCacheConfig struct {
 	Enabled bool `json:"enabled" mapstructure:"enabled"`
 	// CacheDir is file cache dir
 	CacheDir string `json:"cache_dir" mapstructure:"cache_dir"`
-	// cleanupIntervalSeconds is interval seconds of cleanup, not exposed for configuration now, use default value
-	CleanupIntervalSeconds int64 `json:"-" mapstructure:"-"`
+	// CleanupIntervalSeconds is interval seconds of cleanup
+	CleanupIntervalSeconds int64 `json:"cleanup_interval_seconds" mapstructure:"cleanup_interval_seconds"`
 	// ThresholdGB is threshold gigabyte of cleanup
 	ThresholdGB float64 `json:"threshold_gb" mapstructure:"threshold_gb"`
-	// retentionRate is retention rate of cleanup, not exposed for configuration now, use default value
-	RetentionRate float64 `json:"-" mapstructure:"-"`
+	// RetentionRate is the rate of the threshold retained after cleanup
+	RetentionRate float64 `json:"retention_rate" mapstructure:"retention_rate"`
+	// EvictionPolicy is the policy to choose the files to evict, one of lru, lfu
+	EvictionPolicy string `json:"eviction_policy" mapstructure:"eviction_policy"`
+	// Materialize is the way to materialize the app files from the cache, one of copy, reflink, hardlink
+	Materialize string `json:"materialize" mapstructure:"materialize"`
+	// PrefetchConcurrency is the max concurrent prefetch downloads when watching, 0 means disabled
+	PrefetchConcurrency int `json:"prefetch_concurrency" mapstructure:"prefetch_concurrency"`
 }
 
 // Validate validates the file cache config
@@ -327,6 +392,24 @@ func (c *FileCacheConfig) Validate() error {
 	if c.RetentionRate <= 0 || c.RetentionRate > 1 {
 		c.RetentionRate = constant.DefaultCacheRetentionRate
 	}
+	if c.EvictionPolicy == "" {
+		c.EvictionPolicy = constant.DefaultCacheEvictionPolicy
+	}
+	if c.EvictionPolicy != "lru" && c.EvictionPolicy != "lfu" {
+		return fmt.Errorf("invalid file cache eviction policy %s, should be one of lru, lfu", c.EvictionPolicy)
+	}
+	if c.Materialize == "" {
+		c.Materialize = constant.DefaultCacheMaterialize
+	}
+	switch c.Materialize {
+	case "copy", "reflink", "hardlink":
+	default:
+		return fmt.Errorf("invalid file cache materialize mode %s, should be one of copy, reflink, hardlink",
+			c.Materialize)
+	}
+	if c.PrefetchConcurrency < 0 {
+		return fmt.Errorf("file cache prefetch_concurrency %d is invalid, should >= 0", c.PrefetchConcurrency)
+	}
 	return nil
 }
 
@@ -336,6 +419,18 @@ type KvCacheConfig struct {
 	Enabled bool `json:"enabled" mapstructure:"enabled"`
 	// ThresholdMB is threshold megabyte of kv cache
 	ThresholdMB float64 `json:"threshold_mb" mapstructure:"threshold_mb"`
+	// DiskEnabled is whether enable the on-disk kv cache
+	DiskEnabled bool `json:"disk_enabled" mapstructure:"disk_enabled"`
+	// DiskDir is the dir of the on-disk kv cache
+	DiskDir string `json:"disk_dir" mapstructure:"disk_dir"`
+	// DiskThresholdMB is threshold megabyte of the on-disk kv cache
+	DiskThresholdMB float64 `json:"disk_threshold_mb" mapstructure:"disk_threshold_mb"`
+	// EncryptionKeyFile is the file of the hex encoded 32 bytes key to encrypt the secret kvs on disk
+	EncryptionKeyFile string `json:"encryption_key_file" mapstructure:"encryption_key_file"`
+	// EncryptionKey is the key read from the encryption key file
+	EncryptionKey []byte `json:"-" mapstructure:"-"`
+	// MaxStalenessSeconds is the max seconds since the cached kv was verified, 0 means unlimited
+	MaxStalenessSeconds int64 `json:"max_staleness_seconds" mapstructure:"max_staleness_seconds"`
 }
 
 // Validate validates the kv cache config
@@ -343,5 +438,168 @@ func (c *KvCacheConfig) Validate() error {
 	if c.ThresholdMB <= 0 {
 		c.ThresholdMB = constant.DefaultKvCacheThresholdMB
 	}
+	if c.DiskDir == "" {
+		c.DiskDir = constant.DefaultKvDiskCacheDir
+	}
+	if c.DiskThresholdMB <= 0 {
+		c.DiskThresholdMB = constant.DefaultKvDiskCacheThresholdMB
+	}
+	if c.MaxStalenessSeconds < 0 {
+		return fmt.Errorf("kv_cache max_staleness_seconds %d is invalid, should >= 0", c.MaxStalenessSeconds)
+	}
+	if c.EncryptionKeyFile != "" {
+		b, err := os.ReadFile(c.EncryptionKeyFile)
+		if err != nil {
+			return fmt.Errorf("read kv cache encryption key file failed, err: %s", err.Error())
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("kv cache encryption key should be hex encoded 32 bytes")
+		}
+		c.EncryptionKey = key
+	}
+	return nil
+}
+
+// BounceConfig config for periodic upstream rebalancing
+type BounceConfig struct {
+	// Enabled is whether enable periodic reconnecting to another feed server
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// IntervalSeconds is interval seconds of rebalancing, 0 means use the server suggested one
+	IntervalSeconds int64 `json:"interval_seconds" mapstructure:"interval_seconds"`
+	// JitterSeconds is the max random seconds added to each interval
+	JitterSeconds int64 `json:"jitter_seconds" mapstructure:"jitter_seconds"`
+}
+
+// Validate validates the bounce config
+func (c *BounceConfig) Validate() error {
+	if c.IntervalSeconds < 0 {
+		return fmt.Errorf("bounce interval_seconds %d is invalid, should >= 0", c.IntervalSeconds)
+	}
+	if c.JitterSeconds < 0 {
+		return fmt.Errorf("bounce jitter_seconds %d is invalid, should >= 0", c.JitterSeconds)
+	}
+	return nil
+}
+
+// RangeDownloadConfig config for adaptive range download
+type RangeDownloadConfig struct {
+	// MaxPartBytes is the max size of a range part, 0 means the default value
+	MaxPartBytes uint64 `json:"max_part_bytes" mapstructure:"max_part_bytes"`
+	// MaxConcurrency is the max concurrent range parts, 0 means the max http download goroutines
+	MaxConcurrency int64 `json:"max_concurrency" mapstructure:"max_concurrency"`
+	// WaitTimeMs is the delay before downloading, 0 means use the server suggested one, negative means no delay
+	WaitTimeMs int64 `json:"wait_time_ms" mapstructure:"wait_time_ms"`
+}
+
+// Validate validates the range download config
+func (c *RangeDownloadConfig) Validate() error {
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("range_download max_concurrency %d is invalid, should >= 0", c.MaxConcurrency)
+	}
+	return nil
+}
+
+// P2PDownloadConfig config for async p2p download, 0 means the default value
+type P2PDownloadConfig struct {
+	// MinFileBytes is the min size of the file downloaded via p2p
+	MinFileBytes uint64 `json:"min_file_bytes" mapstructure:"min_file_bytes"`
+	// TimeoutSeconds is the max seconds waiting for a p2p download task
+	TimeoutSeconds int64 `json:"timeout_seconds" mapstructure:"timeout_seconds"`
+	// PollIntervalSeconds is the initial interval seconds of polling the task status
+	PollIntervalSeconds int64 `json:"poll_interval_seconds" mapstructure:"poll_interval_seconds"`
+	// MaxPollIntervalSeconds is the max interval seconds of polling the task status
+	MaxPollIntervalSeconds int64 `json:"max_poll_interval_seconds" mapstructure:"max_poll_interval_seconds"`
+}
+
+// Validate validates the p2p download config
+func (c *P2PDownloadConfig) Validate() error {
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("p2p_download timeout_seconds %d is invalid, should >= 0", c.TimeoutSeconds)
+	}
+	if c.PollIntervalSeconds < 0 {
+		return fmt.Errorf("p2p_download poll_interval_seconds %d is invalid, should >= 0", c.PollIntervalSeconds)
+	}
+	if c.MaxPollIntervalSeconds < 0 {
+		return fmt.Errorf("p2p_download max_poll_interval_seconds %d is invalid, should >= 0",
+			c.MaxPollIntervalSeconds)
+	}
+	return nil
+}
+
+// HookTimeoutConfig config for the timeouts of the hooks, 0 means the default value, negative means no timeout
+type HookTimeoutConfig struct {
+	// PreHookSeconds is the timeout seconds of the pre hook
+	PreHookSeconds int64 `json:"pre_hook_seconds" mapstructure:"pre_hook_seconds"`
+	// PostHookSeconds is the timeout seconds of the post hook
+	PostHookSeconds int64 `json:"post_hook_seconds" mapstructure:"post_hook_seconds"`
+}
+
+// PreHook returns the timeout of the pre hook, 0 means no timeout
+func (c *HookTimeoutConfig) PreHook() time.Duration {
+	return hookTimeout(c.PreHookSeconds)
+}
+
+// PostHook returns the timeout of the post hook, 0 means no timeout
+func (c *HookTimeoutConfig) PostHook() time.Duration {
+	return hookTimeout(c.PostHookSeconds)
+}
+
+func hookTimeout(seconds int64) time.Duration {
+	if seconds == 0 {
+		seconds = constant.DefaultHookTimeoutSeconds
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// BandwidthLimitConfig config for download bandwidth limit
+type BandwidthLimitConfig struct {
+	// BytesPerSecond is the bandwidth limit of all the downloads, 0 means unlimited
+	BytesPerSecond int64 `json:"bytes_per_second" mapstructure:"bytes_per_second"`
+	// BurstBytes is the max bytes allowed to be downloaded at once, 0 means the same as the limit per second
+	BurstBytes int64 `json:"burst_bytes" mapstructure:"burst_bytes"`
+	// WarmupBytesPerSecond is the bandwidth limit of the cache warm-up downloads, 0 means unlimited
+	WarmupBytesPerSecond int64 `json:"warmup_bytes_per_second" mapstructure:"warmup_bytes_per_second"`
+	// Schedules overrides the bandwidth limit in the specified time range of the day
+	Schedules []*BandwidthScheduleConfig `json:"schedules" mapstructure:"schedules"`
+}
+
+// BandwidthScheduleConfig config for download bandwidth limit in a time range of the day
+type BandwidthScheduleConfig struct {
+	// Start is the begin clock of the time range, formatted as 15:04
+	Start string `json:"start" mapstructure:"start"`
+	// End is the end clock of the time range, formatted as 15:04
+	End string `json:"end" mapstructure:"end"`
+	// BytesPerSecond is the bandwidth limit in the time range, 0 means unlimited
+	BytesPerSecond int64 `json:"bytes_per_second" mapstructure:"bytes_per_second"`
+}
+
+// Validate validates the bandwidth limit config
+func (c *BandwidthLimitConfig) Validate() error {
+	if c.BytesPerSecond < 0 {
+		return fmt.Errorf("bandwidth_limit bytes_per_second %d is invalid, should >= 0", c.BytesPerSecond)
+	}
+	if c.BurstBytes < 0 {
+		return fmt.Errorf("bandwidth_limit burst_bytes %d is invalid, should >= 0", c.BurstBytes)
+	}
+	if c.WarmupBytesPerSecond < 0 {
+		return fmt.Errorf("bandwidth_limit warmup_bytes_per_second %d is invalid, should >= 0",
+			c.WarmupBytesPerSecond)
+	}
+	for _, s := range c.Schedules {
+		if _, err := util.ParseClock(s.Start); err != nil {
+			return fmt.Errorf("bandwidth_limit schedule start is invalid, %s", err.Error())
+		}
+		if _, err := util.ParseClock(s.End); err != nil {
+			return fmt.Errorf("bandwidth_limit schedule end is invalid, %s", err.Error())
+		}
+		if s.BytesPerSecond < 0 {
+			return fmt.Errorf("bandwidth_limit schedule bytes_per_second %d is invalid, should >= 0",
+				s.BytesPerSecond)
+		}
+	}
 	return nil
 }
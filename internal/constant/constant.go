@@ -36,6 +36,11 @@ const (
 	// DefaultCacheRetentionRate is the bscp cli default file cache retention rate, which is 90%
 	// !important: promise of compatibility
 	DefaultCacheRetentionRate = 0.9
+	// DefaultCacheEvictionPolicy is the bscp cli default file cache eviction policy, which is lru
+	// !important: promise of compatibility
+	DefaultCacheEvictionPolicy = "lru"
+	// DefaultCacheMaterialize is the bscp cli default way to materialize the app files from the file cache
+	DefaultCacheMaterialize = "copy"
 
 	// DefaultKvCacheEnabled is the bscp cli default kv cache switch.
 	// !important: promise of compatibility
@@ -43,6 +48,31 @@ const (
 	// DefaultKvCacheThresholdMB is the bscp cli default file cache threshold, which is 500MB
 	// !important: promise of compatibility
 	DefaultKvCacheThresholdMB = 500
+	// DefaultKvDiskCacheDir is the bscp cli default on-disk kv cache dir.
+	DefaultKvDiskCacheDir = "/data/bscp/kv-cache"
+	// DefaultKvDiskCacheThresholdMB is the bscp cli default on-disk kv cache threshold, which is 100MB
+	DefaultKvDiskCacheThresholdMB = 100
+
+	// DefaultBounceEnabled is the bscp cli default upstream bounce switch.
+	// !important: promise of compatibility
+	DefaultBounceEnabled = false
+	// DefaultBounceIntervalSeconds is the bscp cli default upstream bounce interval, 0 means use the server
+	// suggested one
+	// !important: promise of compatibility
+	DefaultBounceIntervalSeconds = 0
+	// DefaultBounceJitterSeconds is the bscp cli default upstream bounce random jitter, which is 5 minutes
+	// !important: promise of compatibility
+	DefaultBounceJitterSeconds = 300
+
+	// DefaultEventRetention is the bscp cli default count of the events retained in metadata.json and
+	// changeevent.json
+	DefaultEventRetention = 100
+
+	// DefaultReleaseHistory is the bscp cli default count of the release snapshots kept for rollback
+	DefaultReleaseHistory = 5
+
+	// DefaultHookTimeoutSeconds is the bscp cli default timeout seconds of the pre and post hooks
+	DefaultHookTimeoutSeconds = 600
 
 	// DefaultHttpPort is the bscp sidecar default http port.
 	// !important: promise of compatibility
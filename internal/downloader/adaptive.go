@@ -0,0 +1,225 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// minRangePartBytes is the min size of a range part.
+	minRangePartBytes = defaultSwapBufferSize
+	// defaultMaxRangePartBytes is the default max size of a range part.
+	defaultMaxRangePartBytes = 8 * defaultRangeDownloadByteSize
+	// targetRangePartDuration is the expected time cost of downloading a range part, the part size is
+	// adjusted to make each part takes about this time with the measured throughput.
+	targetRangePartDuration = 5 * time.Second
+	// throughputSmoothing is the weight of the latest sample of the throughput moving average.
+	throughputSmoothing = 0.3
+)
+
+// tuner adapts the range part size and concurrency of all the range downloads in the process.
+var tuner = newRangeTuner()
+
+// RangeDownload defines the upper bounds of the adaptive range download and the traffic control delay.
+type RangeDownload struct {
+	// MaxPartBytes is the max size of a range part, 0 means the default value.
+	MaxPartBytes uint64
+	// MaxConcurrency is the max concurrent range parts of the process, 0 means the max http download goroutines.
+	MaxConcurrency int64
+	// WaitTimeMil is the delay in milliseconds before downloading, it is used for traffic control to avoid
+	// the file storage service overload. 0 means use the value suggested by server, negative means no delay.
+	WaitTimeMil int64
+}
+
+// SetRangeDownload sets the range download options of the process, it takes effect on the parts which are
+// not started yet.
+func SetRangeDownload(r RangeDownload) {
+	tuner.setBounds(r)
+}
+
+// rangeTuner adapts the part size by the measured throughput, and the concurrency in AIMD style:
+// the concurrency increases by one after about a window of parts succeed, and halves when a part failed.
+type rangeTuner struct {
+	lock sync.Mutex
+	// bounds is the options set by user, defaultConcurrency is used when the max concurrency is not set
+	bounds             RangeDownload
+	defaultConcurrency int64
+	// maxPartBytes, maxConcurrency and waitTimeMil are the bounds applied
+	maxPartBytes   uint64
+	maxConcurrency float64
+	waitTimeMil    int64
+	// partBytes is the size of the next part
+	partBytes uint64
+	// concurrency is the current window of concurrent parts
+	concurrency float64
+	inflight    int
+	// throughput is the moving average of the throughput of a single part, in bytes per second
+	throughput float64
+	// released notifies the waiters when a part is released or the window is enlarged
+	released chan struct{}
+}
+
+// newRangeTuner returns a tuner whose initial part size is the same as the fixed one before.
+func newRangeTuner() *rangeTuner {
+	t := &rangeTuner{released: make(chan struct{}), defaultConcurrency: defaultDownloadGroutines}
+	t.setBounds(RangeDownload{})
+	t.partBytes = 2 * defaultRangeDownloadByteSize
+	return t
+}
+
+// setBounds resets the upper bounds and clamps the current state into them.
+func (t *rangeTuner) setBounds(r RangeDownload) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.bounds = r
+	t.maxPartBytes = r.MaxPartBytes
+	if t.maxPartBytes == 0 {
+		t.maxPartBytes = defaultMaxRangePartBytes
+	}
+	if t.maxPartBytes < minRangePartBytes {
+		t.maxPartBytes = minRangePartBytes
+	}
+	t.maxConcurrency = float64(r.MaxConcurrency)
+	if t.maxConcurrency <= 0 {
+		t.maxConcurrency = float64(t.defaultConcurrency)
+	}
+	t.waitTimeMil = r.WaitTimeMil
+
+	if t.partBytes > t.maxPartBytes {
+		t.partBytes = t.maxPartBytes
+	}
+	if t.concurrency == 0 || t.concurrency > t.maxConcurrency {
+		// start from the half of the max concurrency, and probe upward
+		t.concurrency = math.Ceil(t.maxConcurrency / 2)
+	}
+	t.notify()
+}
+
+// setDefaultConcurrency sets the max concurrency used when it is not set by user.
+func (t *rangeTuner) setDefaultConcurrency(n int64) {
+	t.lock.Lock()
+	t.defaultConcurrency = n
+	bounds := t.bounds
+	t.lock.Unlock()
+
+	t.setBounds(bounds)
+}
+
+// waitTime returns the delay before downloading with the value suggested by server.
+func (t *rangeTuner) waitTime(suggestedMil int64) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.waitTimeMil < 0 {
+		return 0
+	}
+	if t.waitTimeMil > 0 {
+		return t.waitTimeMil
+	}
+	return suggestedMil
+}
+
+// partSize returns the size of the next part.
+func (t *rangeTuner) partSize() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.partBytes
+}
+
+// acquire blocks until the concurrent parts is less than the current window.
+func (t *rangeTuner) acquire(ctx context.Context) error {
+	for {
+		t.lock.Lock()
+		if t.inflight < int(t.concurrency) {
+			t.inflight++
+			t.lock.Unlock()
+			return nil
+		}
+		released := t.released
+		t.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// release releases a part acquired before.
+func (t *rangeTuner) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.inflight--
+	t.notify()
+}
+
+// notify wakes up all the waiters, must be called with lock held.
+func (t *rangeTuner) notify() {
+	close(t.released)
+	t.released = make(chan struct{})
+}
+
+// observe adjusts the part size and concurrency with the result of a part.
+func (t *rangeTuner) observe(size uint64, cost time.Duration, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err != nil {
+		// multiplicative decrease
+		t.concurrency = math.Max(1, math.Floor(t.concurrency/2))
+		t.partBytes = clampPartBytes(t.partBytes/2, t.maxPartBytes)
+		logger.Debug("range download failed, shrink the part size and concurrency",
+			slog.Uint64("part_bytes", t.partBytes), slog.Float64("concurrency", t.concurrency))
+		return
+	}
+
+	if cost <= 0 {
+		return
+	}
+	sample := float64(size) / cost.Seconds()
+	if t.throughput == 0 {
+		t.throughput = sample
+	} else {
+		t.throughput = throughputSmoothing*sample + (1-throughputSmoothing)*t.throughput
+	}
+	t.partBytes = clampPartBytes(uint64(t.throughput*targetRangePartDuration.Seconds()), t.maxPartBytes)
+
+	// additive increase, about one more part after a whole window succeed
+	before := int(t.concurrency)
+	t.concurrency = math.Min(t.maxConcurrency, t.concurrency+1/t.concurrency)
+	if int(t.concurrency) > before {
+		t.notify()
+	}
+}
+
+// clampPartBytes clamps the part size into [minRangePartBytes, max].
+func clampPartBytes(size, max uint64) uint64 {
+	if size < minRangePartBytes {
+		return minRangePartBytes
+	}
+	if size > max {
+		return max
+	}
+	return size
+}
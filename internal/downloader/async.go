@@ -14,11 +14,12 @@
 package downloader
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -29,13 +30,183 @@ import (
 
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
 	defaultAsyncDownloadByteSize             = 2 * 1024 * 1024
 	defaultAsyncDownloadPollingStateInterval = 5 * time.Second
+	defaultAsyncDownloadMaxPollingInterval   = 30 * time.Second
+	defaultAsyncDownloadTimeout              = 10 * time.Minute
+	// maxAsyncStatusErrorCount is the max consecutive times of failing to get the task status
+	maxAsyncStatusErrorCount = 3
+	// maxAsyncFallbackRecords is the max fallback records kept for the release report
+	maxAsyncFallbackRecords = 1000
 )
 
+// the reasons why the async download falls back to http download.
+const (
+	fallbackSubmitFailed   = "submit_failed"
+	fallbackStatusFailed   = "status_failed"
+	fallbackTaskFailed     = "task_failed"
+	fallbackTimeout        = "timeout"
+	fallbackCancelled      = "cancelled"
+	fallbackMoveFailed     = "move_failed"
+	fallbackChecksumFailed = "checksum_failed"
+)
+
+// AsyncDownload defines the options of the async p2p download.
+type AsyncDownload struct {
+	// MinFileBytes is the min size of the file downloaded via p2p, 0 means the default value.
+	MinFileBytes uint64
+	// Timeout is the max time waiting for a task since it is submitted, 0 means the default value.
+	Timeout time.Duration
+	// PollInterval is the initial interval of polling the task status, 0 means the default value.
+	PollInterval time.Duration
+	// MaxPollInterval is the max interval of polling the task status, the interval doubles each time
+	// no task makes progress, 0 means the default value.
+	MaxPollInterval time.Duration
+}
+
+var (
+	asyncOptionsLock sync.RWMutex
+	asyncOptions     = AsyncDownload{}.withDefaults()
+)
+
+// SetAsyncDownload sets the async p2p download options of the process.
+func SetAsyncDownload(o AsyncDownload) {
+	asyncOptionsLock.Lock()
+	defer asyncOptionsLock.Unlock()
+	asyncOptions = o.withDefaults()
+}
+
+// getAsyncDownload returns the async p2p download options of the process.
+func getAsyncDownload() AsyncDownload {
+	asyncOptionsLock.RLock()
+	defer asyncOptionsLock.RUnlock()
+	return asyncOptions
+}
+
+// withDefaults fills the unset options with the default values.
+func (o AsyncDownload) withDefaults() AsyncDownload {
+	if o.MinFileBytes == 0 {
+		o.MinFileBytes = defaultAsyncDownloadByteSize
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultAsyncDownloadTimeout
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultAsyncDownloadPollingStateInterval
+	}
+	if o.MaxPollInterval < o.PollInterval {
+		o.MaxPollInterval = defaultAsyncDownloadMaxPollingInterval
+		if o.MaxPollInterval < o.PollInterval {
+			o.MaxPollInterval = o.PollInterval
+		}
+	}
+	return o
+}
+
+// fallbackError is returned when the async download failed and should fall back to http download.
+type fallbackError struct {
+	reason string
+	err    error
+}
+
+// Error implements the error interface.
+func (e *fallbackError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err.Error())
+}
+
+// Unwrap returns the wrapped error.
+func (e *fallbackError) Unwrap() error {
+	return e.err
+}
+
+// fallbackReason returns the reason of the async download error.
+func fallbackReason(err error) string {
+	var fe *fallbackError
+	if errors.As(err, &fe) {
+		return fe.reason
+	}
+	return "unknown"
+}
+
+var (
+	fallbacksLock sync.Mutex
+	// fallbacks records the reason of the latest fallback of the content, keyed by signature
+	fallbacks = make(map[string]string)
+)
+
+// recordAsyncFallback records the fallback reason of the content for the release report.
+func recordAsyncFallback(signature, reason string) {
+	fallbacksLock.Lock()
+	defer fallbacksLock.Unlock()
+
+	// the records are taken by the release report, drop them if nobody takes
+	if len(fallbacks) >= maxAsyncFallbackRecords {
+		fallbacks = make(map[string]string)
+	}
+	fallbacks[signature] = reason
+}
+
+// TakeAsyncFallbacks returns and clears the fallback reasons of the contents, keyed by signature.
+func TakeAsyncFallbacks(signatures []string) map[string]string {
+	fallbacksLock.Lock()
+	defer fallbacksLock.Unlock()
+
+	taken := make(map[string]string)
+	for _, sig := range signatures {
+		if reason, ok := fallbacks[sig]; ok {
+			taken[sig] = reason
+			delete(fallbacks, sig)
+		}
+	}
+	return taken
+}
+
+// AbandonAsyncDownloads abandons the submitted p2p download tasks of the files which are not consumed by the
+// downloads, e.g. the release is aborted. the temp files of the tasks are removed once they are finished.
+func AbandonAsyncDownloads(files []AsyncFile) {
+	if instance == nil || instance.asyncDownloader == nil {
+		return
+	}
+	dl := instance.asyncDownloader
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	for _, f := range files {
+		if t, ok := dl.tasks[asyncTaskKey(f.FileMeta.GetCommitSpec().GetContent().GetSignature(), f.Dir)]; ok {
+			t.abandoned = true
+		}
+	}
+}
+
+// AsyncFile is a file to be downloaded via p2p.
+type AsyncFile struct {
+	FileMeta *pbfs.FileMeta
+	// Dir is the directory where the file will be downloaded to.
+	Dir string
+}
+
+// SubmitAsyncDownloads submits the p2p download tasks of the files together before downloading them, so that
+// the p2p agent can download them in parallel. the files smaller than the threshold are skipped, the failed
+// ones are submitted again when they are downloaded.
+func SubmitAsyncDownloads(files []AsyncFile) {
+	if instance == nil || !instance.enableAsyncDownload || len(instance.backends) > 0 {
+		return
+	}
+	threshold := getAsyncDownload().MinFileBytes
+	for _, f := range files {
+		if f.FileMeta.GetCommitSpec().GetContent().GetByteSize() < threshold {
+			continue
+		}
+		if _, err := instance.asyncDownloader.submit(f.FileMeta, f.Dir); err != nil {
+			logger.Warn("submit async download task failed", slog.String("file",
+				filepath.Join(f.FileMeta.ConfigItemSpec.Path, f.FileMeta.ConfigItemSpec.Name)), logger.ErrAttr(err))
+		}
+	}
+}
+
 type asyncDownloader struct {
 	vas *kit.Vas
 	// bkAgentID blueking gse agent id
@@ -49,14 +220,60 @@ type asyncDownloader struct {
 	upstream      upstream.Upstream
 	bizID         uint32
 	token         string
+
+	// lock protects the tasks, tasks is the submitted tasks keyed by the directory and signature
+	lock    sync.Mutex
+	tasks   map[string]*asyncTask
+	polling bool
 }
 
-// Download the configuration items from p2p async download.
-func (dl *asyncDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64,
-	to DownloadTo, bytes []byte, toFile string) error {
-	// create asynchronous download task
+// asyncTask is a submitted p2p download task.
+type asyncTask struct {
+	bizID     uint32
+	taskID    string
+	tempFile  string
+	submitted time.Time
+	progress  *progressTracker
+	// abandoned means the task will not be consumed by any download, it is accessed with lock held
+	abandoned bool
 
-	start := time.Now()
+	// the fields below are only accessed by the polling goroutine before done is closed
+	lastSize   int64
+	statusErrs int
+	status     pbfs.AsyncDownloadStatus
+	err        error
+	done       chan struct{}
+	finishedAt time.Time
+	isFinished bool
+}
+
+// finish marks the task as finished with the status.
+func (t *asyncTask) finish(status pbfs.AsyncDownloadStatus, err error) {
+	t.status = status
+	t.err = err
+	t.finishedAt = time.Now()
+	t.isFinished = true
+	close(t.done)
+}
+
+// asyncTaskKey returns the key of the task.
+func asyncTaskKey(signature, dir string) string {
+	return filepath.Join(dir, signature)
+}
+
+// submit creates the async download task of the file, the unfinished or succeeded task of the same content
+// in the same directory is reused.
+func (dl *asyncDownloader) submit(fileMeta *pbfs.FileMeta, dir string) (*asyncTask, error) {
+	signature := fileMeta.GetCommitSpec().GetContent().GetSignature()
+	key := asyncTaskKey(signature, dir)
+
+	dl.lock.Lock()
+	if t, ok := dl.tasks[key]; ok && !t.abandoned &&
+		(!t.isFinished || t.status == pbfs.AsyncDownloadStatus_SUCCESS) {
+		dl.lock.Unlock()
+		return t, nil
+	}
+	dl.lock.Unlock()
 
 	resp, err := dl.upstream.AsyncDownload(dl.vas, &pbfs.AsyncDownloadReq{
 		BizId:         fileMeta.ConfigItemAttachment.BizId,
@@ -65,67 +282,229 @@ func (dl *asyncDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 		PodId:         dl.podID,
 		ContainerName: dl.containerName,
 		FileMeta:      fileMeta,
-		FileDir:       filepath.Dir(toFile),
+		FileDir:       dir,
 	})
 	if err != nil {
-		return err
+		return nil, &fallbackError{reason: fallbackSubmitFailed, err: err}
 	}
 
-	logger.Info("start async download file",
+	logger.Info("submit async download task",
 		slog.String("file", filepath.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name)),
 		slog.String("taskID", resp.TaskId))
 
+	t := &asyncTask{
+		bizID:     fileMeta.ConfigItemAttachment.BizId,
+		taskID:    resp.TaskId,
+		tempFile:  filepath.Join(dir, signature),
+		submitted: time.Now(),
+		progress:  newProgressTracker(fileMeta, fileMeta.GetCommitSpec().GetContent().GetByteSize()),
+		status:    pbfs.AsyncDownloadStatus_DOWNLOADING,
+		done:      make(chan struct{}),
+	}
+
+	dl.lock.Lock()
+	if dl.tasks == nil {
+		dl.tasks = make(map[string]*asyncTask)
+	}
+	dl.tasks[key] = t
+	if !dl.polling {
+		dl.polling = true
+		go dl.pollTasks()
+	}
+	dl.lock.Unlock()
+
+	return t, nil
+}
+
+// Download the configuration items from p2p async download.
+func (dl *asyncDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64,
+	to DownloadTo, bytes []byte, toFile string) error {
+	start := time.Now()
+	dir := filepath.Dir(toFile)
+	signature := fileMeta.CommitSpec.Content.Signature
+
+	// the task may be submitted together with other files of the release
+	task, err := dl.submit(fileMeta, dir)
+	if err != nil {
+		return err
+	}
+	consumed := false
+	defer func() {
+		dl.remove(asyncTaskKey(signature, dir), task, consumed)
+	}()
+
 	// Check the status of the download asynchronously with timeout
-	if err := dl.awaitDownloadCompletion(fileMeta.ConfigItemAttachment.BizId, resp.TaskId, toFile); err != nil {
+	if err := dl.awaitDownloadCompletion(task, toFile); err != nil {
 		return err
 	}
 
 	// move the downloaded file from temp dir to the target path
-	if err := MoveFile(filepath.Join(filepath.Dir(toFile), fileMeta.CommitSpec.Content.Signature), toFile); err != nil {
-		return fmt.Errorf("move file from %s to %s failed, err: %s",
-			filepath.Join(filepath.Dir(toFile), fileMeta.CommitSpec.Content.Signature), toFile, err)
+	if err := MoveFile(task.tempFile, toFile); err != nil {
+		return &fallbackError{reason: fallbackMoveFailed,
+			err: fmt.Errorf("move file from %s to %s failed, err: %s", task.tempFile, toFile, err)}
 	}
+	consumed = true
 
 	// Verify the checksum of the downloaded file
-	if err := dl.verifyChecksum(toFile, fileMeta.CommitSpec.Content.Signature); err != nil {
-		return err
+	if err := dl.verifyChecksum(toFile, signature); err != nil {
+		return &fallbackError{reason: fallbackChecksumFailed, err: err}
 	}
 
+	task.progress.finish()
 	logger.Info("async download file success", "file", toFile, "cost", time.Since(start).String())
 	return nil
 }
 
+// remove the task if it is not replaced by a new one, the task whose temp file is not consumed, e.g. it is
+// timed out, is abandoned so that the temp file is removed once it is finished.
+func (dl *asyncDownloader) remove(key string, task *asyncTask, consumed bool) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	if dl.tasks[key] != task {
+		return
+	}
+	if consumed {
+		delete(dl.tasks, key)
+		return
+	}
+	task.abandoned = true
+}
+
 // awaitDownloadCompletion waits for the download task to complete with a timeout.
-func (dl *asyncDownloader) awaitDownloadCompletion(bizID uint32, taskID, toFile string) error {
-	ctx, cancel := context.WithTimeout(dl.vas.Ctx, 10*time.Minute)
-	defer cancel()
+func (dl *asyncDownloader) awaitDownloadCompletion(task *asyncTask, toFile string) error {
+	timer := time.NewTimer(time.Until(task.submitted.Add(getAsyncDownload().Timeout)))
+	defer timer.Stop()
 
-	ticker := time.NewTicker(defaultAsyncDownloadPollingStateInterval)
-	defer ticker.Stop()
+	select {
+	case <-timer.C:
+		return &fallbackError{reason: fallbackTimeout, err: fmt.Errorf("async download file %s timed out", toFile)}
+	case <-scopes.context(task.progress.signature).Done():
+		metrics.DownloadCancelledCounter.Inc()
+		return &fallbackError{reason: fallbackCancelled,
+			err: fmt.Errorf("async download file %s is cancelled", toFile)}
+	case <-dl.vas.Ctx.Done():
+		return &fallbackError{reason: fallbackCancelled, err: dl.vas.Ctx.Err()}
+	case <-task.done:
+	}
 
+	if task.err != nil {
+		return &fallbackError{reason: fallbackStatusFailed,
+			err: fmt.Errorf("get async download file %s status failed, err: %s", toFile, task.err)}
+	}
+	if task.status == pbfs.AsyncDownloadStatus_FAILED {
+		return &fallbackError{reason: fallbackTaskFailed, err: fmt.Errorf("async download file %s failed", toFile)}
+	}
+	return nil
+}
+
+// pollTasks polls the status of all the unfinished tasks in one loop, the interval doubles each time no task
+// makes progress, and resets when any task makes progress. it exits when there is no task.
+func (dl *asyncDownloader) pollTasks() {
+	opts := getAsyncDownload()
+	interval := opts.PollInterval
 	for {
 		select {
-		case <-ctx.Done():
-			return fmt.Errorf("async download file %s timed out", toFile)
-		case <-ticker.C:
-
-			resp, err := dl.upstream.AsyncDownloadStatus(dl.vas, &pbfs.AsyncDownloadStatusReq{
-				BizId:  bizID,
-				TaskId: taskID,
-			})
-			if err != nil {
-				return err
+		case <-dl.vas.Ctx.Done():
+			dl.lock.Lock()
+			dl.polling = false
+			dl.lock.Unlock()
+			return
+		case <-time.After(interval):
+		}
+
+		pending := dl.pendingTasks(opts.Timeout)
+		if pending == nil {
+			return
+		}
+
+		progressed := false
+		for _, t := range pending {
+			if dl.pollTask(t) {
+				progressed = true
 			}
-			switch resp.Status {
-			case pbfs.AsyncDownloadStatus_FAILED:
-				return fmt.Errorf("async download file %s failed", toFile)
-			case pbfs.AsyncDownloadStatus_DOWNLOADING:
-				continue
-			case pbfs.AsyncDownloadStatus_SUCCESS:
-				return nil
+		}
+
+		opts = getAsyncDownload()
+		if progressed {
+			interval = opts.PollInterval
+		} else if interval *= 2; interval > opts.MaxPollInterval {
+			interval = opts.MaxPollInterval
+		}
+	}
+}
+
+// pendingTasks returns the unfinished tasks and drops the finished ones which are abandoned or not consumed
+// in time, together with their temp files. it returns nil and stops polling when there is no task.
+func (dl *asyncDownloader) pendingTasks(expire time.Duration) []*asyncTask {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	pending := make([]*asyncTask, 0)
+	for key, t := range dl.tasks {
+		if !t.isFinished {
+			pending = append(pending, t)
+			continue
+		}
+		if t.abandoned || time.Since(t.finishedAt) > expire {
+			delete(dl.tasks, key)
+			// the consumed tasks are removed by the downloads, the temp file is left by nobody else
+			if err := os.Remove(t.tempFile); err != nil && !os.IsNotExist(err) {
+				logger.Warn("remove the temp file of the unconsumed async download task failed",
+					slog.String("file", t.tempFile), logger.ErrAttr(err))
 			}
 		}
 	}
+	if len(dl.tasks) == 0 {
+		dl.polling = false
+		return nil
+	}
+	return pending
+}
+
+// pollTask gets the status of the task, returns whether the task makes progress.
+// the progress is estimated by the size of the temp file which is being written by the p2p agent.
+func (dl *asyncDownloader) pollTask(t *asyncTask) bool {
+	resp, err := dl.upstream.AsyncDownloadStatus(dl.vas, &pbfs.AsyncDownloadStatusReq{
+		BizId:  t.bizID,
+		TaskId: t.taskID,
+	})
+	if err != nil {
+		t.statusErrs++
+		logger.Warn("get async download task status failed", slog.String("taskID", t.taskID),
+			slog.Int("times", t.statusErrs), logger.ErrAttr(err))
+		if t.statusErrs >= maxAsyncStatusErrorCount {
+			dl.finish(t, pbfs.AsyncDownloadStatus_FAILED, err)
+		}
+		return false
+	}
+	t.statusErrs = 0
+	t.progress.setAsyncStatus(resp.Status.String())
+
+	switch resp.Status {
+	case pbfs.AsyncDownloadStatus_DOWNLOADING:
+		info, e := os.Stat(t.tempFile)
+		if e != nil || info.Size() <= t.lastSize {
+			return false
+		}
+		t.lastSize = info.Size()
+		if uint64(info.Size()) <= t.progress.total {
+			t.progress.set(uint64(info.Size()))
+		}
+		return true
+	default:
+		logger.Info("async download task finished", slog.String("taskID", t.taskID),
+			slog.String("status", resp.Status.String()))
+		dl.finish(t, resp.Status, nil)
+		return true
+	}
+}
+
+// finish marks the task as finished with lock held, so that pendingTasks sees the consistent state.
+func (dl *asyncDownloader) finish(t *asyncTask, status pbfs.AsyncDownloadStatus, err error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	t.finish(status, err)
 }
 
 // verifyChecksum verifies the checksum of the downloaded file.
@@ -136,6 +515,7 @@ func (dl *asyncDownloader) verifyChecksum(filePath, expectedChecksum string) err
 	}
 
 	if signature != expectedChecksum {
+		metrics.DownloadChecksumFailedCounter.WithLabelValues("async").Inc()
 		return fmt.Errorf("file %s SHA256 not matched, file SHA256: %s, expected SHA256: %s",
 			filePath, signature, expectedChecksum)
 	}
@@ -0,0 +1,64 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
+)
+
+func TestPendingTasksRemoveUnconsumedTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	newTask := func(name string, finished bool, finishedAt time.Time) *asyncTask {
+		tempFile := filepath.Join(dir, name)
+		if err := os.WriteFile(tempFile, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return &asyncTask{tempFile: tempFile, isFinished: finished, finishedAt: finishedAt,
+			status: pbfs.AsyncDownloadStatus_SUCCESS, done: make(chan struct{})}
+	}
+	dl := &asyncDownloader{tasks: map[string]*asyncTask{
+		"running":   newTask("running", false, time.Time{}),
+		"finished":  newTask("finished", true, time.Now()),
+		"expired":   newTask("expired", true, time.Now().Add(-2*time.Minute)),
+		"abandoned": newTask("abandoned", true, time.Now()),
+		"aborted":   newTask("aborted", false, time.Time{}),
+	}}
+	dl.tasks["abandoned"].abandoned = true
+	dl.tasks["aborted"].abandoned = true
+
+	pending := dl.pendingTasks(time.Minute)
+	if len(pending) != 2 {
+		t.Fatalf("expect 2 pending tasks, got %d", len(pending))
+	}
+	// the unfinished task is kept even if it is abandoned, its temp file is removed once it is finished
+	for name, kept := range map[string]bool{"running": true, "finished": true, "expired": false,
+		"abandoned": false, "aborted": true} {
+		if _, ok := dl.tasks[name]; ok != kept {
+			t.Errorf("task %s kept = %v, want %v", name, ok, kept)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("temp file %s kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+
+	dl.tasks["aborted"].isFinished = true
+	dl.pendingTasks(time.Minute)
+	if _, err := os.Stat(filepath.Join(dir, "aborted")); !os.IsNotExist(err) {
+		t.Errorf("expect the temp file of the aborted task removed once finished, err: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+var (
+	// ErrBackendContentNotFound is returned by the backend when it does not have the content,
+	// then the next backend in the chain is tried.
+	ErrBackendContentNotFound = errors.New("content not found in download backend")
+
+	// BuiltinBackend stands for the built-in async p2p and http downloaders in the backend chain.
+	BuiltinBackend Backend = builtinBackend{}
+)
+
+// Backend is a pluggable source of the config item content.
+type Backend interface {
+	// Name returns the name of the backend, used in logs.
+	Name() string
+	// Open opens the content stream of the config item, signature is the sha256 of the content.
+	Open(ctx context.Context, fileMeta *pbfs.FileMeta, signature string) (io.ReadCloser, error)
+}
+
+// builtinBackend is the placeholder of the built-in downloaders, it never be opened.
+type builtinBackend struct{}
+
+// Name returns the name of the backend.
+func (builtinBackend) Name() string {
+	return "builtin"
+}
+
+// Open is not supported, the built-in downloaders are called directly.
+func (builtinBackend) Open(context.Context, *pbfs.FileMeta, string) (io.ReadCloser, error) {
+	return nil, errors.New("builtin backend can not be opened")
+}
+
+// SetBackends sets the download backend chain, the backends are tried in order until one of them succeeds.
+// the built-in downloaders are appended to the end if BuiltinBackend is not in the chain.
+func SetBackends(backends []Backend) {
+	var chain []Backend
+	hasBuiltin := false
+	for _, b := range backends {
+		if b == nil {
+			continue
+		}
+		if b == BuiltinBackend {
+			hasBuiltin = true
+		}
+		chain = append(chain, b)
+	}
+	if !hasBuiltin {
+		chain = append(chain, BuiltinBackend)
+	}
+
+	instance.backends = chain
+	instance.warmup.backends = chain
+}
+
+// downloadFromChain downloads the content from the backend chain.
+func (d *downloader) downloadFromChain(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo,
+	b []byte, filePath string) error {
+
+	var err error
+	for _, backend := range d.backends {
+		if backend == BuiltinBackend {
+			err = d.download(fileMeta, downloadUri, fileSize, to, b, filePath)
+		} else {
+			err = downloadFromBackend(backend, fileMeta, fileSize, to, b, filePath)
+		}
+		if err == nil {
+			return nil
+		}
+
+		logger.Warn("download file from backend failed, try the next one",
+			slog.String("file", filepath.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name)),
+			slog.String("backend", backend.Name()), logger.ErrAttr(err))
+	}
+
+	return err
+}
+
+// downloadFromBackend downloads the content from the external backend, and verifies it with the signature.
+func downloadFromBackend(backend Backend, fileMeta *pbfs.FileMeta, fileSize uint64, to DownloadTo, b []byte,
+	filePath string) error {
+
+	signature := fileMeta.GetCommitSpec().GetContent().GetSignature()
+	body, err := backend.Open(scopes.context(signature), fileMeta, signature)
+	if err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
+				Err: fmt.Errorf("open content from backend %s failed, err: %w", backend.Name(), err)})
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	progress := newProgressTracker(fileMeta, fileSize)
+	// read one more byte to check the content is not larger than expected
+	r := io.TeeReader(io.LimitReader(&progressReader{r: body, progress: progress}, int64(fileSize)+1), h)
+
+	var n int64
+	switch to {
+	case DownloadToBytes:
+		if uint64(len(b)) != fileSize {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.ValidateDownloadFailed,
+					Err: fmt.Errorf("the size of bytes is not equal to the file size")})
+		}
+		var read int
+		read, err = io.ReadFull(r, b)
+		n = int64(read)
+		if err == nil {
+			// the content is larger than expected if there is any more byte
+			var more int64
+			more, err = io.Copy(io.Discard, r)
+			n += more
+		} else if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case DownloadToFile:
+		n, err = copyToPartFile(r, filePath)
+	}
+	if err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+				Err: fmt.Errorf("read content from backend %s failed, err: %s", backend.Name(), err.Error())})
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if uint64(n) != fileSize || (signature != "" && actual != signature) {
+		metrics.DownloadChecksumFailedCounter.WithLabelValues(backend.Name()).Inc()
+		if to == DownloadToFile {
+			_ = os.Remove(filePath + partFileSuffix)
+		}
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ValidateDownloadFailed,
+				Err: fmt.Errorf("content from backend %s is not matched, size: %d, SHA256: %s, "+
+					"expected size: %d, expected SHA256: %s", backend.Name(), n, actual, fileSize, signature)})
+	}
+
+	if to == DownloadToFile {
+		if err := os.Rename(filePath+partFileSuffix, filePath); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+					Err: fmt.Errorf("rename the part file to %s failed, err: %s", filePath, err.Error())})
+		}
+	}
+	progress.finish()
+
+	return nil
+}
+
+// progressReader reports the download progress while reading.
+type progressReader struct {
+	r        io.Reader
+	progress *progressTracker
+}
+
+// Read implements io.Reader.
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.progress.add(n)
+	return n, err
+}
+
+// copyToPartFile copies the content to the part file of the target file.
+func copyToPartFile(r io.Reader, filePath string) (int64, error) {
+	if len(filePath) == 0 {
+		return 0, fmt.Errorf("target file path is empty")
+	}
+
+	file, err := os.OpenFile(filePath+partFileSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, r)
+	if err != nil {
+		return n, err
+	}
+	if err := file.Sync(); err != nil {
+		return n, err
+	}
+	return n, file.Close()
+}
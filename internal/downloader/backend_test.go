@@ -0,0 +1,81 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pbcommit "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/commit"
+	pbcontent "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/content"
+	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
+)
+
+type fakeBackend struct {
+	content []byte
+}
+
+func (b *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (b *fakeBackend) Open(context.Context, *pbfs.FileMeta, string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b.content)), nil
+}
+
+func TestDownloadFromBackend(t *testing.T) {
+	content := []byte("bscp config content")
+	sum := sha256.Sum256(content)
+	fileMeta := &pbfs.FileMeta{CommitSpec: &pbcommit.CommitSpec{
+		Content: &pbcontent.ContentSpec{Signature: hex.EncodeToString(sum[:]), ByteSize: uint64(len(content))},
+	}}
+	size := uint64(len(content))
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{name: "matched", content: content},
+		{name: "tampered", content: []byte("bscp config CONTENT"), wantErr: true},
+		{name: "truncated", content: content[:5], wantErr: true},
+		{name: "oversize", content: append(append([]byte{}, content...), '!'), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &fakeBackend{content: tt.content}
+
+			b := make([]byte, size)
+			err := downloadFromBackend(backend, fileMeta, size, DownloadToBytes, b, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("download to bytes error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			filePath := filepath.Join(t.TempDir(), "file")
+			err = downloadFromBackend(backend, fileMeta, size, DownloadToFile, nil, filePath)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("download to file error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, statErr := os.Stat(filePath); (statErr == nil) == tt.wantErr {
+				t.Errorf("target file exists = %v, want %v", statErr == nil, !tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// partFileSuffix is the suffix of the file which is being downloaded.
+	partFileSuffix = ".part"
+	// checkpointFileSuffix is the suffix of the sidecar checkpoint file of the part file.
+	checkpointFileSuffix = ".ckpt"
+)
+
+// byteRange is a closed interval [Start, End] of the file content.
+type byteRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	// SHA256 is the sha256 of the range content, used to verify the completed range when resuming.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// size returns the byte size of the range.
+func (r byteRange) size() uint64 {
+	return r.End - r.Start + 1
+}
+
+// checkpoint records the completed ranges of a range download, so that the download can be resumed
+// after the process restarts.
+type checkpoint struct {
+	// Signature is the expected sha256 of the whole file content.
+	Signature string `json:"signature"`
+	// FileSize is the expected size of the whole file content.
+	FileSize uint64 `json:"fileSize"`
+	// Completed is the completed ranges of the file content.
+	Completed []byteRange `json:"completed"`
+
+	path string
+	lock sync.Mutex
+}
+
+// loadCheckpoint loads the checkpoint of the part file, and verifies the completed ranges with the part file.
+// if the checkpoint is not exist or not match with the expected content, an empty checkpoint is returned.
+func loadCheckpoint(path string, part *os.File, signature string, fileSize uint64) *checkpoint {
+	ckpt := &checkpoint{
+		Signature: signature,
+		FileSize:  fileSize,
+		path:      path,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("read download checkpoint failed, download from the beginning",
+				slog.String("checkpoint", path), logger.ErrAttr(err))
+		}
+		return ckpt
+	}
+
+	last := new(checkpoint)
+	if err := json.Unmarshal(b, last); err != nil {
+		logger.Warn("decode download checkpoint failed, download from the beginning",
+			slog.String("checkpoint", path), logger.ErrAttr(err))
+		return ckpt
+	}
+
+	if last.Signature != signature || last.FileSize != fileSize {
+		logger.Info("download checkpoint is not match with current content, download from the beginning",
+			slog.String("checkpoint", path))
+		return ckpt
+	}
+
+	// verify the completed ranges, the part file may be modified or truncated after crash.
+	for _, r := range last.Completed {
+		sha, err := rangeSHA256(part, r)
+		if err != nil || sha != r.SHA256 {
+			logger.Warn("completed range of download checkpoint is corrupted, download it again",
+				slog.String("checkpoint", path), slog.Uint64("start", r.Start), slog.Uint64("end", r.End))
+			continue
+		}
+		ckpt.Completed = append(ckpt.Completed, r)
+	}
+
+	logger.Info("resume download from checkpoint", slog.String("checkpoint", path),
+		slog.Int("completed_ranges", len(ckpt.Completed)), slog.Uint64("completed_bytes", ckpt.completedSize()))
+
+	return ckpt
+}
+
+// completedSize returns the total byte size of the completed ranges.
+func (c *checkpoint) completedSize() uint64 {
+	var size uint64
+	for _, r := range c.Completed {
+		size += r.size()
+	}
+	return size
+}
+
+// pending returns the ranges which are not completed yet, each range's size is no more than partSize.
+func (c *checkpoint) pending(partSize uint64) []byteRange {
+	c.lock.Lock()
+	completed := append([]byteRange{}, c.Completed...)
+	c.lock.Unlock()
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].Start < completed[j].Start
+	})
+
+	return splitGaps(completed, c.FileSize, partSize)
+}
+
+// splitGaps returns the gaps of the sorted completed ranges in [0, fileSize), and splits them by partSize.
+func splitGaps(completed []byteRange, fileSize, partSize uint64) []byteRange {
+	var gaps []byteRange
+	var next uint64
+	for _, r := range completed {
+		if r.Start > next {
+			gaps = append(gaps, byteRange{Start: next, End: r.Start - 1})
+		}
+		if r.End+1 > next {
+			next = r.End + 1
+		}
+	}
+	if next < fileSize {
+		gaps = append(gaps, byteRange{Start: next, End: fileSize - 1})
+	}
+
+	if partSize == 0 {
+		return gaps
+	}
+
+	var parts []byteRange
+	for _, g := range gaps {
+		for start := g.Start; start <= g.End; start += partSize {
+			end := start + partSize - 1
+			if end > g.End {
+				end = g.End
+			}
+			parts = append(parts, byteRange{Start: start, End: end})
+		}
+	}
+	return parts
+}
+
+// done records the range as completed and persists the checkpoint.
+func (c *checkpoint) done(r byteRange) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Completed = append(c.Completed, r)
+	return c.save()
+}
+
+// save persists the checkpoint atomically, must be called with lock held.
+func (c *checkpoint) save() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("encode download checkpoint failed, err: %s", err.Error())
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("write download checkpoint failed, err: %s", err.Error())
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("rename download checkpoint failed, err: %s", err.Error())
+	}
+	return nil
+}
+
+// remove the checkpoint file, it is called when the download is finished or can not be resumed.
+func (c *checkpoint) remove() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Completed = nil
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		logger.Warn("remove download checkpoint failed", slog.String("checkpoint", c.path), logger.ErrAttr(err))
+	}
+}
+
+// rangeSHA256 calculates the sha256 of the range content of the file.
+func rangeSHA256(file *os.File, r byteRange) (string, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, io.NewSectionReader(file, int64(r.Start), int64(r.size())))
+	if err != nil {
+		return "", err
+	}
+	if uint64(n) != r.size() {
+		return "", fmt.Errorf("range size %d is not as what we expected %d", n, r.size())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
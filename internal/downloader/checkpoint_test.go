@@ -0,0 +1,109 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitGaps(t *testing.T) {
+	tests := []struct {
+		name      string
+		completed []byteRange
+		fileSize  uint64
+		partSize  uint64
+		want      []byteRange
+	}{
+		{
+			name:     "nothing completed",
+			fileSize: 25,
+			partSize: 10,
+			want:     []byteRange{{Start: 0, End: 9}, {Start: 10, End: 19}, {Start: 20, End: 24}},
+		},
+		{
+			name:      "all completed",
+			completed: []byteRange{{Start: 0, End: 9}, {Start: 10, End: 24}},
+			fileSize:  25,
+			partSize:  10,
+			want:      nil,
+		},
+		{
+			name:      "gaps between completed ranges",
+			completed: []byteRange{{Start: 5, End: 9}, {Start: 20, End: 24}},
+			fileSize:  30,
+			partSize:  10,
+			want: []byteRange{{Start: 0, End: 4}, {Start: 10, End: 19},
+				{Start: 25, End: 29}},
+		},
+		{
+			name:      "overlapped completed ranges",
+			completed: []byteRange{{Start: 0, End: 9}, {Start: 5, End: 14}},
+			fileSize:  20,
+			partSize:  10,
+			want:      []byteRange{{Start: 15, End: 19}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitGaps(tt.completed, tt.fileSize, tt.partSize)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitGaps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	partPath := filepath.Join(dir, "file"+partFileSuffix)
+	ckptPath := partPath + checkpointFileSuffix
+
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	if _, err = part.Write([]byte("0123456789abcdefghij")); err != nil {
+		t.Fatal(err)
+	}
+
+	ckpt := loadCheckpoint(ckptPath, part, "sig", 20)
+	for _, r := range []byteRange{{Start: 0, End: 9}, {Start: 10, End: 19}} {
+		if r.SHA256, err = rangeSHA256(part, r); err != nil {
+			t.Fatal(err)
+		}
+		if err = ckpt.done(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// corrupt the second range, only it should be downloaded again
+	if _, err = part.WriteAt([]byte("x"), 15); err != nil {
+		t.Fatal(err)
+	}
+	resumed := loadCheckpoint(ckptPath, part, "sig", 20)
+	want := []byteRange{{Start: 10, End: 19}}
+	if got := resumed.pending(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("pending() = %v, want %v", got, want)
+	}
+
+	// the checkpoint of other content should be dropped
+	other := loadCheckpoint(ckptPath, part, "other", 20)
+	if got := other.completedSize(); got != 0 {
+		t.Errorf("completedSize() = %d, want 0", got)
+	}
+}
@@ -24,6 +24,7 @@ import (
 
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 var (
@@ -55,6 +56,8 @@ func Init(vas *kit.Vas, bizID uint32, token string, upstream upstream.Upstream,
 		return fmt.Errorf("build tls config failed, err: %s", err.Error())
 	}
 
+	maxGoroutines := setupMaxHttpDownloadGoroutines()
+	tuner.setDefaultConcurrency(maxGoroutines)
 	instance = &downloader{
 		httpDownloader: &httpDownloader{
 			vas:                     vas,
@@ -62,10 +65,12 @@ func Init(vas *kit.Vas, bizID uint32, token string, upstream upstream.Upstream,
 			bizID:                   bizID,
 			upstream:                upstream,
 			tls:                     tlsC,
-			sem:                     semaphore.NewWeighted(setupMaxHttpDownloadGoroutines()),
+			sem:                     semaphore.NewWeighted(maxGoroutines),
 			balanceDownloadByteSize: defaultRangeDownloadByteSize,
+			limiters:                []*bandwidthLimiter{downloadLimiter},
 		},
 	}
+	defer instance.initWarmup()
 
 	if !serverEnableP2P {
 		logger.Warn("async p2p download is set to disabled in server side")
@@ -95,12 +100,50 @@ type downloader struct {
 	enableAsyncDownload bool
 	asyncDownloader     *asyncDownloader
 	httpDownloader      *httpDownloader
+	// warmup is the downloader for cache warm-up which shares everything except the bandwidth limiters
+	warmup *downloader
+	// backends is the download backend chain, only the built-in downloaders are used if it is empty
+	backends []Backend
 }
 
+// initWarmup init the warm-up downloader after the downloader is initialized.
+func (d *downloader) initWarmup() {
+	hd := *d.httpDownloader
+	hd.limiters = []*bandwidthLimiter{warmupLimiter, downloadLimiter}
+	d.warmup = &downloader{
+		enableAsyncDownload: d.enableAsyncDownload,
+		asyncDownloader:     d.asyncDownloader,
+		httpDownloader:      &hd,
+	}
+}
+
+// Download the configuration items from the backend chain if set, otherwise from the built-in downloaders.
 func (d *downloader) Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo, b []byte,
 	filePath string) error {
 	logger.Info("start download file", "file", filepath.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name))
 
+	// the download is cancelled if its content is not needed by the newer release
+	ctx, release, err := scopes.acquire(fileMeta.GetCommitSpec().GetContent().GetSignature())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if len(d.backends) > 0 {
+		err = d.downloadFromChain(fileMeta, downloadUri, fileSize, to, b, filePath)
+	} else {
+		err = d.download(fileMeta, downloadUri, fileSize, to, b, filePath)
+	}
+	// keep the context error in the chain, so that the cancelled download can be told from the failed one
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("download is cancelled, %w, err: %w", ctx.Err(), err)
+	}
+	return err
+}
+
+// download the configuration items with the built-in async p2p and http downloaders.
+func (d *downloader) download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo, b []byte,
+	filePath string) error {
 	if !d.enableAsyncDownload {
 		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
 	}
@@ -108,14 +151,18 @@ func (d *downloader) Download(fileMeta *pbfs.FileMeta, downloadUri string, fileS
 	if to == DownloadToBytes {
 		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
 	}
-	// if file size is less than 1MB, use http download
-	if fileSize < defaultAsyncDownloadByteSize {
+	// if file size is less than the threshold, use http download
+	if fileSize < getAsyncDownload().MinFileBytes {
 		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
 	}
-	// if file size is larger than 1MB, try async download
+	// if file size is not less than the threshold, try async download
 	if err := d.asyncDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath); err != nil {
+		reason := fallbackReason(err)
+		metrics.AsyncDownloadFallbackCounter.WithLabelValues(reason).Inc()
+		recordAsyncFallback(fileMeta.GetCommitSpec().GetContent().GetSignature(), reason)
 		logger.Warn("async download file failed, fallback to http download", "file",
-			filepath.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name), "err", err.Error())
+			filepath.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name), "reason", reason,
+			"err", err.Error())
 		// if async download failed, fallback to http download
 		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
 	}
@@ -0,0 +1,103 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+const (
+	// acceptEncoding is the content encodings negotiated with the repository when download the whole file.
+	acceptEncoding = "zstd, gzip"
+	// identityEncoding means no compression, range requests must be uncompressed to keep the offsets.
+	identityEncoding = "identity"
+)
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+// Read implements io.Reader.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// decodedBody decompresses the response body while streaming, and records the received and decoded bytes.
+type decodedBody struct {
+	encoding string
+	body     io.ReadCloser
+	received *countingReader
+	decoded  *countingReader
+	release  func()
+}
+
+// Read implements io.Reader.
+func (b *decodedBody) Read(p []byte) (int, error) {
+	return b.decoded.Read(p)
+}
+
+// Close implements io.Closer.
+func (b *decodedBody) Close() error {
+	if b.release != nil {
+		b.release()
+	}
+	metrics.DownloadReceivedBytesCounter.WithLabelValues(b.encoding).Add(float64(b.received.n))
+	metrics.DownloadDecodedBytesCounter.WithLabelValues(b.encoding).Add(float64(b.decoded.n))
+	return b.body.Close()
+}
+
+// decodeBody returns the decompressed response body according to the Content-Encoding header.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	received := &countingReader{r: resp.Body}
+	b := &decodedBody{encoding: encoding, body: resp.Body, received: received}
+
+	switch encoding {
+	case "", identityEncoding:
+		b.encoding = identityEncoding
+		b.decoded = &countingReader{r: received}
+	case "gzip":
+		gr, err := gzip.NewReader(received)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("new gzip reader failed, err: %s", err.Error())
+		}
+		b.decoded = &countingReader{r: gr}
+		b.release = func() { _ = gr.Close() }
+	case "zstd":
+		zr, err := zstd.NewReader(received, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("new zstd reader failed, err: %s", err.Error())
+		}
+		b.decoded = &countingReader{r: zr}
+		b.release = zr.Close
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+
+	return b, nil
+}
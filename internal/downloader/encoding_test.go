@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecodeBody(t *testing.T) {
+	content := []byte(strings.Repeat("bscp config content\n", 1000))
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write(content)
+	_ = gw.Close()
+
+	zw, _ := zstd.NewWriter(nil)
+	zs := zw.EncodeAll(content, nil)
+	_ = zw.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{encoding: "", body: content},
+		{encoding: "identity", body: content},
+		{encoding: "gzip", body: gz.Bytes()},
+		{encoding: "zstd", body: zs},
+		{encoding: "br", body: content, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{"Content-Encoding": []string{tt.encoding}},
+				Body:   io.NopCloser(bytes.NewReader(tt.body)),
+			}
+			body, err := decodeBody(resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("read decoded body failed, err: %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decoded content is not match, got %d bytes, want %d bytes", len(got), len(content))
+			}
+		})
+	}
+}
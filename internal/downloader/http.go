@@ -15,10 +15,13 @@ package downloader
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"net/http"
@@ -41,6 +44,7 @@ import (
 
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
@@ -49,6 +53,8 @@ const (
 	defaultRangeDownloadByteSize       = 5 * defaultSwapBufferSize
 	requestAwaitResponseTimeoutSeconds = 10
 	defaultDownloadGroutines           = 10
+	// maxChecksumRetryCount is the max times to download the whole content again when checksum is not matched
+	maxChecksumRetryCount = 2
 
 	// EnvMaxHTTPDownloadGoroutines is the env name of max goroutines to download file via http.
 	EnvMaxHTTPDownloadGoroutines = "BK_BSCP_MAX_HTTP_DOWNLOAD_GOROUTINES"
@@ -98,6 +104,12 @@ func GetDownloader() Downloader {
 	return instance
 }
 
+// GetWarmupDownloader returns the downloader for cache warm-up, its bandwidth is limited by both the warm-up
+// limit and the global limit.
+func GetWarmupDownloader() Downloader {
+	return instance.warmup
+}
+
 // httpDownloader is used to download the configuration items from provider
 type httpDownloader struct {
 	vas      *kit.Vas
@@ -111,6 +123,8 @@ type httpDownloader struct {
 	// will be downloaded with range policy, otherwise, it will be downloaded directly
 	// without range policy.
 	balanceDownloadByteSize uint64
+	// limiters limit the download bandwidth, all of them are waited before writing the content
+	limiters []*bandwidthLimiter
 }
 
 // Download the configuration items from provider.
@@ -119,7 +133,7 @@ func (dl *httpDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 
 	start := time.Now()
 	exec := &execDownload{
-		ctx:          context.Background(),
+		ctx:          scopes.context(fileMeta.GetCommitSpec().GetContent().GetSignature()),
 		dl:           dl,
 		fileMeta:     fileMeta,
 		to:           to,
@@ -127,6 +141,8 @@ func (dl *httpDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 		header:       http.Header{},
 		downloadUris: []string{downloadUri},
 		fileSize:     fileSize,
+		signature:    fileMeta.GetCommitSpec().GetContent().GetSignature(),
+		progress:     newProgressTracker(fileMeta, fileSize),
 	}
 	switch to {
 	case DownloadToFile:
@@ -135,15 +151,19 @@ func (dl *httpDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 				sfs.SecondaryError{SpecificFailedReason: sfs.FilePathNotFound,
 					Err: fmt.Errorf("target file path is empty")})
 		}
-		file, err := os.OpenFile(toFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+		// download to the part file first, so that it can be resumed after the process restarts
+		partFile := toFile + partFileSuffix
+		file, err := os.OpenFile(partFile, os.O_RDWR|os.O_CREATE, os.ModePerm)
 		if err != nil {
 			return sfs.WrapPrimaryError(sfs.DownloadFailed,
 				sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
 					Err: fmt.Errorf("open the target file failed, err: %s", err.Error())})
 		}
-		logger.Info("open file success", "file", toFile)
+		logger.Info("open file success", "file", partFile)
 		defer file.Close()
 		exec.file = file
+		exec.ckpt = loadCheckpoint(partFile+checkpointFileSuffix, file, exec.signature, fileSize)
+		exec.progress.reset(exec.ckpt.completedSize())
 	case DownloadToBytes:
 		if len(bytes) != int(fileSize) {
 			return sfs.WrapPrimaryError(sfs.DownloadFailed,
@@ -153,9 +173,21 @@ func (dl *httpDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 		exec.bytes = bytes
 	}
 	if err := exec.do(); err != nil {
+		if exec.ctx.Err() != nil {
+			metrics.DownloadCancelledCounter.Inc()
+			metrics.DownloadCancelledBytesCounter.Add(float64(exec.progress.runBytes()))
+		}
 		return err
 	}
 
+	if to == DownloadToFile {
+		if err := exec.commit(toFile); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed, Err: err})
+		}
+	}
+	exec.progress.finish()
+
 	logger.Info("http download file success", "file", toFile, "cost", time.Since(start).String())
 	return nil
 }
@@ -194,6 +226,82 @@ type execDownload struct {
 	downloadUris []string // returned by feed server
 	fileSize     uint64
 	waitTimeMil  int64
+	// signature is the expected sha256 of the content, empty means no need to verify
+	signature string
+	// ckpt records the completed ranges when download to file, nil when download to bytes
+	ckpt *checkpoint
+	// progress tracks the download progress
+	progress *progressTracker
+}
+
+// commit moves the downloaded part file to the target file, and removes the checkpoint.
+func (exec *execDownload) commit(toFile string) error {
+	partFile := exec.file.Name()
+	if err := exec.file.Sync(); err != nil {
+		return fmt.Errorf("sync the part file failed, err: %s", err.Error())
+	}
+	if err := exec.file.Close(); err != nil {
+		return fmt.Errorf("close the part file failed, err: %s", err.Error())
+	}
+	if err := os.Rename(partFile, toFile); err != nil {
+		return fmt.Errorf("rename the part file to %s failed, err: %s", toFile, err.Error())
+	}
+	exec.ckpt.remove()
+	return nil
+}
+
+// pendingRanges returns the ranges to be downloaded, the completed ranges recorded in checkpoint are skipped.
+func (exec *execDownload) pendingRanges(partSize uint64) []byteRange {
+	if exec.ckpt == nil {
+		return splitGaps(nil, exec.fileSize, partSize)
+	}
+	return exec.ckpt.pending(partSize)
+}
+
+// checksumError is returned when the sha256 of the downloaded content is not match with the signature.
+type checksumError struct {
+	actual   string
+	expected string
+}
+
+// Error implements the error interface.
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("content SHA256 not matched, content SHA256: %s, expected SHA256: %s", e.actual, e.expected)
+}
+
+// verifyChecksum compares the sha256 of the downloaded content with the signature.
+func (exec *execDownload) verifyChecksum(mode, actual string) error {
+	if exec.signature == "" || actual == exec.signature {
+		return nil
+	}
+
+	metrics.DownloadChecksumFailedCounter.WithLabelValues(mode).Inc()
+	logger.Warn("downloaded content SHA256 not matched",
+		slog.String("file", path.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)),
+		slog.String("download_uri", exec.downloadUri), slog.String("actual", actual),
+		slog.String("expected", exec.signature))
+
+	return &checksumError{actual: actual, expected: exec.signature}
+}
+
+// contentSHA256 calculates the sha256 of the whole downloaded content.
+func (exec *execDownload) contentSHA256() (string, error) {
+	if exec.to == DownloadToBytes {
+		sum := sha256.Sum256(exec.bytes)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	return rangeSHA256(exec.file, byteRange{Start: 0, End: exec.fileSize - 1})
+}
+
+// failedReason returns the specific failed reason of the download error, checksum mismatch is distinguished
+// from the other errors.
+func failedReason(err error, defaultReason sfs.SpecificFailedReason) sfs.SpecificFailedReason {
+	var ce *checksumError
+	if errors.As(err, &ce) {
+		return sfs.ValidateDownloadFailed
+	}
+	return defaultReason
 }
 
 func (exec *execDownload) do() error {
@@ -230,7 +338,7 @@ func (exec *execDownload) do() error {
 				Err: fmt.Errorf("get temporary download url failed, err: %s", err.Error())})
 	}
 
-	exec.waitTimeMil = resp.WaitTimeMil
+	exec.waitTimeMil = tuner.waitTime(resp.WaitTimeMil)
 	exec.downloadUris = resp.Urls
 	logger.Debug("download uri info", slog.String("file", path.Join(exec.fileMeta.ConfigItemSpec.Path,
 		exec.fileMeta.ConfigItemSpec.Name)), slog.Any("uris", exec.downloadUris))
@@ -260,7 +368,7 @@ func (exec *execDownload) download() error {
 		// the file size is not big enough, download directly
 		if e := exec.downloadDirectlyWithRetry(); e != nil {
 			return sfs.WrapPrimaryError(sfs.DownloadFailed,
-				sfs.SecondaryError{SpecificFailedReason: sfs.RetryDownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: failedReason(e, sfs.RetryDownloadFailed),
 					Err: fmt.Errorf("download directly failed, err: %s", e.Error())})
 		}
 
@@ -279,9 +387,9 @@ func (exec *execDownload) download() error {
 					Err: fmt.Errorf("the to be download file size: %d is not as what we expected %d", size, exec.fileSize)})
 		}
 
-		if err := exec.downloadWithRange(); err != nil {
+		if err := exec.downloadWithRangeAndVerify(); err != nil {
 			return sfs.WrapPrimaryError(sfs.DownloadFailed,
-				sfs.SecondaryError{SpecificFailedReason: sfs.DownloadChunkFailed,
+				sfs.SecondaryError{SpecificFailedReason: failedReason(err, sfs.DownloadChunkFailed),
 					Err: fmt.Errorf("download with range failed, err: %s", err.Error())})
 		}
 
@@ -292,7 +400,7 @@ func (exec *execDownload) download() error {
 
 	if err := exec.downloadDirectlyWithRetry(); err != nil {
 		return sfs.WrapPrimaryError(sfs.DownloadFailed,
-			sfs.SecondaryError{SpecificFailedReason: sfs.RetryDownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: failedReason(err, sfs.RetryDownloadFailed),
 				Err: fmt.Errorf("download directly failed, err: %s", err.Error())})
 	}
 
@@ -380,13 +488,16 @@ func (exec *execDownload) downloadDirectlyWithRetry() error {
 
 			// Return detailed error with all retry attempts
 			if len(allErrors) == 1 {
-				return fmt.Errorf("download failed after %d retries, error: %v", maxRetryCount, lastErr)
+				return fmt.Errorf("download failed after %d retries, error: %w", maxRetryCount, lastErr)
 			}
-			return fmt.Errorf("download failed after %d retries, last error: %v, all errors: %v",
+			return fmt.Errorf("download failed after %d retries, last error: %w, all errors: %v",
 				maxRetryCount, lastErr, allErrors)
 		}
 
 		if err := exec.downloadDirectly(requestAwaitResponseTimeoutSeconds); err != nil {
+			if exec.ctx.Err() != nil {
+				return fmt.Errorf("download is cancelled, err: %w", err)
+			}
 			lastErr = err
 			allErrors = append(allErrors, err)
 			logger.Error("exec do download failed",
@@ -416,14 +527,31 @@ func (exec *execDownload) downloadDirectly(timeoutSeconds int) error {
 	defer exec.dl.sem.Release(1)
 
 	start := time.Now()
-	header := exec.header
+	header := exec.header.Clone()
+	// negotiate the compression, the content is decompressed while streaming
+	header.Set("Accept-Encoding", acceptEncoding)
 	body, err := exec.doRequest(http.MethodGet, header, timeoutSeconds)
 	if err != nil {
 		return err
 	}
 	defer body.Close()
 
-	if err := exec.write(body, exec.fileSize, 0); err != nil {
+	if exec.to == DownloadToFile {
+		// download the whole file again, the previous content and checkpoint are useless
+		exec.ckpt.remove()
+		if err := exec.file.Truncate(0); err != nil {
+			return fmt.Errorf("truncate the part file failed, err: %s", err.Error())
+		}
+	}
+
+	// download the whole content from the beginning
+	exec.progress.reset(0)
+	h := sha256.New()
+	if err := exec.write(body, exec.fileSize, 0, h); err != nil {
+		return err
+	}
+
+	if err := exec.verifyChecksum("direct", hex.EncodeToString(h.Sum(nil))); err != nil {
 		return err
 	}
 
@@ -435,6 +563,35 @@ func (exec *execDownload) downloadDirectly(timeoutSeconds int) error {
 	return nil
 }
 
+// downloadWithRangeAndVerify download file with range policy, and verifies the whole content after all the parts
+// are downloaded, the whole content is downloaded again if checksum is not matched.
+func (exec *execDownload) downloadWithRangeAndVerify() error {
+	var err error
+	for i := 0; i <= maxChecksumRetryCount; i++ {
+		if err = exec.downloadWithRange(); err != nil {
+			return err
+		}
+
+		var sha string
+		sha, err = exec.contentSHA256()
+		if err != nil {
+			return fmt.Errorf("calculate content SHA256 failed, err: %s", err.Error())
+		}
+
+		if err = exec.verifyChecksum("range", sha); err == nil {
+			return nil
+		}
+
+		// the completed parts can not be trusted anymore
+		if exec.ckpt != nil {
+			exec.ckpt.remove()
+		}
+		exec.progress.reset(0)
+	}
+
+	return err
+}
+
 func (exec *execDownload) downloadWithRange() error {
 	logger.Info("start download file with range",
 		slog.String("file", filepath.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)),
@@ -444,53 +601,55 @@ func (exec *execDownload) downloadWithRange() error {
 		time.Sleep(time.Millisecond * time.Duration(exec.waitTimeMil))
 	}
 
-	var start, end uint64
-	batchSize := 2 * exec.dl.balanceDownloadByteSize
-	// calculate the total parts to be downloaded
-	totalParts := int(exec.fileSize / batchSize)
-	if (exec.fileSize % batchSize) > 0 {
-		totalParts++
-	}
-
-	var hitError error
-	wg := sync.WaitGroup{}
-
-	for part := 0; part < totalParts; part++ {
-		start = uint64(part) * batchSize
-
-		if part == totalParts-1 {
-			end = exec.fileSize
-		} else {
-			end = start + batchSize
+	// the part size is decided by the tuner when the part is started, the completed parts are skipped when resuming
+	gaps := exec.pendingRanges(0)
+	if exec.to == DownloadToFile {
+		// the stale part file may be larger than the expected content
+		if err := exec.file.Truncate(int64(exec.fileSize)); err != nil {
+			return fmt.Errorf("truncate the part file failed, err: %s", err.Error())
 		}
+	}
 
-		end--
-
-		wg.Add(1)
-
-		go func(pos int, from uint64, to uint64) {
-			defer wg.Done()
+	var (
+		hitError error
+		errLock  sync.Mutex
+	)
+	setError := func(err error) {
+		errLock.Lock()
+		defer errLock.Unlock()
+		hitError = err
+	}
+	failed := func() bool {
+		errLock.Lock()
+		defer errLock.Unlock()
+		return hitError != nil
+	}
 
-			start := time.Now()
-			if err := exec.downloadOneRangedPartWithRetry(from, to); err != nil {
-				hitError = err
-				logger.Error("download file part failed",
-					slog.String("file", filepath.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)),
-					slog.Int("part", pos),
-					slog.Uint64("start", from),
-					logger.ErrAttr(err))
-				return
+	wg := sync.WaitGroup{}
+	part := 0
+	for _, gap := range gaps {
+		for from := gap.Start; from <= gap.End && !failed(); part++ {
+			if err := tuner.acquire(exec.ctx); err != nil {
+				setError(fmt.Errorf("wait for range download slot failed, err: %s", err.Error()))
+				break
+			}
+			to := from + tuner.partSize() - 1
+			if to > gap.End {
+				to = gap.End
 			}
 
-			logger.Debug("download file range part success",
-				slog.String("file", filepath.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)),
-				slog.Int("part", pos),
-				slog.Uint64("from", from),
-				slog.Uint64("to", to),
-				slog.Duration("cost", time.Since(start)))
+			wg.Add(1)
+			go func(pos int, from uint64, to uint64) {
+				defer wg.Done()
+				defer tuner.release()
 
-		}(part, start, end)
+				if err := exec.downloadRangedPart(pos, from, to); err != nil {
+					setError(err)
+				}
+			}(part, from, to)
 
+			from = to + 1
+		}
 	}
 
 	wg.Wait()
@@ -505,6 +664,27 @@ func (exec *execDownload) downloadWithRange() error {
 	return nil
 }
 
+// downloadRangedPart download a ranged part with retry and logs the result.
+func (exec *execDownload) downloadRangedPart(pos int, from uint64, to uint64) error {
+	start := time.Now()
+	if err := exec.downloadOneRangedPartWithRetry(from, to); err != nil {
+		logger.Error("download file part failed",
+			slog.String("file", filepath.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)),
+			slog.Int("part", pos),
+			slog.Uint64("start", from),
+			logger.ErrAttr(err))
+		return err
+	}
+
+	logger.Debug("download file range part success",
+		slog.String("file", filepath.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)),
+		slog.Int("part", pos),
+		slog.Uint64("from", from),
+		slog.Uint64("to", to),
+		slog.Duration("cost", time.Since(start)))
+	return nil
+}
+
 func (exec *execDownload) downloadOneRangedPartWithRetry(start uint64, end uint64) error {
 	retry := tools.NewRetryPolicy(1, [2]uint{500, 10000})
 	maxRetryCount := 5
@@ -533,6 +713,9 @@ func (exec *execDownload) downloadOneRangedPartWithRetry(start uint64, end uint6
 		}
 
 		if err := exec.downloadOneRangedPart(start, end); err != nil {
+			if exec.ctx.Err() != nil {
+				return fmt.Errorf("download file part (bytes %d-%d) is cancelled, err: %w", start, end, err)
+			}
 			lastErr = err
 			allErrors = append(allErrors, err)
 			logger.Error("download file part failed",
@@ -562,7 +745,12 @@ func (exec *execDownload) downloadOneRangedPart(start uint64, end uint64) error
 	}
 	defer exec.dl.sem.Release(1)
 
+	exec.progress.partStart(start, end)
+	defer exec.progress.partEnd(start)
+
 	header := exec.header.Clone()
+	// the range is the offset of the uncompressed content, so the compression is disabled
+	header.Set("Accept-Encoding", identityEncoding)
 	// set ranged part.
 	if start == end {
 		header.Set("Range", fmt.Sprintf("bytes=%d-", start))
@@ -570,17 +758,34 @@ func (exec *execDownload) downloadOneRangedPart(start uint64, end uint64) error
 		header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 	}
 
+	begin := time.Now()
 	body, err := exec.doRequest(http.MethodGet, header, 6*requestAwaitResponseTimeoutSeconds)
 	if err != nil {
+		if exec.ctx.Err() == nil {
+			tuner.observe(0, 0, err)
+		}
 		return err
 	}
 
 	defer body.Close()
 
-	if err := exec.write(body, end-start+1, start); err != nil {
+	h := sha256.New()
+	err = exec.write(body, end-start+1, start, h)
+	if exec.ctx.Err() == nil {
+		tuner.observe(end-start+1, time.Since(begin), err)
+	}
+	if err != nil {
 		return err
 	}
 
+	if exec.ckpt != nil {
+		r := byteRange{Start: start, End: end, SHA256: hex.EncodeToString(h.Sum(nil))}
+		if err := exec.ckpt.done(r); err != nil {
+			// the range is downloaded, failed to record checkpoint only affects resuming
+			logger.Warn("record download checkpoint failed", logger.ErrAttr(err))
+		}
+	}
+
 	return nil
 }
 
@@ -612,13 +817,21 @@ func (exec *execDownload) doRequest(method string, header http.Header, timeoutSe
 		return nil, fmt.Errorf("request to provider, but returned with http code: %d", resp.StatusCode)
 	}
 
-	return resp.Body, nil
+	return decodeBody(resp)
 }
 
-func (exec *execDownload) write(body io.ReadCloser, expectSize uint64, start uint64) error {
+// write the response body to the target, h is optional to calculate the hash of the written content.
+func (exec *execDownload) write(body io.ReadCloser, expectSize uint64, start uint64, h hash.Hash) (
+	retErr error) {
 	totalSize := uint64(0)
 	swap := swapPool.Get().(*[]byte)
 	defer swapPool.Put(swap)
+	defer func() {
+		// the written content will be downloaded again
+		if retErr != nil {
+			exec.progress.sub(totalSize)
+		}
+	}()
 	for {
 		select {
 		case <-exec.ctx.Done():
@@ -633,6 +846,12 @@ func (exec *execDownload) write(body io.ReadCloser, expectSize uint64, start uin
 		// that happen after reading some bytes and also both of the
 		// allowed EOF behaviors.
 		if picked > 0 {
+			for _, limiter := range exec.dl.limiters {
+				if e := limiter.wait(exec.ctx, picked); e != nil {
+					return fmt.Errorf("wait for download bandwidth failed, err: %s", e.Error())
+				}
+			}
+
 			var cnt int
 			switch exec.to {
 			case DownloadToBytes:
@@ -649,6 +868,11 @@ func (exec *execDownload) write(body io.ReadCloser, expectSize uint64, start uin
 				}
 			}
 
+			if h != nil {
+				_, _ = h.Write((*swap)[0:picked])
+			}
+			exec.progress.add(picked)
+
 			totalSize += uint64(picked)
 		}
 
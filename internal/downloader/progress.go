@@ -0,0 +1,239 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
+	"go.uber.org/atomic"
+)
+
+// progressInterval is the min interval of publishing the progress of a file.
+const progressInterval = 500 * time.Millisecond
+
+var hub = &progressHub{listeners: make(map[uint64]ProgressListener)}
+
+// Progress is the download progress of a file.
+type Progress struct {
+	// File is the path and name of the config item.
+	File string
+	// Signature is the sha256 of the content.
+	Signature string
+	// DoneBytes is the downloaded bytes.
+	DoneBytes uint64
+	// TotalBytes is the total bytes of the content.
+	TotalBytes uint64
+	// BytesPerSecond is the average download rate of the current run.
+	BytesPerSecond float64
+	// ETA is the estimated remaining time.
+	ETA time.Duration
+	// ActiveParts is the range parts being downloaded.
+	ActiveParts [][2]uint64
+	// AsyncStatus is the status of the p2p download task, empty if the file is not downloaded via p2p.
+	AsyncStatus string
+	// Done is whether the file is downloaded.
+	Done bool
+}
+
+// ProgressListener receives the download progress events, it must not block.
+type ProgressListener func(p Progress)
+
+// progressHub dispatches the progress events to the listeners.
+type progressHub struct {
+	lock      sync.RWMutex
+	listeners map[uint64]ProgressListener
+	nextID    uint64
+	count     atomic.Int32
+}
+
+// AddProgressListener adds a download progress listener, returns a function to remove it.
+func AddProgressListener(l ProgressListener) (remove func()) {
+	hub.lock.Lock()
+	id := hub.nextID
+	hub.nextID++
+	hub.listeners[id] = l
+	hub.count.Inc()
+	hub.lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			hub.lock.Lock()
+			delete(hub.listeners, id)
+			hub.count.Dec()
+			hub.lock.Unlock()
+		})
+	}
+}
+
+// PublishDone publishes the done event of the file which is not downloaded by the downloader,
+// such as copied from the cache or already exists.
+func PublishDone(fileMeta *pbfs.FileMeta) {
+	size := fileMeta.GetCommitSpec().GetContent().GetByteSize()
+	publish(Progress{
+		File:       path.Join(fileMeta.GetConfigItemSpec().GetPath(), fileMeta.GetConfigItemSpec().GetName()),
+		Signature:  fileMeta.GetCommitSpec().GetContent().GetSignature(),
+		DoneBytes:  size,
+		TotalBytes: size,
+		Done:       true,
+	})
+}
+
+// publish dispatches the progress event to all the listeners.
+func publish(p Progress) {
+	if hub.count.Load() == 0 {
+		return
+	}
+
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+	for _, l := range hub.listeners {
+		l(p)
+	}
+}
+
+// progressTracker tracks the download progress of a file.
+type progressTracker struct {
+	file      string
+	signature string
+	total     uint64
+	done      atomic.Uint64
+	// base is the done bytes when the tracker starts or resets, used to calculate the rate of the current run
+	base  uint64
+	start time.Time
+
+	lock        sync.Mutex
+	active      map[uint64]uint64
+	asyncStatus string
+	lastEmit    time.Time
+}
+
+// newProgressTracker returns a progress tracker of the file.
+func newProgressTracker(fileMeta *pbfs.FileMeta, total uint64) *progressTracker {
+	return &progressTracker{
+		file:      path.Join(fileMeta.GetConfigItemSpec().GetPath(), fileMeta.GetConfigItemSpec().GetName()),
+		signature: fileMeta.GetCommitSpec().GetContent().GetSignature(),
+		total:     total,
+		start:     time.Now(),
+		active:    make(map[uint64]uint64),
+	}
+}
+
+// reset the done bytes, e.g. resumed from checkpoint or download again from the beginning.
+func (t *progressTracker) reset(done uint64) {
+	t.lock.Lock()
+	t.done.Store(done)
+	t.base = done
+	t.start = time.Now()
+	t.lock.Unlock()
+	t.emit(false, true)
+}
+
+// add n bytes to the done bytes.
+func (t *progressTracker) add(n int) {
+	t.done.Add(uint64(n))
+	t.emit(false, false)
+}
+
+// runBytes returns the bytes downloaded in the current run.
+func (t *progressTracker) runBytes() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	done := t.done.Load()
+	if done < t.base {
+		return 0
+	}
+	return done - t.base
+}
+
+// sub n bytes from the done bytes, used when the written content will be downloaded again.
+func (t *progressTracker) sub(n uint64) {
+	t.done.Sub(n)
+}
+
+// set the done bytes, used when the done bytes are known from outside, such as async download.
+func (t *progressTracker) set(done uint64) {
+	t.done.Store(done)
+	t.emit(false, false)
+}
+
+// setAsyncStatus sets the status of the p2p download task.
+func (t *progressTracker) setAsyncStatus(status string) {
+	t.lock.Lock()
+	t.asyncStatus = status
+	t.lock.Unlock()
+}
+
+// partStart marks the range part as active.
+func (t *progressTracker) partStart(start, end uint64) {
+	t.lock.Lock()
+	t.active[start] = end
+	t.lock.Unlock()
+}
+
+// partEnd marks the range part as inactive.
+func (t *progressTracker) partEnd(start uint64) {
+	t.lock.Lock()
+	delete(t.active, start)
+	t.lock.Unlock()
+}
+
+// finish publishes the done event.
+func (t *progressTracker) finish() {
+	t.done.Store(t.total)
+	t.emit(true, true)
+}
+
+// emit publishes the progress, it is throttled unless force is true.
+func (t *progressTracker) emit(done, force bool) {
+	if hub.count.Load() == 0 {
+		return
+	}
+
+	t.lock.Lock()
+	now := time.Now()
+	if !force && now.Sub(t.lastEmit) < progressInterval {
+		t.lock.Unlock()
+		return
+	}
+	t.lastEmit = now
+
+	p := Progress{
+		File:        t.file,
+		Signature:   t.signature,
+		DoneBytes:   t.done.Load(),
+		TotalBytes:  t.total,
+		AsyncStatus: t.asyncStatus,
+		Done:        done,
+	}
+	if elapsed := now.Sub(t.start).Seconds(); elapsed > 0 && p.DoneBytes > t.base {
+		p.BytesPerSecond = float64(p.DoneBytes-t.base) / elapsed
+		if p.TotalBytes > p.DoneBytes {
+			p.ETA = time.Duration(float64(p.TotalBytes-p.DoneBytes) / p.BytesPerSecond * float64(time.Second))
+		}
+	}
+	for start, end := range t.active {
+		p.ActiveParts = append(p.ActiveParts, [2]uint64{start, end})
+	}
+	t.lock.Unlock()
+
+	sort.Slice(p.ActiveParts, func(i, j int) bool {
+		return p.ActiveParts[i][0] < p.ActiveParts[j][0]
+	})
+	publish(p)
+}
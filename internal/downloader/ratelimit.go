@@ -0,0 +1,149 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	// downloadLimiter limits the bandwidth of all the downloads in the process.
+	downloadLimiter = new(bandwidthLimiter)
+	// warmupLimiter limits the bandwidth of the cache warm-up downloads, which are also limited by downloadLimiter.
+	warmupLimiter = new(bandwidthLimiter)
+)
+
+// BandwidthSchedule limits the download bandwidth in a time range of the day.
+type BandwidthSchedule struct {
+	// Start is the offset from the midnight of local time when the schedule begins.
+	Start time.Duration
+	// End is the offset from the midnight of local time when the schedule ends, the schedule crosses the
+	// midnight if End is less than Start.
+	End time.Duration
+	// BytesPerSecond is the bandwidth limit in the time range, 0 means unlimited.
+	BytesPerSecond int64
+}
+
+// contains returns whether the time is in the schedule.
+func (s BandwidthSchedule) contains(t time.Time) bool {
+	year, month, day := t.Date()
+	offset := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	if s.Start <= s.End {
+		return offset >= s.Start && offset < s.End
+	}
+	return offset >= s.Start || offset < s.End
+}
+
+// BandwidthLimit defines the download bandwidth limit of the process.
+type BandwidthLimit struct {
+	// BytesPerSecond is the bandwidth limit of all the downloads, 0 means unlimited.
+	BytesPerSecond int64
+	// BurstBytes is the max bytes allowed to be downloaded at once, default as the bandwidth limit per second.
+	BurstBytes int64
+	// WarmupBytesPerSecond is the bandwidth limit of the cache warm-up downloads, 0 means unlimited.
+	WarmupBytesPerSecond int64
+	// Schedules overrides BytesPerSecond in the specified time range of the day, the first matched one wins.
+	Schedules []BandwidthSchedule
+}
+
+// SetBandwidthLimit sets the download bandwidth limit of the process, it takes effect immediately even if
+// there are downloads in progress.
+func SetBandwidthLimit(l BandwidthLimit) {
+	downloadLimiter.setLimit(l.BytesPerSecond, l.BurstBytes, l.Schedules)
+	warmupLimiter.setLimit(l.WarmupBytesPerSecond, l.BurstBytes, nil)
+}
+
+// bandwidthLimiter is a token bucket limiter, a token stands for a byte.
+type bandwidthLimiter struct {
+	lock           sync.Mutex
+	bytesPerSecond int64
+	burst          int64
+	schedules      []BandwidthSchedule
+	tokens         float64
+	last           time.Time
+}
+
+// setLimit resets the limit and refills the bucket.
+func (l *bandwidthLimiter) setLimit(bytesPerSecond, burst int64, schedules []BandwidthSchedule) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.bytesPerSecond = bytesPerSecond
+	l.burst = burst
+	l.schedules = schedules
+	l.last = time.Time{}
+}
+
+// limit returns the bandwidth limit at the time, the matched schedule overrides the default one.
+func (l *bandwidthLimiter) limit(now time.Time) int64 {
+	for _, s := range l.schedules {
+		if s.contains(now) {
+			return s.BytesPerSecond
+		}
+	}
+	return l.bytesPerSecond
+}
+
+// reserve takes n tokens from the bucket, returns how long to wait before the n bytes can be transferred.
+func (l *bandwidthLimiter) reserve(now time.Time, n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	rate := l.limit(now)
+	if rate <= 0 {
+		// unlimited, refill the bucket when limited again
+		l.last = time.Time{}
+		return 0
+	}
+
+	burst := l.burst
+	if burst <= 0 {
+		burst = rate
+	}
+
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * float64(rate)
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+
+	// the tokens may be negative, the following reservations wait for the debt to be paid off
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// wait blocks until n bytes are allowed to be transferred or the context is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	delay := l.reserve(time.Now(), n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
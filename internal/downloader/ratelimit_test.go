@@ -0,0 +1,71 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthScheduleContains(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		schedule BandwidthSchedule
+		at       time.Duration
+		want     bool
+	}{
+		{name: "in range", schedule: BandwidthSchedule{Start: 9 * time.Hour, End: 18 * time.Hour},
+			at: 12 * time.Hour, want: true},
+		{name: "at end", schedule: BandwidthSchedule{Start: 9 * time.Hour, End: 18 * time.Hour},
+			at: 18 * time.Hour, want: false},
+		{name: "cross midnight before", schedule: BandwidthSchedule{Start: 22 * time.Hour, End: 6 * time.Hour},
+			at: 23 * time.Hour, want: true},
+		{name: "cross midnight after", schedule: BandwidthSchedule{Start: 22 * time.Hour, End: 6 * time.Hour},
+			at: 5 * time.Hour, want: true},
+		{name: "cross midnight out", schedule: BandwidthSchedule{Start: 22 * time.Hour, End: 6 * time.Hour},
+			at: 12 * time.Hour, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.contains(day.Add(tt.at)); got != tt.want {
+				t.Errorf("contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimiterReserve(t *testing.T) {
+	l := new(bandwidthLimiter)
+	now := time.Now()
+
+	// unlimited
+	if d := l.reserve(now, 1<<30); d != 0 {
+		t.Errorf("unlimited reserve() = %v, want 0", d)
+	}
+
+	l.setLimit(100, 100, nil)
+	// the bucket is full at the beginning
+	if d := l.reserve(now, 100); d != 0 {
+		t.Errorf("first reserve() = %v, want 0", d)
+	}
+	// the bucket is empty, wait for 50 tokens
+	if d := l.reserve(now, 50); d != 500*time.Millisecond {
+		t.Errorf("second reserve() = %v, want 500ms", d)
+	}
+	// the debt is paid off after 1.5 seconds
+	if d := l.reserve(now.Add(1500*time.Millisecond), 100); d != 0 {
+		t.Errorf("third reserve() = %v, want 0", d)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// scopes tracks the download scopes and the in-flight downloads of the process.
+var scopes = &scopeRegistry{
+	active:    make(map[*Scope]struct{}),
+	cancelled: make(map[*Scope]struct{}),
+	downloads: make(map[string]*inflightDownload),
+}
+
+// Scope is the download scope of a release, it records the contents needed by the release.
+// an in-flight download is cancelled when all the scopes which need its content are cancelled,
+// so that the content shared by a superseded release and the newer one is carried over.
+type Scope struct {
+	// signatures is the sha256 of the contents needed by the release
+	signatures map[string]struct{}
+	cancelled  bool
+}
+
+// NewScope creates and activates a download scope which needs the contents of the signatures.
+func NewScope(signatures []string) *Scope {
+	s := &Scope{signatures: make(map[string]struct{}, len(signatures))}
+	for _, sig := range signatures {
+		s.signatures[sig] = struct{}{}
+	}
+
+	scopes.lock.Lock()
+	scopes.active[s] = struct{}{}
+	scopes.lock.Unlock()
+	return s
+}
+
+// Cancel deactivates the scope, and cancels the in-flight downloads which are not needed by other active scopes.
+// the downloads of the scope which are not started yet fail fast until the scope is closed.
+// the newer scope should be created before the older one is cancelled to carry over the shared contents.
+func (s *Scope) Cancel() {
+	scopes.lock.Lock()
+	defer scopes.lock.Unlock()
+
+	if _, ok := scopes.active[s]; !ok {
+		return
+	}
+	delete(scopes.active, s)
+	scopes.cancelled[s] = struct{}{}
+	s.cancelled = true
+
+	for sig, d := range scopes.downloads {
+		if _, ok := s.signatures[sig]; !ok || d.pinned || scopes.needed(sig) {
+			continue
+		}
+		logger.Info("cancel the download which is not needed by the newer release", slog.String("signature", sig))
+		d.cancel()
+	}
+}
+
+// Close deactivates the scope without cancelling any download, it is called when the release is handled.
+func (s *Scope) Close() {
+	scopes.lock.Lock()
+	defer scopes.lock.Unlock()
+	delete(scopes.active, s)
+	delete(scopes.cancelled, s)
+}
+
+// Cancelled returns whether the scope is cancelled.
+func (s *Scope) Cancelled() bool {
+	scopes.lock.Lock()
+	defer scopes.lock.Unlock()
+	return s.cancelled
+}
+
+// scopeRegistry tracks the scopes and the in-flight downloads.
+type scopeRegistry struct {
+	lock   sync.Mutex
+	active map[*Scope]struct{}
+	// cancelled is the scopes which are cancelled but whose releases are still being handled
+	cancelled map[*Scope]struct{}
+	downloads map[string]*inflightDownload
+}
+
+// inflightDownload is a download in progress, the downloads of the same content share the context.
+type inflightDownload struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	refs   int
+	// pinned means the download is started out of any scope, e.g. pull, and can not be cancelled
+	pinned bool
+}
+
+// needed returns whether the content is needed by any active scope, must be called with lock held.
+func (r *scopeRegistry) needed(signature string) bool {
+	for s := range r.active {
+		if _, ok := s.signatures[signature]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// abandoned returns whether the content is only needed by the cancelled scopes, must be called with lock held.
+func (r *scopeRegistry) abandoned(signature string) bool {
+	if r.needed(signature) {
+		return false
+	}
+	for s := range r.cancelled {
+		if _, ok := s.signatures[signature]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire returns the context of the download of the content, the returned release func must be called
+// when the download is finished. it fails with context.Canceled if the content is only needed by the
+// cancelled scopes, so that the remaining downloads of the superseded release are skipped.
+func (r *scopeRegistry) acquire(signature string) (context.Context, func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.abandoned(signature) {
+		return nil, nil, fmt.Errorf("the content %s is not needed by the newer release, %w", signature,
+			context.Canceled)
+	}
+
+	d, ok := r.downloads[signature]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		d = &inflightDownload{ctx: ctx, cancel: cancel}
+		r.downloads[signature] = d
+	}
+	d.refs++
+	if !r.needed(signature) {
+		d.pinned = true
+	}
+
+	return d.ctx, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		d.refs--
+		if d.refs == 0 {
+			d.cancel()
+			delete(r.downloads, signature)
+		}
+	}, nil
+}
+
+// context returns the context of the in-flight download of the content, or background if not found.
+func (r *scopeRegistry) context(signature string) context.Context {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if d, ok := r.downloads[signature]; ok {
+		return d.ctx
+	}
+	return context.Background()
+}
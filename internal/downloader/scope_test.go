@@ -0,0 +1,127 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	pbcommit "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/commit"
+	pbci "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/content"
+	pbfs "github.com/TencentBlueKing/bk-bscp/pkg/protocol/feed-server"
+)
+
+// blockingBackend blocks the opening of the contents until the download is cancelled, except the ready ones
+type blockingBackend struct {
+	lock    sync.Mutex
+	ready   map[string][]byte
+	opened  []string
+	started chan string
+}
+
+func (b *blockingBackend) Name() string {
+	return "blocking"
+}
+
+func (b *blockingBackend) Open(ctx context.Context, _ *pbfs.FileMeta, signature string) (io.ReadCloser, error) {
+	b.lock.Lock()
+	b.opened = append(b.opened, signature)
+	content, ok := b.ready[signature]
+	b.lock.Unlock()
+	if ok {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	b.started <- signature
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func testFileMeta(content string) *pbfs.FileMeta {
+	sum := sha256.Sum256([]byte(content))
+	return &pbfs.FileMeta{
+		ConfigItemSpec: &pbci.ConfigItemSpec{Name: content, Path: "/"},
+		CommitSpec: &pbcommit.CommitSpec{Content: &pbcontent.ContentSpec{
+			Signature: hex.EncodeToString(sum[:]), ByteSize: uint64(len(content))}},
+	}
+}
+
+func TestScopeCancelQueuedDownloads(t *testing.T) {
+	metas := []*pbfs.FileMeta{testFileMeta("a=1"), testFileMeta("b=1"), testFileMeta("c=1")}
+	signatures := make([]string, 0, len(metas))
+	for _, m := range metas {
+		signatures = append(signatures, m.CommitSpec.Content.Signature)
+	}
+	backend := &blockingBackend{
+		ready:   map[string][]byte{signatures[2]: []byte("c=1")},
+		started: make(chan string, 1),
+	}
+	d := &downloader{backends: []Backend{backend}}
+
+	old := NewScope(signatures)
+	defer old.Close()
+	// the files of the release are downloaded one by one, the later ones are queued
+	errs := make([]error, len(metas))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, m := range metas {
+			size := m.CommitSpec.Content.ByteSize
+			errs[i] = d.Download(m, "", size, DownloadToBytes, make([]byte, size), "")
+		}
+	}()
+
+	if sig := <-backend.started; sig != signatures[0] {
+		t.Fatalf("expect the first file started, got %s", sig)
+	}
+	// the newer release shares the third file only
+	newer := NewScope(signatures[2:])
+	defer newer.Close()
+	old.Cancel()
+	<-done
+
+	if !old.Cancelled() {
+		t.Fatal("expect the old scope cancelled")
+	}
+	for i, err := range errs[:2] {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expect file %d cancelled, got %v", i, err)
+		}
+	}
+	if errs[2] != nil {
+		t.Errorf("expect the shared file downloaded, got %v", errs[2])
+	}
+	// the queued file which is not needed by the newer release is not started at all
+	for _, sig := range backend.opened {
+		if sig == signatures[1] {
+			t.Fatal("expect the queued file skipped")
+		}
+	}
+
+	// the content is downloaded as usual once the cancelled release is handled
+	old.Close()
+	ctx, release, err := scopes.acquire(signatures[1])
+	if err != nil {
+		t.Fatalf("expect the content acquired after the scope closed, got %v", err)
+	}
+	release()
+	if ctx.Err() == nil {
+		t.Fatal("expect the download context released")
+	}
+}
@@ -13,6 +13,7 @@
 package upstream
 
 import (
+	"math/rand"
 	"time"
 
 	"github.com/TencentBlueKing/bk-bscp/pkg/tools"
@@ -22,20 +23,36 @@ import (
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
 )
 
-const defaultBounceIntervalHour = 1
+// DefaultBounceInterval is the default interval to rebalance the upstream server connection.
+const DefaultBounceInterval = time.Hour
+
+// BounceHandler is called when the bounce time is reached, it is used to rebalance the upstream
+// server connection, eg: drain the watch stream gracefully and then reconnect.
+type BounceHandler func() error
 
 // bounce define connect bounce manager.
 type bounce struct {
 	reconnectFunc func() error
-	intervalHour  *atomic.Uint32
+	handler       *atomic.Value
+	interval      *atomic.Duration
+	jitter        *atomic.Duration
 	st            *atomic.Bool
+	// resetCh is used to reschedule the bounce time, eg: the connection is rebalanced by others.
+	resetCh chan struct{}
+	stopCh  chan struct{}
+	stopped *atomic.Bool
 }
 
 func initBounce(reconnectFunc func() error) *bounce {
 	bc := &bounce{
-		intervalHour:  atomic.NewUint32(defaultBounceIntervalHour),
+		interval:      atomic.NewDuration(DefaultBounceInterval),
+		jitter:        atomic.NewDuration(0),
+		handler:       new(atomic.Value),
 		reconnectFunc: reconnectFunc,
 		st:            atomic.NewBool(false),
+		resetCh:       make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+		stopped:       atomic.NewBool(false),
 	}
 
 	return bc
@@ -45,38 +62,91 @@ func (b *bounce) state() bool {
 	return b.st.Load()
 }
 
-func (b *bounce) updateInterval(intervalHour uint) {
-	b.intervalHour.Store(uint32(intervalHour))
+func (b *bounce) update(interval, jitter time.Duration, handler BounceHandler) {
+	if interval <= 0 {
+		interval = DefaultBounceInterval
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	b.interval.Store(interval)
+	b.jitter.Store(jitter)
+	if handler != nil {
+		b.handler.Store(handler)
+	}
 }
 
-// enableBounce wait for the bounce to be reached and to reconnect upstream server.
-// with each call, reschedule bounce time.
+// reset reschedule the bounce time, it does not block.
+func (b *bounce) reset() {
+	select {
+	case b.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+// stop the bounce loop, it can be called multiple times.
+func (b *bounce) stop() {
+	if b.stopped.CompareAndSwap(false, true) {
+		close(b.stopCh)
+	}
+}
+
+// nextWait returns the duration to wait before next bounce, which is interval plus a random jitter.
+func (b *bounce) nextWait() time.Duration {
+	wait := b.interval.Load()
+	if jitter := b.jitter.Load(); jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(jitter))) // nolint
+	}
+	return wait
+}
+
+// doBounce call the bounce handler if set, otherwise reconnect the upstream server directly.
+func (b *bounce) doBounce() error {
+	if h, ok := b.handler.Load().(BounceHandler); ok && h != nil {
+		return h()
+	}
+	return b.reconnectFunc()
+}
+
+// enableBounce wait for the bounce to be reached and to rebalance upstream server.
+// with each call or reconnection, reschedule bounce time.
 func (b *bounce) enableBounce() {
-	if b.st.Load() {
+	if !b.st.CompareAndSwap(false, true) {
 		logger.Error("bounce is enabled state, unable to enable bounce again")
 		return
 	}
 
-	b.st.Store(true)
-
 	for {
-		intervalHour := b.intervalHour.Load()
-
-		logger.Info("start wait connect bounce, bounce interval", slog.Any("intervalHour", intervalHour))
-
-		time.Sleep(time.Duration(intervalHour) * time.Hour)
+		wait := b.nextWait()
+		logger.Info("start wait connect bounce", slog.Duration("wait", wait))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-b.stopCh:
+			timer.Stop()
+			logger.Info("connect bounce stopped")
+			return
+		case <-b.resetCh:
+			timer.Stop()
+			logger.Debug("upstream server is reconnected, reschedule connect bounce")
+			continue
+		case <-timer.C:
+		}
 
-		logger.Info("reach the bounce time and start to reconnect stream server")
+		logger.Info("reach the bounce time and start to rebalance stream server")
 
 		retry := tools.NewRetryPolicy(5, [2]uint{500, 15000})
 		for {
-			if err := b.reconnectFunc(); err != nil {
-				logger.Error("reconnect upstream server failed", logger.ErrAttr(err))
+			if b.stopped.Load() {
+				return
+			}
+			if err := b.doBounce(); err != nil {
+				logger.Error("bounce upstream server failed", logger.ErrAttr(err))
 				retry.Sleep()
 				continue
 			}
 
-			logger.Info("reconnect new upstream server success.")
+			logger.Info("bounce upstream server success.")
 			break
 		}
 	}
@@ -45,7 +45,7 @@ type Upstream interface {
 	Handshake(vas *kit.Vas, msg *pbfs.HandshakeMessage) (*pbfs.HandshakeResp, error)
 	Watch(vas *kit.Vas, payload []byte) (pbfs.Upstream_WatchClient, error)
 	Messaging(vas *kit.Vas, typ sfs.MessagingType, payload []byte) (*pbfs.MessagingResp, error)
-	EnableBounce(bounceIntervalHour uint)
+	EnableBounce(interval, jitter time.Duration, handler BounceHandler)
 	PullAppFileMeta(vas *kit.Vas, req *pbfs.PullAppFileMetaReq) (*pbfs.PullAppFileMetaResp, error)
 	PullKvMeta(vas *kit.Vas, req *pbfs.PullKvMetaReq) (*pbfs.PullKvMetaResp, error)
 	GetKvValue(vas *kit.Vas, req *pbfs.GetKvValueReq) (*pbfs.GetKvValueResp, error)
@@ -55,6 +55,7 @@ type Upstream interface {
 	AsyncDownload(vas *kit.Vas, req *pbfs.AsyncDownloadReq) (*pbfs.AsyncDownloadResp, error)
 	AsyncDownloadStatus(vas *kit.Vas, req *pbfs.AsyncDownloadStatusReq) (*pbfs.AsyncDownloadStatusResp, error)
 	GetSingleFileContent(vas *kit.Vas, req *pbfs.GetSingleFileContentReq) (pbfs.Upstream_GetSingleFileContentClient, error)
+	ConnState() (string, connectivity.State)
 	Close() error
 }
 
@@ -122,6 +123,8 @@ type upstreamClient struct {
 	wait   *blocker
 	conn   *grpc.ClientConn
 	client pbfs.UpstreamClient
+	// endpoint is the upstream server address of the current connection
+	endpoint string
 
 	// stateWatchCancel is used to cancel the state watching goroutine
 	stateWatchCancel context.CancelFunc
@@ -153,7 +156,10 @@ func (uc *upstreamClient) dial() error {
 	logger.Info("dial upstream server success", slog.String("upstream", endpoint))
 
 	uc.cancelCtx = cancel
+	uc.stateMutex.Lock()
 	uc.conn = conn
+	uc.endpoint = endpoint
+	uc.stateMutex.Unlock()
 	uc.client = pbfs.NewUpstreamClient(conn)
 
 	return nil
@@ -176,15 +182,28 @@ func (uc *upstreamClient) ReconnectUpstreamServer() error {
 	if err := uc.dial(); err != nil {
 		return fmt.Errorf("reconnect upstream server failed because of %s", err.Error())
 	}
+	// the connection has been rebalanced, reschedule the next bounce.
+	uc.bounce.reset()
 
 	return nil
 }
 
-// EnableBounce set conn reconnect interval, and start loop wait connect bounce. call multiple times,
-// you need to wait for the last bounce interval to arrive, the bounce interval of set this time
-// will take effect.
-func (uc *upstreamClient) EnableBounce(bounceIntervalHour uint) {
-	uc.bounce.updateInterval(bounceIntervalHour)
+// ConnState returns the upstream server address and the state of the current connection
+func (uc *upstreamClient) ConnState() (string, connectivity.State) {
+	uc.stateMutex.RLock()
+	defer uc.stateMutex.RUnlock()
+	if uc.conn == nil {
+		return uc.endpoint, connectivity.Shutdown
+	}
+	return uc.endpoint, uc.conn.GetState()
+}
+
+// EnableBounce set conn rebalance interval and random jitter, and start loop wait connect bounce.
+// if handler is nil, it reconnects the upstream server directly when the bounce time is reached.
+// call multiple times, you need to wait for the last bounce interval to arrive, the bounce interval
+// of set this time will take effect.
+func (uc *upstreamClient) EnableBounce(interval, jitter time.Duration, handler BounceHandler) {
+	uc.bounce.update(interval, jitter, handler)
 
 	if !uc.bounce.state() {
 		go uc.bounce.enableBounce()
@@ -285,6 +304,9 @@ func (uc *upstreamClient) handleStateChange(state connectivity.State) {
 func (uc *upstreamClient) Close() error {
 	logger.Info("closing upstream client")
 
+	// Stop connect bounce
+	uc.bounce.stop()
+
 	// Stop state watching
 	uc.stateMutex.Lock()
 	if uc.stateWatchCancel != nil {
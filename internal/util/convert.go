@@ -12,6 +12,11 @@
 
 package util
 
+import (
+	"fmt"
+	"time"
+)
+
 // TruncateString It accepts a string s and an integer maxLength as parameters,
 // If the length of string s is greater than maxLength, the first maxLength characters are
 // truncated and '...' is appended to the end.
@@ -24,3 +29,12 @@ func TruncateString(s string, maxLength int) string {
 	}
 	return s
 }
+
+// ParseClock parses the clock of the day formatted as 15:04, returns the offset from the midnight.
+func ParseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock %s, should be formatted as 15:04", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTruncateString(t *testing.T) {
@@ -56,3 +57,28 @@ func TestTruncateString(t *testing.T) {
 	fmt.Printf("Mixed test passed\n")
 	fmt.Printf("Short string test passed\n")
 }
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		clock   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{clock: "00:00", want: 0},
+		{clock: "08:30", want: 8*time.Hour + 30*time.Minute},
+		{clock: "23:59", want: 23*time.Hour + 59*time.Minute},
+		{clock: "24:00", wantErr: true},
+		{clock: "8am", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseClock(tt.clock)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseClock(%s) error = %v, wantErr %v", tt.clock, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseClock(%s) = %v, want %v", tt.clock, got, tt.want)
+		}
+	}
+}
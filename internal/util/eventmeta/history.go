@@ -0,0 +1,95 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eventmeta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// Filter filters the events of the history, the zero value fields match all events
+type Filter struct {
+	// ReleaseID is the release id of the events
+	ReleaseID uint32
+	// Status is the status of the events
+	Status EventStatus
+	// Limit is the max count of the events returned, 0 means no limit
+	Limit int
+}
+
+func (f Filter) match(releaseID uint32, status EventStatus) bool {
+	return (f.ReleaseID == 0 || f.ReleaseID == releaseID) && (f.Status == "" || f.Status == status)
+}
+
+// ListMetadata lists the history of the releases applied to the app temp dir, the latest first.
+func ListMetadata(tempDir string, filter Filter) ([]*EventMeta, error) {
+	var events []*EventMeta
+	err := eachEvent(tempDir, metadataFileName, func(line []byte) (bool, error) {
+		event := new(EventMeta)
+		if err := json.Unmarshal(line, event); err != nil {
+			return false, err
+		}
+		if filter.match(event.ReleaseID, event.Status) {
+			events = append(events, event)
+		}
+		return filter.Limit <= 0 || len(events) < filter.Limit, nil
+	})
+	return events, err
+}
+
+// ListChangeEvents lists the history of the release change events of the app temp dir, the latest first.
+func ListChangeEvents(tempDir string, filter Filter) ([]*ChangeEvent, error) {
+	var events []*ChangeEvent
+	err := eachEvent(tempDir, changeEventFileName, func(line []byte) (bool, error) {
+		event := new(ChangeEvent)
+		if err := json.Unmarshal(line, event); err != nil {
+			return false, err
+		}
+		if filter.match(event.ReleaseID, event.Status) {
+			events = append(events, event)
+		}
+		return filter.Limit <= 0 || len(events) < filter.Limit, nil
+	})
+	return events, err
+}
+
+// eachEvent calls fn with the events of the journal from the latest to the oldest until fn returns false,
+// the events which can not be decoded are skipped.
+func eachEvent(tempDir, name string, fn func(line []byte) (bool, error)) error {
+	if tempDir == "" {
+		return errors.New("the temp dir of the app can not be empty")
+	}
+	path := filepath.Join(tempDir, name)
+	lines, err := getJournal(path).readLines()
+	if err != nil {
+		return fmt.Errorf("read %s failed, err: %s", path, err.Error())
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		next, err := fn(lines[i])
+		if err != nil {
+			logger.Warn("skip the event which can not be decoded", slog.String("file", path),
+				slog.String("event", string(lines[i])), logger.ErrAttr(err))
+			continue
+		}
+		if !next {
+			return nil
+		}
+	}
+	return nil
+}
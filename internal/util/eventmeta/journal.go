@@ -0,0 +1,300 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eventmeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// retention is the count of the events retained in a journal
+var retention = constant.DefaultEventRetention
+
+// SetRetention sets the count of the events retained in the metadata and change event journals,
+// it should be set before any event is recorded, the non-positive value is ignored.
+func SetRetention(n int) {
+	if n > 0 {
+		retention = n
+	}
+}
+
+var (
+	journalsLock sync.Mutex
+	journals     = make(map[string]*journal)
+)
+
+// journal is a JSON lines file of the events, the latest event is the last line. it is compacted to the latest
+// retention events once it holds twice of them, so the file is bounded and the appends stay cheap.
+// the writes are serialized by an advisory file lock across the processes sharing the app dir, such as a cron
+// pull and a running watch, and every write is flushed to the disk. a line is written at once with its newline,
+// so a crash can only leave a partial last line, which is skipped by the readers and truncated by the next append.
+type journal struct {
+	lock sync.Mutex
+	path string
+	// count is the count of the lines in the file, -1 means not counted yet
+	count int
+	// size is the size of the file after the last write of the process, the count is recounted if the size
+	// is changed by others
+	size int64
+}
+
+// getJournal returns the journal of the file, the journal of the same file is shared in the process
+func getJournal(path string) *journal {
+	journalsLock.Lock()
+	defer journalsLock.Unlock()
+
+	j, ok := journals[path]
+	if !ok {
+		j = &journal{path: path, count: -1, size: -1}
+		journals[path] = j
+	}
+	return j
+}
+
+// lockPath returns the path of the lock file of the journal, the journal itself is not locked since it is
+// replaced on compaction
+func (j *journal) lockPath() string {
+	return filepath.Join(filepath.Dir(j.path), "."+filepath.Base(j.path)+".lock")
+}
+
+// append appends the event line to the journal, the journal is compacted before appending if it is full
+func (j *journal) append(line []byte) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	fl, err := util.LockFile(j.lockPath(), true)
+	if err != nil {
+		return err
+	}
+	defer fl.Unlock()
+
+	size, err := j.repair()
+	if err != nil {
+		return err
+	}
+	if j.count < 0 || size != j.size {
+		lines, err := j.readLines()
+		if err != nil {
+			return err
+		}
+		j.count = len(lines)
+	}
+	if j.count >= 2*retention {
+		if err = j.compact(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if size == 0 {
+		// the file may be created just now, flush its entry in the dir
+		if err = util.SyncDir(filepath.Dir(j.path)); err != nil {
+			return err
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	j.count++
+	j.size = info.Size()
+	return nil
+}
+
+// repair truncates the partial last line left by a crash, returns the size of the file
+func (j *journal) repair() (int64, error) {
+	f, err := os.OpenFile(j.path, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	const chunkSize = 4096
+	end := size
+	for end > 0 {
+		n := min(int64(chunkSize), end)
+		chunk := make([]byte, n)
+		if _, err = f.ReadAt(chunk, end-n); err != nil {
+			return 0, err
+		}
+		i := bytes.LastIndexByte(chunk, '\n')
+		if i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == size {
+		return size, nil
+	}
+
+	logger.Warn("truncate the partial last line of the journal", slog.String("file", j.path),
+		slog.String("line", string(bytes.TrimSpace(readAt(f, end, size-end)))))
+	if err = f.Truncate(end); err != nil {
+		return 0, err
+	}
+	if err = f.Sync(); err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+// readAt reads the n bytes from the offset of the file, returns nil if failed
+func readAt(f *os.File, offset, n int64) []byte {
+	b := make([]byte, min(n, 1024))
+	if _, err := f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return nil
+	}
+	return b
+}
+
+// compact rewrites the journal with the latest retention events, the file is replaced atomically so that the
+// readers without the lock never see it half-rewritten, the apps watching it should watch the dir or the rename
+func (j *journal) compact() error {
+	lines, err := j.readLines()
+	if err != nil {
+		return err
+	}
+	if len(lines) > retention {
+		lines = lines[len(lines)-retention:]
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	buf := bytes.NewBuffer(nil)
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err = util.ReplaceFile(tmp.Name(), j.path); err != nil {
+		return err
+	}
+	j.count = len(lines)
+	j.size = int64(buf.Len())
+	return nil
+}
+
+// readLines reads the lines of the journal, the oldest first. the empty lines and the broken lines which are not
+// valid JSON, such as a partial last line, are skipped.
+func (j *journal) readLines() ([][]byte, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 && json.Valid(line) {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// last reads the last valid line of the journal from the end of the file, the broken lines are skipped as
+// readLines, returns nil if the journal has no valid line.
+func (j *journal) last() ([]byte, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	const chunkSize = 4096
+	var tail []byte
+	for end > 0 {
+		n := min(int64(chunkSize), end)
+		end -= n
+		chunk := make([]byte, n)
+		if _, err = f.ReadAt(chunk, end); err != nil {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+
+		// the first line in the tail is incomplete unless the start of the file is reached
+		start := 0
+		if end > 0 {
+			i := bytes.IndexByte(tail, '\n')
+			if i < 0 {
+				continue
+			}
+			start = i + 1
+		}
+		lines := bytes.Split(tail[start:], []byte{'\n'})
+		for i := len(lines) - 1; i >= 0; i-- {
+			if line := bytes.TrimSpace(lines[i]); len(line) > 0 && json.Valid(line) {
+				return line, nil
+			}
+		}
+		tail = tail[:start]
+	}
+	return nil, nil
+}
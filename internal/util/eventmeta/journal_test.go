@@ -0,0 +1,100 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eventmeta
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalCompact(t *testing.T) {
+	dir := t.TempDir()
+	SetRetention(3)
+	defer SetRetention(100)
+
+	for i := 1; i <= 7; i++ {
+		status := EventStatusSuccess
+		if i%2 == 0 {
+			status = EventStatusFailed
+		}
+		if err := RecordChangeEvent(dir, &ChangeEvent{ReleaseID: uint32(i), Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// compacted to the latest 3 events once it holds 6, then the 7th is appended
+	b, err := os.ReadFile(filepath.Join(dir, changeEventFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 4 {
+		t.Fatalf("expect 4 events after compaction, got %d", n)
+	}
+
+	last, err := GetLatestChangeEventFromFile(dir)
+	if err != nil || last.ReleaseID != 7 {
+		t.Fatalf("unexpected latest event %+v, err: %v", last, err)
+	}
+
+	events, err := ListChangeEvents(dir, Filter{Status: EventStatusFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ReleaseID != 6 || events[1].ReleaseID != 4 {
+		t.Fatalf("unexpected failed events %+v", events)
+	}
+}
+
+func TestJournalCorruptTail(t *testing.T) {
+	dir := t.TempDir()
+	for i := 1; i <= 2; i++ {
+		if err := AppendMetadataToFile(dir, &EventMeta{ReleaseID: uint32(i), Status: EventStatusSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a crash in the middle of appending leaves a partial last line
+	path := filepath.Join(dir, metadataFileName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(`{"releaseID":3,"sta`); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	meta, exists, err := GetLatestMetadataFromFile(dir)
+	if err != nil || !exists || meta.ReleaseID != 2 {
+		t.Fatalf("expect the partial line to be skipped, got %+v, err: %v", meta, err)
+	}
+
+	// the next append truncates the partial line, even if the journal is counted by another process
+	journals = make(map[string]*journal)
+	if err = AppendMetadataToFile(dir, &EventMeta{ReleaseID: 4, Status: EventStatusSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(`"sta`+"\n")) || bytes.Count(b, []byte("\n")) != 3 {
+		t.Fatalf("expect the journal to be repaired, got %q", b)
+	}
+	meta, _, err = GetLatestMetadataFromFile(dir)
+	if err != nil || meta.ReleaseID != 4 {
+		t.Fatalf("unexpected latest metadata %+v, err: %v", meta, err)
+	}
+}
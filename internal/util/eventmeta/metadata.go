@@ -14,7 +14,6 @@
 package eventmeta
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
@@ -52,6 +51,13 @@ const (
 	EventStatusFailed EventStatus = "FAILED"
 )
 
+const (
+	// metadataFileName is the journal of the applied releases, which is also the sentinel file watched by the apps
+	metadataFileName = "metadata.json"
+	// changeEventFileName is the journal of the release change events
+	changeEventFileName = "changeevent.json"
+)
+
 // AppendMetadataToFile append metadata to file.
 func AppendMetadataToFile(tempDir string, metadata *EventMeta) error {
 	if tempDir == "" {
@@ -70,15 +76,6 @@ func AppendMetadataToFile(tempDir string, metadata *EventMeta) error {
 			sfs.SecondaryError{SpecificFailedReason: sfs.NewFolderFailed, Err: err})
 	}
 
-	metaFilePath := filepath.Join(tempDir, "metadata.json")
-
-	metaFile, err := os.OpenFile(metaFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
-			sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
-				Err: fmt.Errorf("open metadata.json failed, err: %s", err.Error())})
-	}
-	defer metaFile.Close()
 	b, err := json.Marshal(metadata)
 	if err != nil {
 		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
@@ -91,7 +88,7 @@ func AppendMetadataToFile(tempDir string, metadata *EventMeta) error {
 			sfs.SecondaryError{SpecificFailedReason: sfs.FormattingFailed,
 				Err: fmt.Errorf("compress metadata failed, err: %s", err.Error())})
 	}
-	if _, err := metaFile.WriteString(compress.String() + "\n"); err != nil {
+	if err := getJournal(filepath.Join(tempDir, metadataFileName)).append(compress.Bytes()); err != nil {
 		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
 			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
 				Err: fmt.Errorf("append metadata to metadata.json failed, err: %s", err.Error())})
@@ -110,31 +107,18 @@ func GetLatestMetadataFromFile(tempDir string) (*EventMeta, bool, error) {
 				Err: errors.New("metadata file path can not be empty")})
 	}
 
-	metaFilePath := filepath.Join(tempDir, "metadata.json")
-
-	metaFile, err := os.Open(metaFilePath)
+	lastLine, err := getJournal(filepath.Join(tempDir, metadataFileName)).last()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, false, nil
-		}
-		return nil, false, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
-			sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
-				Err: err})
-	}
-	defer metaFile.Close()
-	var lastLine string
-	scanner := bufio.NewScanner(metaFile)
-	for scanner.Scan() {
-		lastLine = scanner.Text()
-	}
-	if err := scanner.Err(); err != nil {
 		return nil, false, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
 			sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed,
 				Err: err})
 	}
+	if lastLine == nil {
+		return nil, false, nil
+	}
 
 	metadata := &EventMeta{}
-	if err := json.Unmarshal([]byte(lastLine), metadata); err != nil {
+	if err := json.Unmarshal(lastLine, metadata); err != nil {
 		return nil, false, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
 			sfs.SecondaryError{SpecificFailedReason: sfs.SerializationFailed,
 				Err: fmt.Errorf("unmarshal metadata failed, err: %s", err.Error())})
@@ -149,6 +133,12 @@ type ChangeEvent struct {
 	ReleaseID uint32 `json:"releaseID"`
 	// Status event status
 	Status EventStatus `json:"status"`
+	// FailedReason the reason of the failed event
+	FailedReason string `json:"failedReason,omitempty"`
+	// Message event message, the detail of the failed reason
+	Message string `json:"message,omitempty"`
+	// EventTime event time
+	EventTime string `json:"eventTime,omitempty"`
 }
 
 // RecordChangeEvent 记录变更的事件
@@ -165,16 +155,6 @@ func RecordChangeEvent(tempDir string, eventData *ChangeEvent) error {
 			sfs.SecondaryError{SpecificFailedReason: sfs.NewFolderFailed, Err: err})
 	}
 
-	metaFilePath := filepath.Join(tempDir, "changeevent.json")
-
-	metaFile, err := os.OpenFile(metaFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		return sfs.WrapPrimaryError(sfs.UnknownFailed,
-			sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
-				Err: fmt.Errorf("open record change event file failed, err: %s", err.Error())})
-	}
-	defer metaFile.Close()
-
 	b, err := json.Marshal(eventData)
 	if err != nil {
 		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
@@ -187,7 +167,7 @@ func RecordChangeEvent(tempDir string, eventData *ChangeEvent) error {
 			sfs.SecondaryError{SpecificFailedReason: sfs.FormattingFailed,
 				Err: fmt.Errorf("compress metadata failed, err: %s", err.Error())})
 	}
-	if _, err := metaFile.WriteString(compress.String() + "\n"); err != nil {
+	if err := getJournal(filepath.Join(tempDir, changeEventFileName)).append(compress.Bytes()); err != nil {
 		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
 			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
 				Err: fmt.Errorf("record change event failed, err: %s", err.Error())})
@@ -206,31 +186,18 @@ func GetLatestChangeEventFromFile(tempDir string) (*ChangeEvent, error) {
 				Err: errors.New("the file path for record change event is empty")})
 	}
 
-	metaFilePath := filepath.Join(tempDir, "changeevent.json")
-
-	metaFile, err := os.Open(metaFilePath)
+	lastLine, err := getJournal(filepath.Join(tempDir, changeEventFileName)).last()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
-			sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
-				Err: err})
-	}
-	defer metaFile.Close()
-	var lastLine string
-	scanner := bufio.NewScanner(metaFile)
-	for scanner.Scan() {
-		lastLine = scanner.Text()
-	}
-	if err := scanner.Err(); err != nil {
 		return nil, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
 			sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed,
 				Err: err})
 	}
+	if lastLine == nil {
+		return nil, nil
+	}
 
 	metadata := &ChangeEvent{}
-	if err := json.Unmarshal([]byte(lastLine), metadata); err != nil {
+	if err := json.Unmarshal(lastLine, metadata); err != nil {
 		return nil, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
 			sfs.SecondaryError{SpecificFailedReason: sfs.SerializationFailed,
 				Err: fmt.Errorf("unmarshal metadata failed, err: %s", err.Error())})
@@ -15,8 +15,11 @@ package util
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/user"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -31,40 +34,50 @@ func SetFilePermission(filePath string, pm *pbci.FilePermission) error {
 	}
 	defer file.Close()
 
-	mode, err := strconv.ParseInt("0"+pm.Privilege, 8, 64)
+	mode, uid, gid, err := parseFilePermission(pm)
 	if err != nil {
-		return fmt.Errorf("parse %s privilege to int failed, err: %v", pm.Privilege, err)
+		return err
 	}
 
-	if err = file.Chmod(os.FileMode(mode)); err != nil {
+	if err = file.Chmod(mode); err != nil {
 		return fmt.Errorf("file chmod %o failed, err: %v", mode, err)
 	}
 
+	if err := file.Chown(uid, gid); err != nil {
+		return fmt.Errorf("file chown %d %d failed, err: %v", uid, gid, err)
+	}
+
+	return nil
+}
+
+// parseFilePermission parses the file mode, uid and gid of the file permission.
+func parseFilePermission(pm *pbci.FilePermission) (os.FileMode, int, int, error) {
+	mode, err := strconv.ParseInt("0"+pm.Privilege, 8, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("parse %s privilege to int failed, err: %v", pm.Privilege, err)
+	}
+
 	ur, err := user.Lookup(pm.User)
 	if err != nil {
-		return fmt.Errorf("look up %s user failed, err: %v", pm.User, err)
+		return 0, 0, 0, fmt.Errorf("look up %s user failed, err: %v", pm.User, err)
 	}
 
 	uid, err := strconv.Atoi(ur.Uid)
 	if err != nil {
-		return fmt.Errorf("atoi %s uid failed, err: %v", ur.Uid, err)
+		return 0, 0, 0, fmt.Errorf("atoi %s uid failed, err: %v", ur.Uid, err)
 	}
 
 	gp, err := user.LookupGroup(pm.UserGroup)
 	if err != nil {
-		return fmt.Errorf("look up %s group failed, err: %v", pm.User, err)
+		return 0, 0, 0, fmt.Errorf("look up %s group failed, err: %v", pm.User, err)
 	}
 
 	gid, err := strconv.Atoi(gp.Gid)
 	if err != nil {
-		return fmt.Errorf("atoi %s gid failed, err: %v", gp.Gid, err)
+		return 0, 0, 0, fmt.Errorf("atoi %s gid failed, err: %v", gp.Gid, err)
 	}
 
-	if err := file.Chown(uid, gid); err != nil {
-		return fmt.Errorf("file chown %s %s failed, err: %v", ur.Uid, gp.Gid, err)
-	}
-
-	return nil
+	return os.FileMode(mode), uid, gid, nil
 }
 
 // ConvertTextLineBreak converts the text file line break type.
@@ -98,3 +111,61 @@ func ConvertTextLineBreak(filePath string, lineBreak string) error {
 	// 写回文件
 	return os.WriteFile(filePath, []byte(updatedContent), 0644)
 }
+
+// CopyFile copies the content of src file to dst file, the dst file is truncated if exists.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// SyncFile flushes the file content to the disk.
+func SyncFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// ReplaceFile renames the src file to dst file atomically, and flushes the parent directory to the disk,
+// so that the rename is durable after crash.
+func ReplaceFile(src, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	return SyncDir(filepath.Dir(dst))
+}
+
+// SyncDir flushes the entries of the directory to the disk, so that the created or renamed files in it are
+// durable after crash.
+func SyncDir(path string) error {
+	// windows does not support to sync the directory
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by TryLockFile if the file is locked by others
+var ErrLocked = errors.New("file is locked by others")
+
+// FileLock is an advisory lock of a file, it is held by the open file rather than the process,
+// so it also excludes the goroutines of the same process which lock the file separately.
+type FileLock struct {
+	f    *os.File
+	path string
+}
+
+// LockFile acquires the advisory lock of the file, it blocks until the lock is acquired. the lock is exclusive
+// or shared, the lock file is created if not exists.
+func LockFile(path string, exclusive bool) (*FileLock, error) {
+	return lockFile(path, exclusive, true)
+}
+
+// TryLockFile acquires the advisory lock of the file without blocking, returns ErrLocked if the lock is held by
+// others in the conflicting mode.
+func TryLockFile(path string, exclusive bool) (*FileLock, error) {
+	return lockFile(path, exclusive, false)
+}
+
+func lockFile(path string, exclusive, block bool) (*FileLock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = lockFd(f, exclusive, block); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		// the lock file may be removed by the last holder before the lock is acquired, which no one else
+		// will lock any more, so lock the file at the path again
+		locked, err := f.Stat()
+		if err != nil {
+			_ = unlockFd(f)
+			_ = f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return &FileLock{f: f, path: path}, nil
+		}
+		_ = unlockFd(f)
+		_ = f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	err := unlockFd(l.f)
+	if e := l.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Remove removes the lock file and releases the lock, it must be called with the exclusive lock held,
+// the waiters of the lock will lock the re-created lock file.
+func (l *FileLock) Remove() error {
+	return removeLock(l)
+}
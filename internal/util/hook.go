@@ -13,6 +13,8 @@
 package util
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -20,6 +22,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/TencentBlueKing/bk-bscp/pkg/dal/table"
 	pbhook "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/hook"
@@ -39,11 +42,19 @@ const (
 	executeBatCmd = "cmd"
 	// executePowershellCmd powershell script executor
 	executePowershellCmd = "powershell"
+
+	// hookTimeoutTag is the prefix of the hook tag which overrides the timeout of the hook, eg: timeout=90s
+	hookTimeoutTag = "timeout="
 )
 
-// ExecuteHook executes the hook.
+// hookKillGracePeriod is the period between terminating and killing the hook process group on timeout,
+// it also bounds the wait for the output of the processes left by the hook
+var hookKillGracePeriod = 10 * time.Second
+
+// ExecuteHook executes the hook, the hook is killed with the processes it spawns if it is not finished in the
+// timeout, which is overridden by the timeout tag of the hook. 0 means no timeout.
 func ExecuteHook(hook *pbhook.HookSpec, hookType table.HookType,
-	tempDir string, biz uint32, app string, relName string) error {
+	tempDir string, biz uint32, app string, relName string, timeout time.Duration) error {
 	appTempDir := filepath.Join(tempDir, strconv.Itoa(int(biz)), app)
 	hookEnvs := []string{
 		fmt.Sprintf("%s=%s", env.HookAppTempDir, appTempDir),
@@ -78,8 +89,14 @@ func ExecuteHook(hook *pbhook.HookSpec, hookType table.HookType,
 	cmd := exec.Command(command, args...)
 	cmd.Dir = appTempDir
 	cmd.Env = append(os.Environ(), hookEnvs...)
-	out, err := cmd.CombinedOutput()
+	out, err := runHook(cmd, hookTimeout(hook, timeout))
 	if err != nil {
+		// sf-share has no specific failed reason of timeout yet, keep ErrHookTimeout in the error chain
+		// so that the caller can tell it
+		if errors.Is(err, ErrHookTimeout) {
+			return sfs.WrapSecondaryError(sfs.ScriptExecutionFailed,
+				fmt.Errorf("exec %s error: %w, output: %s", hookType.String(), err, string(out)))
+		}
 		return sfs.WrapSecondaryError(sfs.ScriptExecutionFailed,
 			fmt.Errorf("exec %s error: %s, output: %s", hookType.String(), err.Error(), string(out)))
 	}
@@ -87,6 +104,105 @@ func ExecuteHook(hook *pbhook.HookSpec, hookType table.HookType,
 	return nil
 }
 
+// ErrHookTimeout is the error of the hook which is killed on timeout
+var ErrHookTimeout = errors.New("hook execution timeout")
+
+// hookTimeout returns the timeout of the hook, the timeout tag of the hook overrides the default one
+func hookTimeout(hook *pbhook.HookSpec, timeout time.Duration) time.Duration {
+	for _, tag := range hook.Tags {
+		if !strings.HasPrefix(tag, hookTimeoutTag) {
+			continue
+		}
+		value := strings.TrimPrefix(tag, hookTimeoutTag)
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			// 不带单位时按秒处理
+			seconds, e := strconv.Atoi(value)
+			if e != nil {
+				logger.Warn("ignore the invalid hook timeout tag", slog.String("hook", hook.Name),
+					slog.String("tag", tag))
+				continue
+			}
+			d = time.Duration(seconds) * time.Second
+		}
+		if d < 0 {
+			d = 0
+		}
+		return d
+	}
+	return timeout
+}
+
+// runHook runs the hook in its own process group and returns the combined output, the process group is
+// terminated and then killed after a grace period if the hook is not finished in the timeout.
+func runHook(cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// 钩子退出后其启动的后台进程可能仍持有输出，不再等待其输出
+	cmd.WaitDelay = hookKillGracePeriod
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	if timeout <= 0 {
+		return out.Bytes(), waitHook(<-done)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return out.Bytes(), waitHook(err)
+	case <-timer.C:
+	}
+
+	logger.Warn("hook execution timeout, terminate it", slog.Int("pid", cmd.Process.Pid),
+		slog.Duration("timeout", timeout))
+	if err := terminateProcessGroup(cmd); err != nil {
+		logger.Warn("terminate hook process group failed", slog.Int("pid", cmd.Process.Pid), logger.ErrAttr(err))
+	}
+	// the hook may exit on SIGTERM while the processes it spawns ignore it, so the process group is killed after
+	// the grace period whether the hook exits or not, unless all the processes in it exit
+	grace := time.NewTimer(hookKillGracePeriod)
+	defer grace.Stop()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	exited := false
+	for !exited || processGroupAlive(cmd) {
+		select {
+		case <-done:
+			exited = true
+		case <-tick.C:
+		case <-grace.C:
+			logger.Warn("hook process group is not terminated in the grace period, kill it",
+				slog.Int("pid", cmd.Process.Pid))
+			if err := killProcessGroup(cmd); err != nil {
+				logger.Warn("kill hook process group failed", slog.Int("pid", cmd.Process.Pid), logger.ErrAttr(err))
+			}
+			if !exited {
+				<-done
+			}
+			return out.Bytes(), fmt.Errorf("%w after %s", ErrHookTimeout, timeout)
+		}
+	}
+	return out.Bytes(), fmt.Errorf("%w after %s", ErrHookTimeout, timeout)
+}
+
+// waitHook ignores the error of the background processes left by the hook which hold the output
+func waitHook(err error) error {
+	if errors.Is(err, exec.ErrWaitDelay) {
+		logger.Warn("the processes started by the hook still hold the output, stop waiting for them")
+		return nil
+	}
+	return err
+}
+
 func saveContentToFile(workspace string, hook *pbhook.HookSpec, hookType table.HookType, hookEnvs []string) (string,
 	error) {
 	hookDir := filepath.Join(workspace, "hooks")
@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TencentBlueKing/bk-bscp/pkg/dal/table"
+	pbhook "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/hook"
+	sfs "github.com/TencentBlueKing/bk-bscp/pkg/sf-share"
+)
+
+func TestExecuteHookTimeout(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	hook := &pbhook.HookSpec{
+		Name: "hang",
+		Type: "shell",
+		// the tag overrides the timeout passed in
+		Tags:    []string{"timeout=1s"},
+		Content: "sleep 60 &\necho $! > " + pidFile + "\nsleep 60\n",
+	}
+
+	start := time.Now()
+	err := ExecuteHook(hook, table.PreHook, dir, 1, "app", "v1", time.Hour)
+	var e sfs.SecondaryError
+	if !errors.As(err, &e) || e.SpecificFailedReason != sfs.ScriptExecutionFailed || !errors.Is(e.Err, ErrHookTimeout) {
+		t.Fatalf("expect the hook timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > hookKillGracePeriod {
+		t.Fatalf("expect the hook to be terminated in time, took %s", elapsed)
+	}
+
+	// the process spawned by the hook is terminated with the hook
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(b[:len(b)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// the killed process may be left as a zombie if its new parent does not reap it
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Fatalf("expect the child process %d of the hook to be killed, stat: %s", pid, stat)
+	}
+}
+
+func TestExecuteHookTimeoutKillsTrappedChild(t *testing.T) {
+	grace := hookKillGracePeriod
+	hookKillGracePeriod = time.Second
+	defer func() { hookKillGracePeriod = grace }()
+
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	hook := &pbhook.HookSpec{
+		Name: "trap",
+		Type: "shell",
+		// the hook exits on SIGTERM, while its child ignores it
+		Content: "sh -c 'trap \"\" TERM; echo $$ > " + pidFile + "; while true; do sleep 0.1; done' &\n" +
+			"sleep 60\n",
+	}
+
+	err := ExecuteHook(hook, table.PostHook, dir, 1, "app", "v1", time.Second)
+	var e sfs.SecondaryError
+	if !errors.As(err, &e) || !errors.Is(e.Err, ErrHookTimeout) {
+		t.Fatalf("expect the hook timeout error, got %v", err)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strings.TrimSpace(string(b))
+	time.Sleep(100 * time.Millisecond)
+	// the child is killed after the grace period though the hook exits on SIGTERM
+	stat, err := os.ReadFile("/proc/" + pid + "/stat")
+	if err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Fatalf("expect the child process %s of the hook to be killed, stat: %s", pid, stat)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !windows
+
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	pbci "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/config-item"
+)
+
+// HardLinkCount returns the count of the hard links of the file.
+func HardLinkCount(filePath string) (uint64, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("stat of file %s is not supported", filePath)
+	}
+	return uint64(st.Nlink), nil // nolint: unconvert
+}
+
+// FilePermissionMatched returns whether the mode and owner of the file are the same as the file permission.
+func FilePermissionMatched(filePath string, pm *pbci.FilePermission) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("stat of file %s is not supported", filePath)
+	}
+	mode, uid, gid, err := parseFilePermission(pm)
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().Perm() == mode.Perm() && int(st.Uid) == uid && int(st.Gid) == gid, nil
+}
@@ -0,0 +1,28 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	pbci "github.com/TencentBlueKing/bk-bscp/pkg/protocol/core/config-item"
+)
+
+// HardLinkCount returns the count of the hard links of the file, hard link is not used on windows.
+func HardLinkCount(_ string) (uint64, error) {
+	return 1, nil
+}
+
+// FilePermissionMatched returns whether the mode and owner of the file are the same as the file permission,
+// the file permission is not supported on windows.
+func FilePermissionMatched(_ string, _ *pbci.FilePermission) (bool, error) {
+	return false, nil
+}
@@ -21,6 +21,16 @@ const (
 	namespace = "bscp_go"
 )
 
+// the label values of the cache metrics
+const (
+	// CacheFile is the file cache
+	CacheFile = "file"
+	// CacheKv is the in-memory kv cache
+	CacheKv = "kv"
+	// CacheKvDisk is the on-disk kv cache
+	CacheKvDisk = "kv_disk"
+)
+
 var (
 	// ReleaseChangeCallbackCounter is the counter of release change event callback
 	ReleaseChangeCallbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -36,10 +46,124 @@ var (
 		Help:      "the handing time(seconds) of release change callback",
 		Buckets:   []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
 	}, []string{"app", "status", "release"})
+
+	// DownloadChecksumFailedCounter is the counter of downloaded content which sha256 is not match with the signature
+	DownloadChecksumFailedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_download_checksum_failed_count",
+		Help:      "the total count of downloaded content which SHA256 is not match with the signature",
+	}, []string{"mode"})
+
+	// DownloadReceivedBytesCounter is the counter of bytes received from the repository, which are compressed
+	// if the content encoding is negotiated
+	DownloadReceivedBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_download_received_bytes",
+		Help:      "the total bytes received from the repository, compressed if content encoding is negotiated",
+	}, []string{"encoding"})
+
+	// DownloadDecodedBytesCounter is the counter of bytes of the downloaded content after decompression
+	DownloadDecodedBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_download_decoded_bytes",
+		Help:      "the total bytes of the downloaded content after decompression",
+	}, []string{"encoding"})
+
+	// AsyncDownloadFallbackCounter is the counter of async p2p downloads which fall back to http download
+	AsyncDownloadFallbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_async_download_fallback_count",
+		Help:      "the total count of async p2p downloads which fall back to http download",
+	}, []string{"reason"})
+
+	// DownloadCancelledCounter is the counter of downloads cancelled because they are superseded by a newer release
+	DownloadCancelledCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_download_cancelled_count",
+		Help:      "the total count of downloads cancelled because they are superseded by a newer release",
+	})
+
+	// DownloadCancelledBytesCounter is the counter of bytes downloaded by the cancelled downloads
+	DownloadCancelledBytesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_download_cancelled_bytes",
+		Help:      "the total bytes downloaded by the downloads which are cancelled before completed",
+	})
+
+	// CacheHitCounter is the counter of cache hits
+	CacheHitCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_cache_hit_count",
+		Help:      "the total count of cache hits",
+	}, []string{"cache"})
+
+	// CacheMissCounter is the counter of cache misses
+	CacheMissCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_cache_miss_count",
+		Help:      "the total count of cache misses",
+	}, []string{"cache"})
+
+	// CacheEvictionCounter is the counter of cache entries evicted to free space
+	CacheEvictionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_cache_eviction_count",
+		Help:      "the total count of cache entries evicted to free space",
+	}, []string{"cache"})
+
+	// CacheServedBytesCounter is the counter of bytes served from the cache
+	CacheServedBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_cache_served_bytes",
+		Help:      "the total bytes served from the cache",
+	}, []string{"cache"})
+
+	// CacheOversizedSkipCounter is the counter of entries not cached because they are too large
+	CacheOversizedSkipCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_cache_oversized_skip_count",
+		Help:      "the total count of entries not cached because they are larger than the single entry limit",
+	}, []string{"cache"})
+
+	// CacheSizeBytes is the current size of the cache
+	CacheSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_size_bytes",
+		Help:      "the current size of the cache in bytes",
+	}, []string{"cache"})
+
+	// CacheThresholdBytes is the size threshold of the cache which triggers the cleanup
+	CacheThresholdBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_threshold_bytes",
+		Help:      "the size threshold of the cache in bytes, the cache is cleaned up beyond it",
+	}, []string{"cache"})
+
+	// CacheCleanupSecond is the histogram of cache cleanup time(seconds)
+	CacheCleanupSecond = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cache_cleanup_second",
+		Help:      "the time(seconds) of cache cleanup",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
+	}, []string{"cache"})
 )
 
 // RegisterMetrics will register the mtrics
 func RegisterMetrics() {
 	prometheus.MustRegister(ReleaseChangeCallbackCounter)
 	prometheus.MustRegister(ReleaseChangeCallbackHandingSecond)
+	prometheus.MustRegister(DownloadChecksumFailedCounter)
+	prometheus.MustRegister(DownloadReceivedBytesCounter)
+	prometheus.MustRegister(DownloadDecodedBytesCounter)
+	prometheus.MustRegister(AsyncDownloadFallbackCounter)
+	prometheus.MustRegister(DownloadCancelledCounter)
+	prometheus.MustRegister(DownloadCancelledBytesCounter)
+	prometheus.MustRegister(CacheHitCounter)
+	prometheus.MustRegister(CacheMissCounter)
+	prometheus.MustRegister(CacheEvictionCounter)
+	prometheus.MustRegister(CacheServedBytesCounter)
+	prometheus.MustRegister(CacheOversizedSkipCounter)
+	prometheus.MustRegister(CacheSizeBytes)
+	prometheus.MustRegister(CacheThresholdBytes)
+	prometheus.MustRegister(CacheCleanupSecond)
 }